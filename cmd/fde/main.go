@@ -18,9 +18,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -28,13 +33,21 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/ivajloip/fitbit-data-exporter/internal/algorithm"
+	"github.com/ivajloip/fitbit-data-exporter/internal/health"
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/mqtt"
 	client "github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source/api"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source/applehealth"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source/fit"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source/gadgetbridge"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source/offline"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage/influxdb"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage/postgresql"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage/remotewrite"
 )
 
 var version string // set by the compiler
@@ -85,12 +98,69 @@ func main() {
 			Usage:  "InfluxDB Password",
 			EnvVar: "FDE_INFLUXDB_PASSWORD",
 		},
+		cli.StringFlag{
+			Name:   "remote-write-url",
+			Usage:  "Prometheus remote-write URL (ex. http://localhost:8428/api/v1/write)",
+			EnvVar: "FDE_REMOTE_WRITE_URL",
+		},
+		cli.StringFlag{
+			Name:   "prometheus-query-url",
+			Usage:  "Prometheus HTTP API URL of the remote-write store, used to check which days are present (ex. http://localhost:8428)",
+			EnvVar: "FDE_PROMETHEUS_QUERY_URL",
+		},
 		cli.IntFlag{
 			Name:   "log-level",
 			Value:  4,
 			Usage:  "debug=5, info=4, warning=3, error=2, fatal=1, panic=0",
 			EnvVar: "FDE_LOG_LEVEL",
 		},
+		cli.StringFlag{
+			Name:   "series",
+			Usage:  fmt.Sprintf("Comma separated series to sync along with the heart rate, among %v. Reading them from the api needs their scopes", strings.Join(model.SeriesNames(), ", ")),
+			EnvVar: "FDE_SERIES",
+		},
+		cli.StringFlag{
+			Name:   "timezone",
+			Usage:  "Time zone of the readings (ex. Europe/Sofia), by default the one of the Fitbit profile for api, which needs the profile scope, and the local one for offline",
+			EnvVar: "FDE_TIMEZONE",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "Address on which the Prometheus metrics are served at /metrics (ex. :9090), disabled if empty",
+			EnvVar: "FDE_METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-url",
+			Usage:  "MQTT broker to which the latest readings are published (ex. tcp://localhost:1883), disabled if empty",
+			EnvVar: "FDE_MQTT_URL",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-username",
+			Usage:  "",
+			EnvVar: "FDE_MQTT_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-password",
+			Usage:  "",
+			EnvVar: "FDE_MQTT_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-topic",
+			Usage:  "Topic under which the latest readings are published, fitbit/<username> if empty",
+			EnvVar: "FDE_MQTT_TOPIC",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-discovery-prefix",
+			Value:  "homeassistant",
+			Usage:  "Prefix of the Home Assistant MQTT discovery topics, disabled if empty",
+			EnvVar: "FDE_MQTT_DISCOVERY_PREFIX",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  30 * time.Second,
+			Usage:  "Time given to the work in progress to finish and to the readings to be flushed when stopping",
+			EnvVar: "FDE_SHUTDOWN_TIMEOUT",
+		},
 		cli.StringFlag{
 			Name:   "record-cpu-statistics-path",
 			Usage:  "record CPU statistics path (ex. /tmp/fde_cpu.prof)",
@@ -106,39 +176,81 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "dirpath",
-					Usage:  "Path to folder containing the json heartrate data files",
+					Usage:  "Path to folder containing the json or csv heartrate data files",
 					EnvVar: "FDE_DIR_PATH",
 				},
+				cli.StringFlag{
+					Name:   "file-prefix",
+					Value:  "heart_rate",
+					Usage:  "Prefix of the heart rate files, named prefix-yyyy-mm-dd.json or .csv",
+					EnvVar: "FDE_FILE_PREFIX",
+				},
+				cli.StringFlag{
+					Name:   "csv-columns",
+					Usage:  "Columns of the csv files (ex. time=Timestamp,value=BPM,confidence=Conf), by default found among common names",
+					EnvVar: "FDE_CSV_COLUMNS",
+				},
 			},
 		},
 		cli.Command{
-			Name:    "api",
-			Aliases: []string{"a"},
-			Usage:   "Reads data from online api and uploads it in the provided database",
-			Action:  runAPI,
+			Name:   "fit",
+			Usage:  "Reads the records of the FIT files of Garmin and other devices and uploads their heart rate and, if the database keeps the series, all of them in the provided database",
+			Action: runFIT,
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:   "conf-file",
-					Value:  confDir + "/fitbit-oauth2.json",
-					Usage:  "",
-					EnvVar: "FDE_API_OAUTH2_CONF_FILE",
+					Name:   "dirpath",
+					Usage:  "Path to folder containing the .fit files, ex. the Activity folder of the device, searched recursively",
+					EnvVar: "FDE_FIT_DIR_PATH",
 				},
 				cli.StringFlag{
-					Name:   "bind-addr",
-					Value:  "127.0.0.1:5556",
-					Usage:  "",
-					EnvVar: "FDE_API_BIND_ADDR",
+					Name:   "source",
+					Value:  "garmin",
+					Usage:  "Source tag of the records, telling the devices apart",
+					EnvVar: "FDE_FIT_SOURCE",
 				},
+			},
+		},
+		cli.Command{
+			Name:   "apple-health",
+			Usage:  "Reads the heart rate and, if the database keeps the series, the steps and the resting heart rate of an Apple Health export and uploads them in the provided database",
+			Action: runAppleHealth,
+			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:   "client-id",
-					Usage:  "",
-					EnvVar: "FDE_API_CLIENT_ID",
+					Name:   "file",
+					Usage:  "Path to the export.xml file of the export, or the export.zip holding it",
+					EnvVar: "FDE_APPLE_HEALTH_FILE",
+				},
+				cli.IntFlag{
+					Name:   "max-records",
+					Value:  applehealth.DefaultMaxRecords,
+					Usage:  "Maximum number of records kept in memory while reading the export, the others are written to temporary files",
+					EnvVar: "FDE_APPLE_HEALTH_MAX_RECORDS",
+				},
+			},
+		},
+		cli.Command{
+			Name:   "gadgetbridge",
+			Usage:  "Reads the heart rate and, if the database keeps the series, the steps and the sleep stages of a Gadgetbridge database export and uploads them in the provided database",
+			Action: runGadgetbridge,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "file",
+					Usage:  "Path to the exported database",
+					EnvVar: "FDE_GADGETBRIDGE_FILE",
 				},
 				cli.StringFlag{
-					Name:   "client-secret",
-					Usage:  "",
-					EnvVar: "FDE_API_CLIENT_SECRET",
+					Name:   "sleep-kinds",
+					Usage:  "Raw kinds of the sleep samples of the devices, by table (ex. PEBBLE_HEALTH_ACTIVITY_SAMPLE:1=light,2=deep;...), those of MI_BAND_ACTIVITY_SAMPLE being known",
+					EnvVar: "FDE_GADGETBRIDGE_SLEEP_KINDS",
 				},
+			},
+		},
+		cli.Command{
+			Name:    "api",
+			Aliases: []string{"a"},
+			Usage:   "Reads data from online api and uploads it in the provided database",
+			Action:  runAPI,
+			Flags: append(oauth2Flags(confDir),
 				cli.StringFlag{
 					Name:   "base-url",
 					Value:  "https://api.fitbit.com/1/user/-/activities/heart/date",
@@ -156,12 +268,171 @@ func main() {
 					Usage:  "",
 					EnvVar: "FDE_API_DAEMON",
 				},
+				cli.DurationFlag{
+					Name:   "sync-interval",
+					Value:  24 * time.Hour,
+					Usage:  "Interval between the syncs in daemon mode, must be positive",
+					EnvVar: "FDE_API_SYNC_INTERVAL",
+				},
+				cli.DurationFlag{
+					Name:   "max-sync-age",
+					Usage:  "Age of the last successful sync after which /healthz fails in daemon mode, twice the sync-interval if 0",
+					EnvVar: "FDE_API_MAX_SYNC_AGE",
+				},
+				cli.BoolFlag{
+					Name:   "latest",
+					Usage:  "Export the latest heart rate, resting heart rate and steps as Prometheus gauges and/or to MQTT, refreshed on every sync in daemon mode (needs metrics-addr or mqtt-url and the activity scope). Without a database, only the latest readings are exported",
+					EnvVar: "FDE_API_LATEST",
+				},
+				cli.BoolFlag{
+					Name:   "devices",
+					Usage:  "Poll the devices on every sync, keeping their battery level and last sync, and wait for the trackers to sync the days before syncing them (needs the settings scope)",
+					EnvVar: "FDE_API_DEVICES",
+				},
+				cli.StringFlag{
+					Name:   "endpoints",
+					Usage:  "Path to a json file of endpoints read as series, with a url template and the paths of the values in the responses (see the README)",
+					EnvVar: "FDE_API_ENDPOINTS",
+				},
+				cli.StringFlag{
+					Name:   "api-url",
+					Value:  api.URL,
+					Usage:  "Root of the Fitbit web API resources of the user",
+					EnvVar: "FDE_API_URL",
+				},
+			),
+		},
+		cli.Command{
+			Name:  "auth",
+			Usage: "Manages the credentials used to access the online api",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:   "login",
+					Usage:  "Authorizes the application and stores the obtained token",
+					Action: runAuthLogin,
+					Flags:  oauth2Flags(confDir),
+				},
+				cli.Command{
+					Name:   "status",
+					Usage:  "Shows the expiry, the granted scopes and the user of the stored token",
+					Action: runAuthStatus,
+					Flags:  oauth2Flags(confDir),
+				},
+				cli.Command{
+					Name:   "refresh",
+					Usage:  "Refreshes the stored token",
+					Action: runAuthRefresh,
+					Flags:  oauth2Flags(confDir),
+				},
+				cli.Command{
+					Name:   "revoke",
+					Usage:  "Revokes the stored token and removes it",
+					Action: runAuthRevoke,
+					Flags:  oauth2Flags(confDir),
+				},
 			},
 		},
 	}
 	err = app.Run(os.Args)
 	if err != nil {
-		log.WithError(err).Fatal("Execution error")
+		log.WithError(err).Error("Execution error")
+		os.Exit(exitCode(err))
+	}
+}
+
+// The exit status of the failed runs. Usage errors exit with 1 too.
+const (
+	exitFailure = 1
+	// exitLoginRequired means that the token is missing or was revoked, so
+	// restarting does not help until auth login is run.
+	exitLoginRequired = 2
+	// exitShutdownTimeout means that the work in progress was abandoned
+	// while stopping.
+	exitShutdownTimeout = 3
+)
+
+type exitError struct {
+	code int
+	msg  string
+}
+
+func newExitError(code int, template string, params ...interface{}) error {
+	return &exitError{code: code, msg: fmt.Sprintf(template, params...)}
+}
+
+func (e *exitError) Error() string {
+	return e.msg
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+
+	return exitFailure
+}
+
+func oauth2Flags(confDir string) []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "conf-file",
+			Value:  confDir + "/fitbit-oauth2.json",
+			Usage:  "",
+			EnvVar: "FDE_API_OAUTH2_CONF_FILE",
+		},
+		cli.StringFlag{
+			Name:   "bind-addr",
+			Value:  "127.0.0.1:5556",
+			Usage:  "Address of the local server receiving the authorization redirect",
+			EnvVar: "FDE_API_BIND_ADDR",
+		},
+		cli.BoolFlag{
+			Name:   "headless",
+			Usage:  "Print the authorization URL and read the redirected URL from stdin instead of starting a local server",
+			EnvVar: "FDE_API_HEADLESS",
+		},
+		cli.StringFlag{
+			Name:   "client-id",
+			Usage:  "",
+			EnvVar: "FDE_API_CLIENT_ID",
+		},
+		cli.StringFlag{
+			Name:   "client-secret",
+			Usage:  "",
+			EnvVar: "FDE_API_CLIENT_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "scopes",
+			Usage:  fmt.Sprintf("Comma separated list of scopes requested when logging in (default: the stored scopes or %v)", strings.Join(client.DefaultScopes, ",")),
+			EnvVar: "FDE_API_SCOPES",
+		},
+		cli.StringFlag{
+			Name:   "token-store",
+			Value:  "file",
+			Usage:  "Where the credentials are stored: file, encrypted (conf-file encrypted with token-passphrase) or env (oauth2-config or token-secret-file, refreshed tokens saved to conf-file)",
+			EnvVar: "FDE_API_TOKEN_STORE",
+		},
+		cli.StringFlag{
+			Name:   "token-passphrase",
+			Usage:  "Passphrase used to encrypt the conf file",
+			EnvVar: "FDE_API_TOKEN_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name:   "token-passphrase-file",
+			Usage:  "File containing the passphrase used to encrypt the conf file",
+			EnvVar: "FDE_API_TOKEN_PASSPHRASE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "oauth2-config",
+			Usage:  "Json credentials used by the env token store",
+			EnvVar: "FDE_API_OAUTH2_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "token-secret-file",
+			Value:  "/run/secrets/fitbit-oauth2",
+			Usage:  "File with json credentials used by the env token store when oauth2-config is empty",
+			EnvVar: "FDE_API_TOKEN_SECRET_FILE",
+		},
 	}
 }
 
@@ -173,61 +444,288 @@ func assertNoError(err error, template string, params ...interface{}) {
 
 func runAPI(c *cli.Context) error {
 	log.SetLevel(log.Level(c.GlobalInt("log-level")))
-	storage := mustCreateStorage(c)
-	source, err := getOAuth2Source(c)
+	latest := c.Bool("latest")
+	if latest && (!c.Bool("daemon") || (c.GlobalString("metrics-addr") == "" && c.GlobalString("mqtt-url") == "")) {
+		return errors.New("latest needs daemon and metrics-addr or mqtt-url")
+	}
+	if c.Bool("daemon") && c.Duration("sync-interval") <= 0 {
+		return fmt.Errorf("the sync-interval must be positive, got %v", c.Duration("sync-interval"))
+	}
+	var storage storage.Storage
+	if !latest || hasStorage(c) {
+		storage = mustCreateStorage(c)
+	}
+	series, err := getSeries(c, storage)
 	if err != nil {
 		return err
 	}
-
-	since := mustGetStartingDate(c)
+	cl, err := getOAuth2Client(c)
+	if err != nil {
+		return err
+	}
+	loc, err := getAPILocation(c, cl)
+	if err != nil {
+		return err
+	}
+	endpoints, err := getEndpoints(c, cl, storage)
+	if err != nil {
+		return err
+	}
+	seriesSources := append(mustCreateAPISeries(c, cl, series), endpoints...)
+	source, err := api.New(cl, c.String("base-url"), c.String("precision"))
 	assertNoError(err, "failed to open source")
+
+	devices := getDevices(c, cl, loc)
+
+	since := mustGetStartingDate(c, loc)
 	var alg algorithm.Alg
 	if c.Bool("daemon") {
-		alg = algorithm.NewContinuous(since, source, storage)
+		var l *algorithm.Latest
+		if latest {
+			l = algorithm.NewLatest(api.NewLatestReader(cl, c.String("api-url")), loc, mustCreatePublishers(c)...)
+		}
+		if storage == nil {
+			// the source is not used without storage, but its client is
+			defer func() {
+				_ = source.Close()
+			}()
+		}
+		alg = algorithm.NewContinuous(since, source, storage, c.Duration("sync-interval"), l, devices, seriesSources...)
 	} else {
-		alg = algorithm.New(since, source, storage)
+		alg = algorithm.New(since, source, storage, devices, seriesSources...)
 	}
-	defer func() {
-		_ = alg.Close()
-	}()
+	live := health.Checks{"token": cl.Check}
+	if c.Bool("daemon") {
+		maxAge := c.Duration("max-sync-age")
+		if maxAge == 0 {
+			maxAge = 2 * c.Duration("sync-interval")
+		}
+		live["sync"] = health.SyncAge(metrics.LastSyncTime, time.Now(), maxAge)
+	}
+	startMetricsServer(c, latest, live, storageChecks(storage))
 
 	return runWithSignalHandling(alg, c)
 }
 
-func getOAuth2Source(c *cli.Context) (source.Source, error) {
-	confFile := c.String("conf-file")
-	bindAddr := c.String("bind-addr")
-	conf := client.Config{
+func getOAuth2Config(c *cli.Context) client.Config {
+	var scopes []string
+	for _, scope := range strings.Split(c.String("scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return client.Config{
 		ClientID:     c.String("client-id"),
 		ClientSecret: c.String("client-secret"),
-		Scopes:       []string{"heartrate"},
+		Scopes:       scopes,
+	}
+}
+
+func getTokenStore(c *cli.Context) (client.Store, error) {
+	confFile := c.String("conf-file")
+	passphrase := c.String("token-passphrase")
+	if f := c.String("token-passphrase-file"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the token passphrase: %v", err)
+		}
+		passphrase = strings.TrimSpace(string(b))
+	}
+	var state client.Store = client.NewFileStore(confFile)
+	if passphrase != "" {
+		var err error
+		if state, err = client.NewEncryptedFileStore(confFile, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	switch kind := c.String("token-store"); kind {
+	case "file":
+		if passphrase != "" {
+			return nil, errors.New("a token passphrase requires the encrypted or env token store")
+		}
+		return client.NewFileStore(confFile), nil
+	case "encrypted":
+		return client.NewEncryptedFileStore(confFile, passphrase)
+	case "env":
+		return client.NewEnvStore(c.String("oauth2-config"), c.String("token-secret-file"), state), nil
+	default:
+		return nil, fmt.Errorf("unknown token store %q", kind)
+	}
+}
+
+func getLoginOptions(c *cli.Context) client.LoginOptions {
+	return client.LoginOptions{
+		BindAddr: c.String("bind-addr"),
+		Headless: c.Bool("headless"),
 	}
-	cl, err := client.New(confFile, bindAddr, conf)
+}
+
+func checkClientError(err error) error {
 	if err == client.ErrMissingClientInformation {
-		return nil, fmt.Errorf("invalid credentials configuration: %v", err)
+		return fmt.Errorf("invalid credentials configuration: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build a client: %v", err)
+	}
+
+	return nil
+}
+
+func getOAuth2Client(c *cli.Context) (*client.Client, error) {
+	var login *client.LoginOptions
+	if !c.Bool("daemon") {
+		opts := getLoginOptions(c)
+		login = &opts
+	}
+	store, err := getTokenStore(c)
+	if err != nil {
+		return nil, err
 	}
+	cl, err := client.New(store, getOAuth2Config(c), login)
+	if err == client.ErrLoginRequired {
+		return nil, newExitError(exitLoginRequired, "%v", err)
+	}
+	if err := checkClientError(err); err != nil {
+		return nil, err
+	}
+	if missing := cl.Status().MissingScopes(); len(missing) > 0 {
+		log.WithField("scopes", missing).Warn("some scopes were not granted, run auth login --scopes to grant them")
+	}
+
+	return cl, nil
+}
+
+// getAPILocation returns the time zone given with --timezone or, if none is,
+// the one of the Fitbit profile, falling back to the local one.
+func getAPILocation(c *cli.Context, cl *client.Client) (*time.Location, error) {
+	if c.GlobalString("timezone") != "" {
+		return getLocation(c)
+	}
+	loc, err := api.ProfileLocation(cl, c.String("api-url"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to build a client: %v", err)
+		log.WithError(err).WithField("timezone", time.Local).Warn("failed to get the time zone of the Fitbit profile, using the local one, set --timezone or run auth login --scopes heartrate,profile")
+
+		return time.Local, nil
 	}
-	baseURL := c.String("base-url")
-	precision := c.String("precision")
+	log.WithField("timezone", loc).Info("using the time zone of the Fitbit profile")
 
-	return api.New(cl, baseURL, precision)
+	return loc, nil
 }
 
-func mustGetStartingDate(c *cli.Context) time.Time {
+// getLocation returns the time zone given with --timezone or the local one.
+func getLocation(c *cli.Context) (*time.Location, error) {
+	tz := c.GlobalString("timezone")
+	if tz == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", tz, err)
+	}
+
+	return loc, nil
+}
+
+func runAuthLogin(c *cli.Context) error {
+	log.SetLevel(log.Level(c.GlobalInt("log-level")))
+	store, err := getTokenStore(c)
+	if err != nil {
+		return err
+	}
+	cl, err := client.Login(store, getOAuth2Config(c), getLoginOptions(c))
+	if err := checkClientError(err); err != nil {
+		return err
+	}
+	fmt.Printf("Token stored in %v\n", store)
+
+	return cl.Close()
+}
+
+func runAuthStatus(c *cli.Context) error {
+	store, err := getTokenStore(c)
+	if err != nil {
+		return err
+	}
+	status, err := client.ReadStatus(store, getOAuth2Config(c))
+	if err != nil {
+		return err
+	}
+	if !status.HasToken && !status.HasRefreshToken {
+		fmt.Printf("No token stored in %v\n", store)
+		return nil
+	}
+	fmt.Printf("Store:            %v\n", store)
+	fmt.Printf("User id:          %v\n", status.UserID)
+	fmt.Printf("Expiry:           %v (expired: %v)\n", status.Expiry.Format(time.RFC3339), status.Expired())
+	fmt.Printf("Refresh token:    %v\n", status.HasRefreshToken)
+	fmt.Printf("Requested scopes: %v\n", strings.Join(status.RequestedScopes, " "))
+	fmt.Printf("Granted scopes:   %v\n", strings.Join(status.GrantedScopes, " "))
+	if missing := status.MissingScopes(); len(missing) > 0 {
+		fmt.Printf("Missing scopes:   %v (run auth login --scopes to grant them)\n", strings.Join(missing, " "))
+	}
+
+	return nil
+}
+
+func getAuthClient(c *cli.Context) (*client.Client, error) {
+	log.SetLevel(log.Level(c.GlobalInt("log-level")))
+	store, err := getTokenStore(c)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := client.New(store, getOAuth2Config(c), nil)
+
+	return cl, checkClientError(err)
+}
+
+func runAuthRefresh(c *cli.Context) error {
+	cl, err := getAuthClient(c)
+	if err != nil {
+		return err
+	}
+	if err := cl.Refresh(); err != nil {
+		return fmt.Errorf("failed to refresh the token: %v", err)
+	}
+	fmt.Printf("Token refreshed, new expiry: %v\n", cl.Status().Expiry.Format(time.RFC3339))
+
+	return cl.Close()
+}
+
+func runAuthRevoke(c *cli.Context) error {
+	cl, err := getAuthClient(c)
+	if err != nil {
+		return err
+	}
+	if err := cl.Revoke(); err != nil {
+		return err
+	}
+	fmt.Println("Token revoked")
+
+	return nil
+}
+
+// mustGetStartingDate returns the start of the starting day in loc.
+func mustGetStartingDate(c *cli.Context, loc *time.Location) time.Time {
 	startingDate := c.GlobalString("starting-date")
-	since, err := time.Parse("2006/01/02", startingDate)
+	since, err := time.ParseInLocation("2006/01/02", startingDate, loc)
 	if err != nil {
 		d, err := time.ParseDuration(startingDate)
 		assertNoError(err, "failed to parse starting-date")
-		since = time.Now().Add(-d)
-		since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, since.Location())
+		since = time.Now().In(loc).Add(-d)
+		since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, loc)
 	}
 
 	return since
 }
 
+// hasStorage reports whether a database is configured.
+func hasStorage(c *cli.Context) bool {
+	return c.GlobalString("postgresql-dsn") != "" || c.GlobalString("remote-write-url") != "" ||
+		c.GlobalString("influxdb-url") != ""
+}
+
 func mustCreateStorage(c *cli.Context) storage.Storage {
 	owner := c.GlobalString("username")
 	dsn := c.GlobalString("postgresql-dsn")
@@ -236,6 +734,13 @@ func mustCreateStorage(c *cli.Context) storage.Storage {
 		assertNoError(err, "failed to open pg db")
 		return postgresql.NewStorage(owner, db)
 	}
+	if writeURL := c.GlobalString("remote-write-url"); writeURL != "" {
+		queryURL := c.GlobalString("prometheus-query-url")
+		if queryURL == "" {
+			log.Fatal("prometheus-query-url is required with remote-write-url")
+		}
+		return remotewrite.NewStorage(owner, writeURL, queryURL)
+	}
 
 	addr := c.GlobalString("influxdb-url")
 	db := c.GlobalString("influxdb-database")
@@ -247,13 +752,178 @@ func mustCreateStorage(c *cli.Context) storage.Storage {
 	return s
 }
 
+// mustCreatePublishers returns the publishers of the latest readings: the
+// Prometheus gauges if metrics-addr is set and MQTT if mqtt-url is set.
+func mustCreatePublishers(c *cli.Context) []algorithm.Publisher {
+	var res []algorithm.Publisher
+	if c.GlobalString("metrics-addr") != "" {
+		res = append(res, metrics.LatestPublisher{})
+	}
+	if url := c.GlobalString("mqtt-url"); url != "" {
+		username := c.GlobalString("username")
+		topic := c.GlobalString("mqtt-topic")
+		if topic == "" {
+			topic = "fitbit/" + username
+		}
+		p, err := mqtt.NewPublisher(username, url, c.GlobalString("mqtt-username"), c.GlobalString("mqtt-password"),
+			topic, c.GlobalString("mqtt-discovery-prefix"))
+		assertNoError(err, "failed to connect to the MQTT broker")
+		res = append(res, p)
+	}
+
+	return res
+}
+
+// getDevices returns the source of the devices, nil if they are not polled.
+func getDevices(c *cli.Context, cl *client.Client, loc *time.Location) source.DeviceSource {
+	if !c.Bool("devices") {
+		return nil
+	}
+	if granted := grantedScopes(cl); len(granted) > 0 && !granted[model.DeviceSeries.Scope] {
+		log.WithField("scope", model.DeviceSeries.Scope).Warn("the scope of the devices was not granted, run auth login --scopes to grant it")
+	}
+
+	return api.NewDeviceReader(cl, c.String("api-url"), loc)
+}
+
+// getSeries returns the series to sync, which the storage must support.
+func getSeries(c *cli.Context, s storage.Storage) ([]model.Series, error) {
+	series, err := model.ParseSeries(c.GlobalString("series"))
+	if err != nil || len(series) == 0 {
+		return nil, err
+	}
+	if _, ok := s.(storage.SeriesStorage); !ok {
+		return nil, fmt.Errorf("the storage can not keep the series, use postgresql or influxdb")
+	}
+
+	return series, nil
+}
+
+// mustCreateAPISeries returns the api sources of the series, warning about
+// the scopes that were not granted.
+func mustCreateAPISeries(c *cli.Context, cl *client.Client, series []model.Series) []source.SeriesSource {
+	granted := grantedScopes(cl)
+	var res []source.SeriesSource
+	for _, s := range series {
+		if len(granted) > 0 && !granted[s.Scope] {
+			log.WithFields(log.Fields{"series": s.Name, "scope": s.Scope}).Warn("the scope of the series was not granted, run auth login --scopes to grant it")
+		}
+		r, err := api.NewSeriesReader(cl, c.String("api-url"), s)
+		assertNoError(err, "failed to open the %v source", s.Name)
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// getEndpoints returns the sources of the configured endpoints, creating
+// their series in the storage if needed.
+func getEndpoints(c *cli.Context, cl *client.Client, s storage.Storage) ([]source.SeriesSource, error) {
+	endpoints, err := api.LoadEndpoints(c.String("endpoints"))
+	if err != nil || len(endpoints) == 0 {
+		return nil, err
+	}
+	if _, ok := s.(storage.SeriesStorage); !ok {
+		return nil, fmt.Errorf("the storage can not keep the endpoints, use postgresql or influxdb")
+	}
+	granted := grantedScopes(cl)
+	var res []source.SeriesSource
+	for _, e := range endpoints {
+		if e.Scope != "" && len(granted) > 0 && !granted[e.Scope] {
+			log.WithFields(log.Fields{"series": e.Name, "scope": e.Scope}).Warn("the scope of the series was not granted, run auth login --scopes to grant it")
+		}
+		r, err := api.NewEndpointReader(cl, c.String("api-url"), e)
+		if err != nil {
+			return nil, err
+		}
+		if creator, ok := s.(storage.SeriesCreator); ok {
+			if err := creator.CreateSeries(r.Series()); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+// grantedScopes returns the scopes granted to the token, none if unknown.
+func grantedScopes(cl *client.Client) map[string]bool {
+	granted := make(map[string]bool)
+	for _, scope := range cl.Status().GrantedScopes {
+		granted[scope] = true
+	}
+
+	return granted
+}
+
+// mustCreateOfflineSeries returns the sources of the series in the export.
+func mustCreateOfflineSeries(dirPath string, series []model.Series, loc *time.Location) []source.SeriesSource {
+	var res []source.SeriesSource
+	for _, s := range series {
+		r, err := offline.NewSeriesReader(dirPath, s, loc)
+		assertNoError(err, "failed to open the %v source", s.Name)
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// storageChecks returns the check of the connectivity to the storage, if it
+// supports it.
+func storageChecks(s storage.Storage) health.Checks {
+	if p, ok := s.(storage.Pinger); ok {
+		return health.Checks{"storage": p.Ping}
+	}
+
+	return health.Checks{}
+}
+
+// startMetricsServer serves the metrics in the background if metrics-addr
+// is set, along with /healthz, running the live checks, and /readyz, running
+// the live and ready checks.
+func startMetricsServer(c *cli.Context, latest bool, live, ready health.Checks) {
+	addr := c.GlobalString("metrics-addr")
+	if addr == "" {
+		return
+	}
+	handler, err := metrics.Handler(c.GlobalString("username"), latest)
+	assertNoError(err, "failed to register the metrics")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	// readiness also depends on the storage, whose outages restarting does
+	// not fix
+	all := health.Checks{}
+	for _, checks := range []health.Checks{live, ready} {
+		for name, check := range checks {
+			all[name] = check
+		}
+	}
+	mux.Handle("/healthz", health.Handler(live))
+	mux.Handle("/readyz", health.Handler(all))
+	go func() {
+		log.WithField("addr", addr).Info("serving metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WithError(err).Error("metrics server stopped")
+		}
+	}()
+}
+
+// runWithSignalHandling runs the runner until it completes or a SIGTERM or
+// SIGINT is received, after which it is closed, letting it finish the work in
+// progress and flush the saved readings for up to shutdown-timeout. SIGUSR2
+// toggles the debug logs.
+//
+// A clean shutdown returns nil, so that the exit status is 0. A runner that
+// can not be closed in time is abandoned with exitShutdownTimeout.
 func runWithSignalHandling(runner algorithm.Alg, c *cli.Context) error {
-	endCh := make(chan error)
+	endCh := make(chan error, 1)
 	go func() {
 		endCh <- runner.Run()
 	}()
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
 
 	for {
 		select {
@@ -262,29 +932,156 @@ func runWithSignalHandling(runner algorithm.Alg, c *cli.Context) error {
 			switch sig {
 			case syscall.SIGUSR2:
 				if log.GetLevel() == log.DebugLevel {
-					log.SetLevel(log.Level(c.Int("log-level")))
+					log.SetLevel(log.Level(c.GlobalInt("log-level")))
 				} else {
 					log.SetLevel(log.DebugLevel)
 				}
 			default:
-				log.Warn("stopping gracefully...")
-				return fmt.Errorf("received signal: %v", sig.String())
+				return shutdown(runner, endCh, sigChan, c.GlobalDuration("shutdown-timeout"))
 			}
 		case err := <-endCh:
+			if closeErr := runner.Close(); err == nil {
+				err = closeErr
+			}
 			return err
 		}
 	}
 }
 
+// shutdown closes the runner and waits for it to stop. A second signal
+// abandons the work in progress right away.
+func shutdown(runner algorithm.Alg, endCh <-chan error, sigChan <-chan os.Signal, timeout time.Duration) error {
+	log.WithField("timeout", timeout).Warn("stopping gracefully, waiting for the work in progress...")
+	closeCh := make(chan error, 1)
+	go func() {
+		closeCh <- runner.Close()
+	}()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var runDone, closeDone bool
+	var closeErr error
+	for !runDone || !closeDone {
+		select {
+		case err := <-endCh:
+			runDone = true
+			if err != nil && err != context.Canceled {
+				log.WithError(err).Warn("the sync in progress was interrupted, it is retried on the next run")
+			}
+		case closeErr = <-closeCh:
+			closeDone = true
+		case <-deadline.C:
+			return newExitError(exitShutdownTimeout, "shutdown timed out after %v, the readings not yet flushed are lost", timeout)
+		case sig := <-sigChan:
+			if sig != syscall.SIGUSR2 {
+				return newExitError(exitShutdownTimeout, "received %v while stopping, the readings not yet flushed are lost", sig)
+			}
+		}
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to flush the readings: %v", closeErr)
+	}
+	log.Info("stopped")
+
+	return nil
+}
+
 func runOffline(c *cli.Context) error {
 	log.SetLevel(log.Level(c.GlobalInt("log-level")))
-	since := mustGetStartingDate(c)
-	dirPath := c.String("filepath")
-	source, err := offline.New(dirPath)
+	loc, err := getLocation(c)
+	if err != nil {
+		return err
+	}
+	since := mustGetStartingDate(c, loc)
+	dirPath := c.String("dirpath")
+	columns, err := offline.ParseCSVColumns(c.String("csv-columns"))
+	if err != nil {
+		return err
+	}
+	source, err := offline.New(dirPath, c.String("file-prefix"), columns, loc)
 	assertNoError(err, "failed to open source")
 	storage := mustCreateStorage(c)
+	series, err := getSeries(c, storage)
+	if err != nil {
+		return err
+	}
+	startMetricsServer(c, false, health.Checks{}, storageChecks(storage))
+
+	alg := algorithm.New(since, source, storage, nil, mustCreateOfflineSeries(dirPath, series, loc)...)
+
+	return runWithSignalHandling(alg, c)
+}
+
+func runFIT(c *cli.Context) error {
+	log.SetLevel(log.Level(c.GlobalInt("log-level")))
+	loc, err := getLocation(c)
+	if err != nil {
+		return err
+	}
+	since := mustGetStartingDate(c, loc)
+	r, err := fit.New(c.String("dirpath"), c.String("source"))
+	assertNoError(err, "failed to open source")
+	store := mustCreateStorage(c)
+	if _, ok := store.(storage.SeriesStorage); !ok {
+		_ = store.Close()
+		return errors.New("the storage can not keep the records, use postgresql or influxdb")
+	}
+	startMetricsServer(c, false, health.Checks{}, storageChecks(store))
+
+	// the heart rate of the records is kept apart from the one of the
+	// Fitbit trackers, tagged with the source
+	alg := algorithm.New(since, nil, store, nil, r)
+
+	return runWithSignalHandling(alg, c)
+}
+
+func runAppleHealth(c *cli.Context) error {
+	log.SetLevel(log.Level(c.GlobalInt("log-level")))
+	loc, err := getLocation(c)
+	if err != nil {
+		return err
+	}
+	since := mustGetStartingDate(c, loc)
+	r, err := applehealth.New(c.String("file"), c.Int("max-records"), loc)
+	assertNoError(err, "failed to open source")
+	store := mustCreateStorage(c)
+	var series []source.SeriesSource
+	if _, ok := store.(storage.SeriesStorage); ok {
+		series = r.SeriesSources()
+	} else {
+		log.Info("the storage can not keep the series, only the heart rate of the export is synced")
+	}
+	startMetricsServer(c, false, health.Checks{}, storageChecks(store))
+
+	alg := algorithm.New(since, r, store, nil, series...)
+
+	return runWithSignalHandling(alg, c)
+}
+
+func runGadgetbridge(c *cli.Context) error {
+	log.SetLevel(log.Level(c.GlobalInt("log-level")))
+	kinds, err := gadgetbridge.ParseSleepKinds(c.String("sleep-kinds"))
+	if err != nil {
+		return err
+	}
+	// before anything else, as it fails without cgo
+	r, err := gadgetbridge.New(c.String("file"), kinds)
+	assertNoError(err, "failed to open source")
+	loc, err := getLocation(c)
+	if err != nil {
+		return err
+	}
+	since := mustGetStartingDate(c, loc)
+	store := mustCreateStorage(c)
+	if _, ok := store.(storage.SeriesStorage); !ok {
+		_ = store.Close()
+		return errors.New("the storage can not keep the samples, use postgresql or influxdb")
+	}
+	startMetricsServer(c, false, health.Checks{}, storageChecks(store))
 
-	alg := algorithm.New(since, source, storage)
+	// the heart rate of the devices is kept apart from the one of the
+	// Fitbit trackers, tagged with the device
+	alg := algorithm.New(since, nil, store, nil, r.SeriesSources()...)
 
 	return runWithSignalHandling(alg, c)
 }
@@ -2,18 +2,24 @@ module github.com/ivajloip/fitbit-data-exporter
 
 require (
 	github.com/client9/misspell v0.3.4 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/fzipp/gocyclo v0.0.0-20150627053110-6acd4345c835 // indirect
 	github.com/gobuffalo/packr v1.30.1 // indirect
 	github.com/gocraft/dbr/v2 v2.6.2
+	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/gordonklaus/ineffassign v0.0.0-20190601041439-ed7b1b5ee0f8 // indirect
 	github.com/influxdata/influxdb v1.7.8
 	github.com/kisielk/errcheck v1.2.0 // indirect
 	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/prometheus/client_golang v1.2.1
 	github.com/rubenv/sql-migrate v0.0.0-20191022111038-5cdff0d8cc42
 	github.com/sirupsen/logrus v1.4.2
 	github.com/urfave/cli v1.22.1
 	github.com/ziutek/mymysql v1.5.4 // indirect
+	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	gopkg.in/gorp.v1 v1.7.2 // indirect
@@ -22,6 +22,9 @@ import (
 	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
 )
@@ -31,48 +34,81 @@ type continuous struct {
 	ctx    context.Context
 	wg     sync.WaitGroup
 	ticker *time.Ticker
+	since  time.Time
 
 	currAlg *DefaultAlg
+	latest  *Latest
 }
 
 // NewContinuous TODO.
-func NewContinuous(since time.Time, source source.Source, storage storage.Storage) Alg {
+//
+// Every interval, the days completed since the previous run are synced and,
+// if latest is not nil, the latest readings are updated. The storage may be
+// nil when only the latest readings are exported.
+func NewContinuous(since time.Time, source source.Source, storage storage.Storage, interval time.Duration, latest *Latest, devices source.DeviceSource,
+	series ...source.SeriesSource) Alg {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &continuous{
-		cancel:  cancel,
-		ctx:     ctx,
-		currAlg: New(since, source, storage),
+	res := &continuous{
+		cancel: cancel,
+		ctx:    ctx,
+		ticker: time.NewTicker(interval),
+		since:  since,
+		latest: latest,
+	}
+	if storage != nil {
+		res.currAlg = New(since, source, storage, devices, series...)
 	}
+
+	return res
 }
 
 // Run TODO.
 func (d *continuous) Run() error {
 	d.wg.Add(1)
 	defer d.wg.Done()
-	d.ticker = time.NewTicker(24 * time.Hour)
-	since := d.currAlg.since
+	since := d.since
 	for {
-		d.currAlg.since = since
-
-		if err := d.currAlg.Run(); err != nil {
-			return err
+		if d.currAlg != nil {
+			d.currAlg.since = since
+			if err := d.currAlg.Run(); err != nil {
+				return err
+			}
+		}
+		if d.latest != nil {
+			if err := d.latest.Update(); err != nil {
+				log.WithError(err).Warn("failed to update the latest readings")
+			} else if d.currAlg == nil {
+				// without storage, updating the latest readings is the sync
+				metrics.SyncDone()
+			}
 		}
 		select {
 		case <-d.ctx.Done():
 			return nil
 		case <-d.ticker.C:
-			n := time.Now()
-			since = time.Date(n.Year(), n.Month(), n.Day(), 0, 0, 0, 0, n.Location())
+			// start from the previous day, which is complete now, or the
+			// first one the device has not synced
+			next := storage.DayStart(time.Now().In(since.Location())).AddDate(0, 0, -1)
+			if d.currAlg != nil && !d.currAlg.pending.IsZero() && d.currAlg.pending.Before(next) {
+				next = d.currAlg.pending
+			}
+			since = next
 		}
 	}
 }
 
 // Close TODO.
 func (d *continuous) Close() error {
-	d.ticker.Stop()
 	d.cancel()
-	_ = d.currAlg.Close()
+	d.ticker.Stop()
+	var err error
+	if d.currAlg != nil {
+		err = d.currAlg.Close()
+	}
 	d.wg.Wait()
+	if d.latest != nil {
+		_ = d.latest.Close()
+	}
 
-	return nil
+	return err
 }
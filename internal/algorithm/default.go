@@ -25,6 +25,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
 )
@@ -43,10 +45,28 @@ type DefaultAlg struct {
 	since   time.Time
 	source  source.Source
 	storage storage.Storage
+	devices source.DeviceSource
+	series  []source.SeriesSource
+
+	// lastSync is the last time the trackers synced, zero if unknown.
+	lastSync time.Time
+	// pending is the first day waiting for the trackers to sync, zero if
+	// none.
+	pending time.Time
 }
 
 // New TODO.
-func New(since time.Time, source source.Source, storage storage.Storage) *DefaultAlg {
+//
+// The series are synced along with the heart rate when the storage is a
+// storage.SeriesStorage. The source may be nil when only the series are
+// synced. The events series, whose sources must implement
+// source.SeriesRangeSource, are synced by date ranges after the days.
+//
+// If devices is not nil, the devices are polled before every sync and their
+// state saved, if the storage supports it. The days after the last sync of
+// the trackers are not synced until the trackers sync them, as they may not
+// be complete.
+func New(since time.Time, source source.Source, storage storage.Storage, devices source.DeviceSource, series ...source.SeriesSource) *DefaultAlg {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &DefaultAlg{
 		cancel:  cancel,
@@ -54,6 +74,8 @@ func New(since time.Time, source source.Source, storage storage.Storage) *Defaul
 		since:   since,
 		source:  source,
 		storage: storage,
+		devices: devices,
+		series:  series,
 	}
 }
 
@@ -61,43 +83,218 @@ func New(since time.Time, source source.Source, storage storage.Storage) *Defaul
 func (d *DefaultAlg) Run() error {
 	d.wg.Add(1)
 	defer d.wg.Done()
+	select {
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	default:
+	}
 	now := time.Now()
+	d.lastSync, d.pending = time.Time{}, time.Time{}
+	if d.devices != nil {
+		if err := d.syncDevices(now); err != nil {
+			log.WithError(err).Warn("failed to read the devices, syncing all the completed days")
+		}
+	}
+	var end time.Time
+	waiting := 0
 	for i := 0; ; i++ {
 		select {
 		case <-d.ctx.Done():
 			return d.ctx.Err()
 		default:
 		}
-		t := d.since.Add(time.Duration(i) * 24 * time.Hour)
-		if !t.Before(now.Add(-24 * time.Hour)) {
+		// days are calendar days in the time zone of since, lasting 23 or
+		// 25 hours when the clock changes
+		t := d.since.AddDate(0, 0, i)
+		if storage.DayEnd(t).After(now) {
+			end = t
 			break
 		}
+		if !d.lastSync.IsZero() && storage.DayEnd(t).After(d.lastSync) {
+			if waiting == 0 {
+				log.WithFields(log.Fields{"ts": t, "last_sync": d.lastSync}).Warn("the device has not synced the day yet, waiting for it")
+				d.pending = t
+			}
+			waiting++
+			continue
+		}
 		log.WithField("ts", t).Info("reading data for date")
-		if present, err := d.storage.IsPresent(t); err != nil {
-			return fmt.Errorf("failed to verify presence: %v", err)
-		} else if present {
-			log.WithField("ts", t).Debug("date already present, skipping...")
+		if d.source != nil {
+			if err := d.syncHeart(t); err != nil {
+				return err
+			}
+		}
+		for _, s := range d.series {
+			if s.Series().Events {
+				continue
+			}
+			if err := d.syncSeries(s, t); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range d.series {
+		if !s.Series().Events {
 			continue
 		}
-		data, err := d.source.ReadData(t)
+		if err := d.syncEvents(s, d.since, end); err != nil {
+			return err
+		}
+	}
+	metrics.DaysWaitingForDevice.Set(float64(waiting))
+	metrics.SyncDone()
+
+	return nil
+}
+
+func (d *DefaultAlg) syncHeart(t time.Time) error {
+	if present, err := d.storage.IsPresent(t); err != nil {
+		return fmt.Errorf("failed to verify presence: %v", err)
+	} else if present {
+		log.WithField("ts", t).Debug("date already present, skipping...")
+		return nil
+	}
+	data, err := d.source.ReadData(t)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %v", err)
+	}
+	log.WithField("ts", t).Debug("data successfully read")
+	if len(data) == 0 {
+		metrics.DaysWithoutReadings.Inc()
+		if d.lastSync.IsZero() {
+			log.WithField("ts", t).Warn("no heart rate readings, the device was not worn or has not synced")
+		} else {
+			log.WithField("ts", t).Info("no heart rate readings although the device synced since, it was not worn")
+		}
+	}
+	if err := d.storage.Save(data); err != nil {
+		return fmt.Errorf("failed to save data: %v", err)
+	}
+	metrics.DaysSynced.Inc()
+
+	return nil
+}
+
+// syncDevices reads the devices, updating their metrics and lastSync, and
+// saves their state at now, if the storage supports it.
+func (d *DefaultAlg) syncDevices(now time.Time) error {
+	devices, err := d.devices.ReadDevices()
+	if err != nil {
+		return err
+	}
+	var data []model.Reading
+	for _, dev := range devices {
+		metrics.DeviceBatteryLevel.WithLabelValues(dev.ID, dev.Model).Set(float64(dev.BatteryLevel))
+		metrics.DeviceLastSync.WithLabelValues(dev.ID, dev.Model).Set(float64(dev.LastSync.Unix()))
+		log.WithFields(log.Fields{
+			"device":    dev.Model,
+			"battery":   dev.BatteryLevel,
+			"last_sync": dev.LastSync,
+		}).Debug("device read")
+		// the scales do not record the heart rate
+		if dev.Type == "TRACKER" && dev.LastSync.After(d.lastSync) {
+			d.lastSync = dev.LastSync
+		}
+		data = append(data, dev.Reading(now))
+	}
+	if ss, ok := d.storage.(storage.SeriesStorage); ok {
+		if err := ss.SaveSeries(model.DeviceSeries, data); err != nil {
+			return fmt.Errorf("failed to save the devices: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// syncSeries syncs the readings of a series, if the storage supports it.
+func (d *DefaultAlg) syncSeries(s source.SeriesSource, t time.Time) error {
+	ss, ok := d.storage.(storage.SeriesStorage)
+	if !ok {
+		return nil
+	}
+	series := s.Series()
+	fields := log.Fields{"ts": t, "series": series.Name}
+	if present, err := ss.IsSeriesPresent(series, t); err != nil {
+		return fmt.Errorf("failed to verify presence of %v: %v", series.Name, err)
+	} else if present {
+		log.WithFields(fields).Debug("series already present, skipping...")
+		return nil
+	}
+	data, err := s.ReadSeries(t)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", series.Name, err)
+	}
+	log.WithFields(fields).WithField("readings", len(data)).Debug("series successfully read")
+	if err := ss.SaveSeries(series, data); err != nil {
+		return fmt.Errorf("failed to save %v: %v", series.Name, err)
+	}
+
+	return nil
+}
+
+// syncEvents syncs the readings of an events series in the days [from, to)
+// by ranges of up to source.MaxRangeDays, if the storage supports it. As the
+// ranges are synced in order, the days before the one of the last stored
+// reading were synced and are skipped.
+func (d *DefaultAlg) syncEvents(s source.SeriesSource, from, to time.Time) error {
+	ss, ok := d.storage.(storage.SeriesStorage)
+	if !ok {
+		return nil
+	}
+	series := s.Series()
+	rs, ok := s.(source.SeriesRangeSource)
+	if !ok {
+		return fmt.Errorf("the source of %v can not read date ranges", series.Name)
+	}
+	stored, err := ss.SeriesReadings(series, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to read the stored %v: %v", series.Name, err)
+	}
+	if len(stored) > 0 {
+		if last := storage.DayStart(stored[len(stored)-1].Time.In(from.Location())); last.After(from) {
+			from = last
+		}
+	}
+	for start := from; start.Before(to); start = start.AddDate(0, 0, source.MaxRangeDays) {
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		default:
+		}
+		end := start.AddDate(0, 0, source.MaxRangeDays)
+		if end.After(to) {
+			end = to
+		}
+		fields := log.Fields{"from": start, "to": end, "series": series.Name}
+		data, err := rs.ReadSeriesRange(start, end)
 		if err != nil {
-			return fmt.Errorf("failed to read data: %v", err)
+			return fmt.Errorf("failed to read %v: %v", series.Name, err)
 		}
-		log.WithField("ts", t).Debug("data successfully read")
-		if err := d.storage.Save(data); err != nil {
-			return fmt.Errorf("failed to save data: %v", err)
+		log.WithFields(fields).WithField("readings", len(data)).Debug("series successfully read")
+		if err := ss.SaveSeries(series, data); err != nil {
+			return fmt.Errorf("failed to save %v: %v", series.Name, err)
 		}
 	}
 
 	return nil
 }
 
-// Close TODO.
+// Close stops the sync after the day in progress, whose readings are saved.
+// The source is closed first, so that waiting for the rate limit to be reset
+// is interrupted, and the storage last, flushing the saved readings. The
+// error of the flush is returned.
 func (d *DefaultAlg) Close() error {
 	d.cancel()
-	_ = d.source.Close()
-	_ = d.storage.Close()
+	if d.source != nil {
+		_ = d.source.Close()
+	}
+	if d.devices != nil {
+		_ = d.devices.Close()
+	}
+	for _, s := range d.series {
+		_ = s.Close()
+	}
 	d.wg.Wait()
 
-	return nil
+	return d.storage.Close()
 }
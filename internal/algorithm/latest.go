@@ -0,0 +1,82 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package algorithm
+
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// Publisher publishes the latest readings of the day.
+type Publisher interface {
+	Publish(day time.Time, l model.Latest) error
+}
+
+// Latest keeps the latest readings published.
+type Latest struct {
+	reader     source.LatestReader
+	loc        *time.Location
+	publishers []Publisher
+}
+
+// NewLatest returns a Latest reading the current day, in loc, from the
+// reader and publishing it to the publishers. The publishers that are also
+// io.Closers are closed with it.
+func NewLatest(reader source.LatestReader, loc *time.Location, publishers ...Publisher) *Latest {
+	return &Latest{reader: reader, loc: loc, publishers: publishers}
+}
+
+// Update reads the latest readings and publishes them. A failing publisher
+// does not prevent the others from being updated.
+func (l *Latest) Update() error {
+	day := storage.DayStart(time.Now().In(l.loc))
+	res, err := l.reader.ReadLatest(day)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"day":     day,
+		"resting": res.RestingHeartRate,
+		"steps":   res.Steps,
+	}).Debug("latest readings read")
+	for _, p := range l.publishers {
+		if perr := p.Publish(day, res); perr != nil {
+			err = perr
+			log.WithError(err).Warn("failed to publish the latest readings")
+		}
+	}
+
+	return err
+}
+
+// Close TODO.
+func (l *Latest) Close() error {
+	for _, p := range l.publishers {
+		if c, ok := p.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+
+	return l.reader.Close()
+}
@@ -0,0 +1,1055 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package e2e
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/algorithm"
+	"github.com/ivajloip/fitbit-data-exporter/internal/fitbittest"
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source/api"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage/memory"
+)
+
+type env struct {
+	server *fitbittest.Server
+	store  oauth2.Store
+	dir    string
+	since  time.Time
+}
+
+func newEnv(t *testing.T) *env {
+	dir, err := ioutil.TempDir("", "fde-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	return &env{
+		server: fitbittest.NewServer(),
+		store:  oauth2.NewFileStore(filepath.Join(dir, "fitbit-oauth2.json")),
+		dir:    dir,
+		since:  time.Date(now.Year(), now.Month(), now.Day()-3, 0, 0, 0, 0, now.Location()),
+	}
+}
+
+func (e *env) close() {
+	e.server.Close()
+	_ = os.RemoveAll(e.dir)
+}
+
+func (e *env) config() oauth2.Config {
+	return oauth2.Config{
+		ClientID:     fitbittest.ClientID,
+		ClientSecret: fitbittest.ClientSecret,
+		Scopes:       []string{"heartrate"},
+		Endpoint:     e.server.Endpoint(),
+		RevokeURL:    e.server.RevokeURL(),
+	}
+}
+
+// login stores a token as if `auth login` was run before.
+func (e *env) login(t *testing.T, ttl time.Duration) *oauth2.Config {
+	c := e.config()
+	c.Token = e.server.IssueToken(ttl)
+	if err := e.store.Save(c); err != nil {
+		t.Fatal(err)
+	}
+
+	return &c
+}
+
+// run does what the api command does: it syncs all days since e.since to
+// the returned storage.
+func (e *env) run(t *testing.T) (*memory.Storage, error) {
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memory.NewStorage("user")
+	alg := algorithm.New(e.since, src, s, nil)
+	err = alg.Run()
+	if cerr := alg.Close(); cerr != nil {
+		t.Errorf("failed to close: %v", cerr)
+	}
+
+	return s, err
+}
+
+func clock(h, m, s int) model.DateTime {
+	return model.DateTime(time.Date(0, 1, 1, h, m, s, 0, time.UTC))
+}
+
+func (e *env) setData() {
+	e.server.SetHeartData(e.since, []model.APIValue{
+		{Time: clock(0, 0, 5), Value: 60},
+		{Time: clock(12, 30, 0), Value: 120},
+	})
+	e.server.SetHeartData(e.since.AddDate(0, 0, 1), []model.APIValue{
+		{Time: clock(23, 59, 59), Value: 55},
+	})
+}
+
+func TestSync(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+
+	s, err := e.run(t)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	data := s.Data()
+	want := []model.HeartData{
+		{DateTime: e.since.Add(5 * time.Second), Value: model.Value{BMP: 60, Confidence: 1}},
+		{DateTime: e.since.Add(12*time.Hour + 30*time.Minute), Value: model.Value{BMP: 120, Confidence: 1}},
+		{DateTime: e.since.AddDate(0, 0, 1).Add(24*time.Hour - time.Second), Value: model.Value{BMP: 55, Confidence: 1}},
+	}
+	if len(data) != len(want) {
+		t.Fatalf("got %d readings, want %d: %v", len(data), len(want), data)
+	}
+	for i := range want {
+		if !data[i].DateTime.Equal(want[i].DateTime) || data[i].Value != want[i].Value {
+			t.Errorf("reading %d: got %v, want %v", i, data[i], want[i])
+		}
+	}
+	if got := e.server.Requests(); got != 3 {
+		t.Errorf("got %d api requests, want one per day (3)", got)
+	}
+	if got := e.server.Refreshes(); got != 0 {
+		t.Errorf("got %d refreshes for a valid token", got)
+	}
+}
+
+func TestSyncSkipsPresentDays(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := api.New(cl, e.server.HeartURL(), "1sec")
+	s := memory.NewStorage("user")
+	_ = s.Save([]model.HeartData{{DateTime: e.since.Add(time.Hour)}})
+	alg := algorithm.New(e.since, src, s, nil)
+	if err := alg.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_ = alg.Close()
+
+	if got := e.server.Requests(); got != 2 {
+		t.Errorf("got %d api requests, want 2 as the first day is present", got)
+	}
+}
+
+func TestExpiredTokenIsRefreshedAndPersisted(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	old := e.login(t, -time.Minute)
+	e.setData()
+
+	if _, err := e.run(t); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if got := e.server.Refreshes(); got != 1 {
+		t.Errorf("got %d refreshes, want 1", got)
+	}
+	if e.server.IsRefreshTokenValid(old.Token.RefreshToken) {
+		t.Error("old refresh token should have been consumed")
+	}
+	stored, err := e.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.server.IsRefreshTokenValid(stored.Token.RefreshToken) {
+		t.Errorf("stored refresh token %q is not the rotated one", stored.Token.RefreshToken)
+	}
+	if stored.UserID != fitbittest.UserID {
+		t.Errorf("got user id %q, want %q", stored.UserID, fitbittest.UserID)
+	}
+	fi, err := os.Stat(filepath.Join(e.dir, "fitbit-oauth2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("got token file permissions %v, want 0600", perm)
+	}
+
+	// a second run must work with the persisted token
+	if _, err := e.run(t); err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+}
+
+func TestReadOnlyStoreIsRejected(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	conf := e.login(t, time.Hour)
+	b, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a state store, the token rotated by the first refresh would
+	// be lost
+	if _, err := oauth2.New(oauth2.NewEnvStore(string(b), "", nil), e.config(), nil); err == nil {
+		t.Error("expected an error for a read only token store")
+	}
+	if _, err := oauth2.New(oauth2.NewEnvStore(string(b), "", e.store), e.config(), nil); err != nil {
+		t.Errorf("failed to create the client with a state store: %v", err)
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+
+	if _, err := oauth2.New(e.store, e.config(), nil); err != oauth2.ErrLoginRequired {
+		t.Fatalf("got %v, want %v", err, oauth2.ErrLoginRequired)
+	}
+}
+
+func TestHeadlessLogin(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		// emulates the user: open the printed url in a browser and paste
+		// the url it was redirected to
+		out := bufio.NewReader(outR)
+		line, err := out.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// keep reading the prompt, otherwise the login blocks writing it
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, out)
+		}()
+		authURL := line[strings.Index(line, "http"):]
+		client := http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Get(strings.TrimSpace(authURL))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = resp.Body.Close()
+		_, _ = io.WriteString(inW, resp.Header.Get("Location")+"\n")
+	}()
+
+	c := e.config()
+	c.Scopes = []string{"heartrate", "profile"}
+	cl, err := oauth2.Login(e.store, c, oauth2.LoginOptions{Headless: true, Input: inR, Output: outW})
+	_ = outW.Close()
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	status := cl.Status()
+	if status.UserID != fitbittest.UserID || status.Expired() || len(status.MissingScopes()) > 0 {
+		t.Errorf("unexpected status after login: %+v", status)
+	}
+	stored, err := oauth2.ReadStatus(e.store, oauth2.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.HasRefreshToken || strings.Join(stored.GrantedScopes, " ") != "heartrate profile" ||
+		strings.Join(stored.RequestedScopes, " ") != "heartrate profile" {
+		t.Errorf("unexpected stored status: %+v", stored)
+	}
+
+	// without explicit scopes, the stored ones are kept
+	c.Scopes = nil
+	cl, err = oauth2.New(e.store, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scopes := strings.Join(cl.Status().RequestedScopes, " "); scopes != "heartrate profile" {
+		t.Errorf("requested scopes = %q, want the stored ones", scopes)
+	}
+	_ = cl.Close()
+}
+
+func TestHeadlessLoginRejectsForgedState(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+
+	in := strings.NewReader("http://127.0.0.1:5556/auth/fitbit/callback?code=code-1&state=forged\n")
+	_, err := oauth2.Login(e.store, e.config(), oauth2.LoginOptions{Headless: true, Input: in, Output: ioutil.Discard})
+	if err != oauth2.ErrStateMismatch {
+		t.Fatalf("got %v, want %v", err, oauth2.ErrStateMismatch)
+	}
+}
+
+func TestRefreshAndRevoke(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	old := e.login(t, time.Hour)
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Refresh(); err != nil {
+		t.Fatalf("refresh failed: %v", err)
+	}
+	stored, _ := e.store.Load()
+	if stored.Token.RefreshToken == old.Token.RefreshToken {
+		t.Error("refresh did not store a new token")
+	}
+	if err := cl.Revoke(); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if e.server.IsRefreshTokenValid(stored.Token.RefreshToken) {
+		t.Error("refresh token still valid after revoke")
+	}
+	if _, err := oauth2.New(e.store, e.config(), nil); err != oauth2.ErrLoginRequired {
+		t.Errorf("got %v after revoke, want %v", err, oauth2.ErrLoginRequired)
+	}
+}
+
+func TestRateLimitIsWaitedFor(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	e.server.RateLimit = 2
+
+	s, err := e.run(t)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if got := len(s.Data()); got != 3 {
+		t.Errorf("got %d readings, want 3", got)
+	}
+	if got := e.server.Requests(); got != 4 {
+		t.Errorf("got %d api requests, want 4 (one rate limited)", got)
+	}
+}
+
+func TestCloseInterruptsRateLimitWait(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	e.server.RateLimit = 2
+	e.server.RateLimitReset = time.Hour
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memory.NewStorage("user")
+	alg := algorithm.New(e.since, src, s, nil)
+	endCh := make(chan error, 1)
+	go func() {
+		endCh <- alg.Run()
+	}()
+	// the third request waits for the rate limit to be reset
+	for e.server.Requests() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- alg.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("failed to close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() did not interrupt the rate limit wait")
+	}
+	if err := <-endCh; err == nil {
+		t.Error("the interrupted sync did not fail")
+	}
+	if got := len(s.Data()); got != 3 {
+		t.Errorf("got %d readings, want the 3 read before closing", got)
+	}
+}
+
+func TestServerErrorStopsSync(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	e.server.FailNext(http.StatusInternalServerError)
+
+	s, err := e.run(t)
+	if err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+	if !strings.Contains(err.Error(), "500") {
+		t.Errorf("error does not mention the status: %v", err)
+	}
+	if got := len(s.Data()); got != 0 {
+		t.Errorf("got %d readings saved, want 0", got)
+	}
+}
+
+func TestInvalidTokenIsReported(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.server.FailNext(http.StatusUnauthorized)
+
+	_, err := e.run(t)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want a 401 status error", err)
+	}
+}
+
+func TestRefreshFailureIsNotALoginRequest(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, -time.Minute)
+	c := e.config()
+	c.ClientSecret = "wrong"
+
+	_, err := oauth2.New(e.store, c, nil)
+	if err == nil || err == oauth2.ErrLoginRequired {
+		t.Fatalf("got %v, want the refresh error", err)
+	}
+}
+
+func TestRevokedRefreshTokenRequiresLogin(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	old := e.login(t, -time.Minute)
+	e.server.Revoke(old.Token.RefreshToken)
+
+	if _, err := oauth2.New(e.store, e.config(), nil); err != oauth2.ErrLoginRequired {
+		t.Fatalf("got %v, want %v", err, oauth2.ErrLoginRequired)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	for i := 0; i < 3; i++ {
+		date := e.since.AddDate(0, 0, i).Format("2006-01-02")
+		e.server.SetResource("spo2/date/"+date+".json", map[string]interface{}{})
+		e.server.SetResource("hrv/date/"+date+"/all.json", map[string]interface{}{"hrv": []interface{}{}})
+	}
+	date := e.since.Format("2006-01-02")
+	e.server.SetResource("spo2/date/"+date+".json", map[string]interface{}{
+		"dateTime": date,
+		"value":    map[string]interface{}{"avg": 95.5, "min": 92.0, "max": 99.0},
+	})
+	e.server.SetResource("hrv/date/"+date+"/all.json", map[string]interface{}{"hrv": []interface{}{
+		map[string]interface{}{
+			"dateTime": date,
+			"minutes": []interface{}{
+				map[string]interface{}{
+					"minute": date + "T03:10:00.000",
+					"value":  map[string]interface{}{"rmssd": 30.5, "coverage": 0.9, "hf": 120.0, "lf": 200.0},
+				},
+			},
+		},
+	}})
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []source.SeriesSource
+	for _, s := range []model.Series{model.SpO2, model.HRVIntraday} {
+		r, err := api.NewSeriesReader(cl, e.server.APIURL(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		series = append(series, r)
+	}
+	s := memory.NewStorage("user")
+	alg := algorithm.New(e.since, src, s, nil, series...)
+	if err := alg.Run(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := alg.Close(); err != nil {
+		t.Errorf("failed to close: %v", err)
+	}
+
+	for _, tt := range []struct {
+		series model.Series
+		want   model.Reading
+	}{
+		{model.SpO2, model.Reading{Time: e.since, Values: map[string]float64{"avg": 95.5, "min": 92, "max": 99}}},
+		{model.HRVIntraday, model.Reading{
+			Time:   e.since.Add(3*time.Hour + 10*time.Minute),
+			Values: map[string]float64{"rmssd": 30.5, "coverage": 0.9, "hf": 120, "lf": 200},
+		}},
+	} {
+		got, err := s.SeriesReadings(tt.series, e.since, e.since.AddDate(0, 0, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !got[0].Time.Equal(tt.want.Time) || !reflect.DeepEqual(got[0].Values, tt.want.Values) {
+			t.Errorf("%v: got %v, want %v", tt.series.Name, got, tt.want)
+		}
+	}
+	if got := e.server.Requests(); got != 9 {
+		t.Errorf("got %d api requests, want 3 per day (9)", got)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	for i := 0; i < 3; i++ {
+		day := e.since.AddDate(0, 0, i)
+		e.server.SetResource("activities/calories/date/"+day.Format("2006-01-02")+"/1d/1min.json", map[string]interface{}{})
+		e.server.SetResource(fmt.Sprintf("glucose?from=%d&to=%d", day.Unix(), day.AddDate(0, 0, 1).Unix()), []interface{}{})
+	}
+	date := e.since.Format("2006-01-02")
+	e.server.SetResource("activities/calories/date/"+date+"/1d/1min.json", map[string]interface{}{
+		"activities-calories": []interface{}{map[string]interface{}{"dateTime": date, "value": "2143"}},
+		"activities-calories-intraday": map[string]interface{}{"dataset": []interface{}{
+			map[string]interface{}{"level": 0, "mets": 10, "time": "00:00:00", "value": 1.2},
+			map[string]interface{}{"level": 1, "mets": 30, "time": "07:01:00", "value": 3.6},
+		}},
+	})
+	glucose := e.since.Add(8 * time.Hour)
+	e.server.SetResource(fmt.Sprintf("glucose?from=%d&to=%d", e.since.Unix(), e.since.AddDate(0, 0, 1).Unix()), []interface{}{
+		map[string]interface{}{"ts": glucose.Unix() * 1000, "reading": map[string]interface{}{"mmol": "5.4"}, "meta": map[string]interface{}{"device-id": 12345678901234567}},
+		map[string]interface{}{"ts": glucose.Unix() * 1000, "reading": map[string]interface{}{"mmol": 5.6}, "meta": map[string]interface{}{"device-id": "other"}},
+		// without values
+		map[string]interface{}{"ts": glucose.Unix() * 1000, "meta": map[string]interface{}{"device-id": "none"}},
+	})
+
+	dir, err := ioutil.TempDir("", "fde-endpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "endpoints.json")
+	config := `[{
+		"name": "calories_intraday",
+		"url": "activities/calories/date/{date}/1d/1min.json",
+		"items": "$['activities-calories-intraday'].dataset[*]",
+		"time": "time",
+		"values": {"calories": "value", "level": "@.level"},
+		"tags": {"total": "$['activities-calories'][0].value"},
+		"scope": "activity"
+	}, {
+		"name": "glucose",
+		"url": "` + e.server.APIURL() + `/glucose?from={unix}&to={end_unix}",
+		"items": "$[*]",
+		"time": "ts",
+		"time_layout": "unix_ms",
+		"values": {"mmol": "reading.mmol"},
+		"tags": {"device": "meta['device-id']"},
+		"key": "device"
+	}]`
+	if err := ioutil.WriteFile(fileName, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := api.LoadEndpoints(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []source.SeriesSource
+	for _, endpoint := range endpoints {
+		r, err := api.NewEndpointReader(cl, e.server.APIURL(), endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		series = append(series, r)
+	}
+	s := memory.NewStorage("user")
+	alg := algorithm.New(e.since, src, s, nil, series...)
+	if err := alg.Run(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := alg.Close(); err != nil {
+		t.Errorf("failed to close: %v", err)
+	}
+
+	for i, want := range [][]model.Reading{
+		{
+			{Time: e.since, Values: map[string]float64{"calories": 1.2, "level": 0}, Tags: map[string]string{"total": "2143"}},
+			{Time: e.since.Add(7*time.Hour + time.Minute), Values: map[string]float64{"calories": 3.6, "level": 1}, Tags: map[string]string{"total": "2143"}},
+		},
+		{
+			{Time: glucose, Values: map[string]float64{"mmol": 5.4}, Tags: map[string]string{"device": "12345678901234567"}},
+			{Time: glucose, Values: map[string]float64{"mmol": 5.6}, Tags: map[string]string{"device": "other"}},
+		},
+	} {
+		series := endpoints[i].Series()
+		got, err := s.SeriesReadings(series, e.since, e.since.AddDate(0, 0, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%v: got %v, want %v", series.Name, got, want)
+		}
+		for j := range got {
+			if !got[j].Time.Equal(want[j].Time) || !reflect.DeepEqual(got[j].Values, want[j].Values) || !reflect.DeepEqual(got[j].Tags, want[j].Tags) {
+				t.Errorf("%v: got %v, want %v", series.Name, got[j], want[j])
+			}
+		}
+	}
+
+	for _, invalid := range []api.Endpoint{
+		{Name: model.Weight.Name, URL: "body.json", Values: map[string]string{"weight": "weight"}},
+		{Name: "no_values", URL: "body.json"},
+		{Name: "bad_path", URL: "body.json", Values: map[string]string{"value": "a[x]"}},
+		{Name: "bad_key", URL: "body.json", Values: map[string]string{"value": "value"}, Key: "id"},
+	} {
+		if _, err := api.NewEndpointReader(cl, e.server.APIURL(), invalid); err == nil {
+			t.Errorf("%v: expected an error", invalid.Name)
+		}
+	}
+}
+
+func TestWeightByRanges(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	day := func(i int) string {
+		return e.since.AddDate(0, 0, i).Format("2006-01-02")
+	}
+	// the first sync reads the three days at once, the next one from the
+	// day of the last log
+	for _, r := range []string{day(0) + "/" + day(2), day(1) + "/" + day(2)} {
+		e.server.SetResource("body/log/weight/date/"+r+".json", map[string]interface{}{"weight": []interface{}{
+			map[string]interface{}{"logId": 1, "date": day(1), "time": "07:12:34", "weight": 72.5, "bmi": 22.4, "source": "Aria"},
+		}})
+		e.server.SetResource("body/log/fat/date/"+r+".json", map[string]interface{}{"fat": []interface{}{}})
+	}
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	s := memory.NewStorage("user")
+	// the heart rate of the last day, which has no readings, is read again
+	for i, wantRequests := range []int{5, 8} {
+		src, err := api.New(cl, e.server.HeartURL(), "1sec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		weight, err := api.NewSeriesReader(cl, e.server.APIURL(), model.Weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg := algorithm.New(e.since, src, s, nil, weight)
+		if err := alg.Run(); err != nil {
+			t.Fatalf("sync %d failed: %v", i, err)
+		}
+		if got := e.server.Requests(); got != wantRequests {
+			t.Errorf("sync %d: got %d api requests in total, want %d", i, got, wantRequests)
+		}
+	}
+
+	got, err := s.SeriesReadings(model.Weight, e.since, e.since.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.Reading{{
+		Time:   e.since.AddDate(0, 0, 1).Add(7*time.Hour + 12*time.Minute + 34*time.Second),
+		Values: map[string]float64{"weight": 72.5, "bmi": 22.4},
+		Tags:   map[string]string{"source": "Aria"},
+	}}
+	if len(got) != 1 || !got[0].Time.Equal(want[0].Time) || !reflect.DeepEqual(got[0].Values, want[0].Values) ||
+		!reflect.DeepEqual(got[0].Tags, want[0].Tags) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestActivities(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	start := e.since.AddDate(0, 0, 1).Add(7 * time.Hour)
+	list := func(offset int, next string, startTime time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"activities": []interface{}{map[string]interface{}{
+				"logId":        offset + 1,
+				"activityName": "Run",
+				"logType":      "mobile_run",
+				"startTime":    startTime.Format("2006-01-02T15:04:05.000"),
+				"duration":     60000,
+				"calories":     12,
+				"tcxLink":      "https://api.fitbit.com/1/user/-/activities/1.tcx",
+			}},
+			"pagination": map[string]interface{}{"next": next},
+		}
+	}
+	page := func(offset int) string {
+		return "activities/list.json?afterDate=" + url.QueryEscape(e.since.Add(-time.Second).Format("2006-01-02T15:04:05")) +
+			fmt.Sprintf("&limit=100&offset=%d&sort=asc", offset)
+	}
+	e.server.SetResource(page(0), list(0, "next page", start))
+	// the second page starts after the synced days
+	e.server.SetResource(page(100), list(100, "", e.since.AddDate(0, 0, 3)))
+	e.server.SetResource("activities/1.tcx", []byte(`<TrainingCenterDatabase><Activities><Activity><Lap><Track>
+<Trackpoint><Time>`+start.Format(time.RFC3339)+`</Time><Position><LatitudeDegrees>42.69</LatitudeDegrees>
+<LongitudeDegrees>23.32</LongitudeDegrees></Position><HeartRateBpm><Value>98</Value></HeartRateBpm></Trackpoint>
+</Track></Lap></Activity></Activities></TrainingCenterDatabase>`))
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []source.SeriesSource
+	for _, s := range []model.Series{model.Activity, model.ActivityTrackpoint} {
+		r, err := api.NewSeriesReader(cl, e.server.APIURL(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		series = append(series, r)
+	}
+	s := memory.NewStorage("user")
+	if err := algorithm.New(e.since, src, s, nil, series...).Run(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		series model.Series
+		want   model.Reading
+	}{
+		{model.Activity, model.Reading{
+			Time:   start,
+			Values: map[string]float64{"duration": 60, "active_duration": 0, "calories": 12},
+			Tags:   map[string]string{"name": "Run", "log_type": "mobile_run", "log_id": "1"},
+		}},
+		{model.ActivityTrackpoint, model.Reading{
+			Time:   start,
+			Values: map[string]float64{"latitude": 42.69, "longitude": 23.32, "heart_rate": 98},
+			Tags:   map[string]string{"log_id": "1"},
+		}},
+	} {
+		got, err := s.SeriesReadings(tt.series, e.since, e.since.AddDate(0, 0, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !got[0].Time.Equal(tt.want.Time) || !reflect.DeepEqual(got[0].Values, tt.want.Values) ||
+			!reflect.DeepEqual(got[0].Tags, tt.want.Tags) {
+			t.Errorf("%v: got %v, want %v", tt.series.Name, got, tt.want)
+		}
+	}
+	// the heart rate of every day, two pages of activities for each series
+	// and the TCX
+	if got := e.server.Requests(); got != 8 {
+		t.Errorf("got %d api requests, want 8", got)
+	}
+}
+
+func TestWaitForDeviceSync(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+	lastSync := e.since.AddDate(0, 0, 1).Add(12 * time.Hour)
+	e.server.SetResource("devices.json", []interface{}{
+		map[string]interface{}{
+			"id":            "101",
+			"deviceVersion": "Charge 5",
+			"type":          "TRACKER",
+			"battery":       "High",
+			"batteryLevel":  80,
+			"lastSyncTime":  lastSync.Format("2006-01-02T15:04:05.000"),
+		},
+		// the scale does not record the heart rate
+		map[string]interface{}{
+			"id":            "202",
+			"deviceVersion": "Aria Air",
+			"type":          "SCALE",
+			"battery":       "Medium",
+			"lastSyncTime":  time.Now().Format("2006-01-02T15:04:05.000"),
+		},
+	})
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := memory.NewStorage("user")
+	alg := algorithm.New(e.since, src, s, api.NewDeviceReader(cl, e.server.APIURL(), e.since.Location()))
+	if err := alg.Run(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// the day of the last sync and the next one are not complete
+	for i, want := range []bool{true, false, false} {
+		day := e.since.AddDate(0, 0, i)
+		if got, err := s.IsPresent(day); err != nil || got != want {
+			t.Errorf("IsPresent(%v) = %v, %v, want %v", day, got, err, want)
+		}
+	}
+	if got := e.server.Requests(); got != 2 {
+		t.Errorf("got %d api requests, want the devices and a day (2)", got)
+	}
+	got, err := s.SeriesReadings(model.DeviceSeries, e.since, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Tags["model"] != "Charge 5" || got[0].Values["battery_level"] != 80 ||
+		got[0].Values["last_sync"] != float64(lastSync.Unix()) {
+		t.Errorf("got devices %v", got)
+	}
+}
+
+func TestClosedSyncReadsNothing(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.setData()
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alg := algorithm.New(e.since, src, memory.NewStorage("user"), api.NewDeviceReader(cl, e.server.APIURL(), e.since.Location()))
+	if err := alg.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := alg.Run(); err == nil {
+		t.Error("the closed sync did not fail")
+	}
+	if got := e.server.Requests(); got != 0 {
+		t.Errorf("got %d api requests after closing, want 0", got)
+	}
+}
+
+func TestReadingsInProfileTimeZone(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+	e.server.Timezone = "Europe/Sofia"
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cl.Close()
+	}()
+	loc, err := api.ProfileLocation(cl, e.server.APIURL())
+	if err != nil {
+		t.Fatalf("failed to read the profile time zone: %v", err)
+	}
+	if loc.String() != "Europe/Sofia" {
+		t.Fatalf("got time zone %v, want Europe/Sofia", loc)
+	}
+
+	// the clock moved back from 04:00 to 03:00, so the day lasts 25 hours
+	day := time.Date(2019, 10, 27, 0, 0, 0, 0, loc)
+	e.server.SetHeartData(day, []model.APIValue{
+		{Time: clock(0, 0, 0), Value: 60},
+		{Time: clock(3, 30, 0), Value: 61},
+		{Time: clock(3, 30, 0), Value: 62},
+		{Time: clock(23, 59, 59), Value: 63},
+	})
+	src, err := api.New(cl, e.server.HeartURL(), "1sec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := src.ReadData(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{
+		time.Date(2019, 10, 26, 21, 0, 0, 0, time.UTC),
+		time.Date(2019, 10, 27, 0, 30, 0, 0, time.UTC),
+		time.Date(2019, 10, 27, 1, 30, 0, 0, time.UTC),
+		time.Date(2019, 10, 27, 21, 59, 59, 0, time.UTC),
+	}
+	if len(data) != len(want) {
+		t.Fatalf("got %d readings, want %d: %v", len(data), len(want), data)
+	}
+	for i := range want {
+		if !data[i].DateTime.Equal(want[i]) {
+			t.Errorf("reading %d at %v, want %v", i, data[i].DateTime, want[i])
+		}
+	}
+
+	s := memory.NewStorage("user")
+	if err := s.Save(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct {
+		day  time.Time
+		want bool
+	}{
+		{day, true},
+		{day.AddDate(0, 0, 1), false},
+	} {
+		if present, _ := s.IsPresent(d.day); present != d.want {
+			t.Errorf("IsPresent(%v) = %v, want %v", d.day, present, d.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, -time.Minute)
+	e.setData()
+	e.server.RateLimit = 100
+
+	days := testutil.ToFloat64(metrics.DaysSynced)
+	ok := testutil.ToFloat64(metrics.APIRequests.WithLabelValues("200"))
+	refreshes := testutil.ToFloat64(metrics.TokenRefreshes)
+	if _, err := e.run(t); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for _, m := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"days synced", testutil.ToFloat64(metrics.DaysSynced) - days, 3},
+		{"successful api requests", testutil.ToFloat64(metrics.APIRequests.WithLabelValues("200")) - ok, 3},
+		{"token refreshes", testutil.ToFloat64(metrics.TokenRefreshes) - refreshes, 1},
+		{"rate limit remaining", testutil.ToFloat64(metrics.RateLimitRemaining), 97},
+	} {
+		if m.got != m.want {
+			t.Errorf("%s: got %v, want %v", m.name, m.got, m.want)
+		}
+	}
+	if last := testutil.ToFloat64(metrics.LastSync); time.Since(time.Unix(int64(last), 0)) > time.Minute {
+		t.Errorf("last sync at %v, want now", last)
+	}
+
+	handler, err := metrics.Handler("user", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `fde_days_synced_total{user="user"}`) {
+		t.Errorf("metrics do not contain the synced days of the user:\n%s", body)
+	}
+}
+
+func TestLatestGauges(t *testing.T) {
+	e := newEnv(t)
+	defer e.close()
+	e.login(t, time.Hour)
+
+	today := time.Now().In(time.UTC)
+	day := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	e.server.SetHeartData(day, []model.APIValue{
+		{Time: clock(0, 0, 0), Value: 60},
+		{Time: clock(0, 1, 0), Value: 72},
+	})
+	e.server.SetRestingHeartRate(day, 58)
+	e.server.SetSteps(day, 1234)
+
+	cl, err := oauth2.New(e.store, e.config(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cl.Close()
+	}()
+	latest := algorithm.NewLatest(api.NewLatestReader(cl, e.server.APIURL()), time.UTC, metrics.LatestPublisher{})
+	defer func() {
+		_ = latest.Close()
+	}()
+	if err := latest.Update(); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	for _, m := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"heart rate", testutil.ToFloat64(metrics.HeartRate), 72},
+		{"heart rate time", testutil.ToFloat64(metrics.HeartRateTime), float64(day.Add(time.Minute).Unix())},
+		{"resting heart rate", testutil.ToFloat64(metrics.RestingHeartRate), 58},
+		{"steps", testutil.ToFloat64(metrics.Steps), 1234},
+	} {
+		if m.got != m.want {
+			t.Errorf("%s: got %v, want %v", m.name, m.got, m.want)
+		}
+	}
+	if got := e.server.Requests(); got != 2 {
+		t.Errorf("got %d api requests, want 2", got)
+	}
+}
@@ -0,0 +1,511 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package fitbittest provides a fake Fitbit web API server for tests.
+//
+// It implements the OAuth2 authorization (including PKCE), token, refresh and
+// revoke endpoints, the profile, the intraday heart rate and the daily steps
+// endpoints, serves canned responses for the other resources of the user,
+// reports the rate limit headers and can be asked to fail the next requests.
+package fitbittest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+const (
+	// ClientID is the client id accepted by the server.
+	ClientID = "fake-client-id"
+	// ClientSecret is the client secret accepted by the server.
+	ClientSecret = "fake-client-secret"
+	// UserID is the id of the only user of the server.
+	UserID = "FAKEUSR"
+
+	userPrefix  = "/1/user/-"
+	heartPrefix = userPrefix + "/activities/heart/date/"
+	stepsPrefix = userPrefix + "/activities/steps/date/"
+	profilePath = userPrefix + "/profile.json"
+)
+
+// Server is a fake Fitbit web API server.
+type Server struct {
+	*httptest.Server
+
+	// TokenTTL is the lifetime of the issued access tokens.
+	TokenTTL time.Duration
+	// RateLimit is the number of API requests allowed before the server
+	// starts responding with 429, zero meaning no limit.
+	RateLimit int
+	// RateLimitReset is the time reported until the rate limit is reset.
+	RateLimitReset time.Duration
+	// Timezone is the time zone reported in the profile of the user.
+	Timezone string
+
+	mu            sync.Mutex
+	codes         map[string]authCode
+	accessTokens  map[string]time.Time
+	refreshTokens map[string]bool
+	heart         map[string][]model.APIValue
+	resting       map[string]int
+	steps         map[string]int
+	resources     map[string]interface{}
+	failures      []int
+	requests      int
+	window        int
+	refreshes     int
+	counter       int
+}
+
+type authCode struct {
+	challenge string
+	scope     string
+}
+
+// NewServer starts a new fake server. It should be closed when done.
+func NewServer() *Server {
+	s := &Server{
+		TokenTTL:       time.Hour,
+		RateLimitReset: time.Second,
+		Timezone:       "UTC",
+		codes:          make(map[string]authCode),
+		accessTokens:   make(map[string]time.Time),
+		refreshTokens:  make(map[string]bool),
+		heart:          make(map[string][]model.APIValue),
+		resting:        make(map[string]int),
+		steps:          make(map[string]int),
+		resources:      make(map[string]interface{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/authorize", s.handleAuthorize)
+	mux.HandleFunc("/oauth2/token", s.handleToken)
+	mux.HandleFunc("/oauth2/revoke", s.handleRevoke)
+	mux.HandleFunc(heartPrefix, s.handleHeart)
+	mux.HandleFunc(stepsPrefix, s.handleSteps)
+	mux.HandleFunc(profilePath, s.handleProfile)
+	mux.HandleFunc(userPrefix+"/", s.handleResource)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Endpoint returns the OAuth2 endpoint of the server.
+func (s *Server) Endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:  s.URL + "/oauth2/authorize",
+		TokenURL: s.URL + "/oauth2/token",
+	}
+}
+
+// RevokeURL returns the url of the revoke endpoint.
+func (s *Server) RevokeURL() string {
+	return s.URL + "/oauth2/revoke"
+}
+
+// HeartURL returns the base url of the intraday heart rate endpoint.
+func (s *Server) HeartURL() string {
+	return s.URL + strings.TrimSuffix(heartPrefix, "/")
+}
+
+// APIURL returns the root of the resources of the user.
+func (s *Server) APIURL() string {
+	return s.URL + userPrefix
+}
+
+// IssueToken returns a new valid token, as if the user had logged in, that
+// expires after ttl (which may be negative).
+func (s *Server) IssueToken(ttl time.Duration) *oauth2.Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	access, refresh := s.newTokens(ttl)
+
+	return &oauth2.Token{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(ttl),
+	}
+}
+
+// SetHeartData sets the intraday heart rate readings of a day.
+func (s *Server) SetHeartData(day time.Time, values []model.APIValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.heart[day.Format("2006-01-02")] = values
+}
+
+// SetRestingHeartRate sets the resting heart rate of the day.
+func (s *Server) SetRestingHeartRate(day time.Time, bpm int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resting[day.Format("2006-01-02")] = bpm
+}
+
+// SetSteps sets the step count of the day.
+func (s *Server) SetSteps(day time.Time, steps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.steps[day.Format("2006-01-02")] = steps
+}
+
+// SetResource sets the json response of a resource of the user, given by its
+// path relative to APIURL (ex. spo2/date/2019-06-01.json), optionally with the
+// query string, which is then matched exactly. A []byte response is written
+// as is. The other resources respond with 404.
+func (s *Server) SetResource(path string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resources[strings.TrimPrefix(path, "/")] = v
+}
+
+// FailNext makes the next API requests fail with the given status codes.
+func (s *Server) FailNext(statusCodes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, statusCodes...)
+}
+
+// Requests returns the number of API requests served, including the failed
+// ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+// Refreshes returns the number of successful token refreshes.
+func (s *Server) Refreshes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.refreshes
+}
+
+// IsRefreshTokenValid reports whether the refresh token can still be used.
+func (s *Server) IsRefreshTokenValid(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.refreshTokens[token]
+}
+
+// Revoke invalidates the token, as if the user removed the application.
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.refreshTokens, token)
+	delete(s.accessTokens, token)
+}
+
+func (s *Server) newTokens(ttl time.Duration) (string, string) {
+	s.counter++
+	access := fmt.Sprintf("access-%d", s.counter)
+	refresh := fmt.Sprintf("refresh-%d", s.counter)
+	s.accessTokens[access] = time.Now().Add(ttl)
+	s.refreshTokens[refresh] = true
+
+	return access, refresh
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID {
+		writeError(w, http.StatusBadRequest, "invalid_client", "unknown client id")
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "missing S256 code challenge")
+		return
+	}
+	redirect := q.Get("redirect_uri")
+	if redirect == "" {
+		redirect = "http://127.0.0.1:5556/auth/fitbit/callback"
+	}
+
+	s.mu.Lock()
+	s.counter++
+	code := fmt.Sprintf("code-%d", s.counter)
+	s.codes[code] = authCode{challenge: q.Get("code_challenge"), scope: q.Get("scope")}
+	s.mu.Unlock()
+
+	params := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, redirect+"?"+params.Encode(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if id != ClientID || secret != ClientSecret {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := "heartrate"
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		code, ok := s.codes[r.FormValue("code")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "unknown authorization code")
+			return
+		}
+		delete(s.codes, r.FormValue("code"))
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "code verifier does not match the challenge")
+			return
+		}
+		if code.scope != "" {
+			scope = code.scope
+		}
+	case "refresh_token":
+		refresh := r.FormValue("refresh_token")
+		if !s.refreshTokens[refresh] {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "refresh token invalid: "+refresh)
+			return
+		}
+		// Fitbit refresh tokens can only be used once
+		delete(s.refreshTokens, refresh)
+		s.refreshes++
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", r.FormValue("grant_type"))
+		return
+	}
+
+	access, refresh := s.newTokens(s.TokenTTL)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.TokenTTL / time.Second),
+		"scope":         scope,
+		"user_id":       UserID,
+	})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != ClientID || secret != ClientSecret {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := r.FormValue("token")
+	delete(s.refreshTokens, token)
+	delete(s.accessTokens, token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkRequest applies the rate limit, the injected failures and the token
+// validation. It returns false if the request has already been answered.
+func (s *Server) checkRequest(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.window++
+	remaining := s.RateLimit - s.window
+	if remaining < 0 {
+		remaining = 0
+	}
+	if s.RateLimit > 0 {
+		reset := strconv.Itoa(int(s.RateLimitReset / time.Second))
+		w.Header().Set("Fitbit-Rate-Limit-Limit", strconv.Itoa(s.RateLimit))
+		w.Header().Set("Fitbit-Rate-Limit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("Fitbit-Rate-Limit-Reset", reset)
+		if s.window > s.RateLimit {
+			// the limit is lifted once reported, as if the reset time passed
+			s.window = 0
+			w.Header().Set("Retry-After", reset)
+			writeError(w, http.StatusTooManyRequests, "system", "Too Many Requests")
+			return false
+		}
+	}
+	if len(s.failures) > 0 {
+		code := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, code, "system", http.StatusText(code))
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	expiry, ok := s.accessTokens[strings.TrimPrefix(auth, "Bearer ")]
+	if !strings.HasPrefix(auth, "Bearer ") || !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "Access token invalid")
+		return false
+	}
+	if expiry.Before(time.Now()) {
+		writeError(w, http.StatusUnauthorized, "expired_token", "Access token expired")
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) handleResource(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRequest(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, userPrefix+"/")
+	s.mu.Lock()
+	v, ok := s.resources[path+"?"+r.URL.RawQuery]
+	if !ok {
+		v, ok = s.resources[path]
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "unknown resource "+r.URL.RequestURI())
+		return
+	}
+	if b, ok := v.([]byte); ok {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(b)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleHeart(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRequest(w, r) {
+		return
+	}
+	// {date}/1d/{precision}/time/00:00/23:59.json
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, heartPrefix), "/")
+	if len(parts) != 6 || parts[1] != "1d" || parts[3] != "time" {
+		writeError(w, http.StatusNotFound, "not_found", "unknown resource "+r.URL.Path)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", parts[0]); err != nil {
+		writeError(w, http.StatusBadRequest, "validation", "invalid date "+parts[0])
+		return
+	}
+
+	s.mu.Lock()
+	values := s.heart[parts[0]]
+	resting, hasResting := s.resting[parts[0]]
+	s.mu.Unlock()
+
+	dataset := make([]map[string]interface{}, 0, len(values))
+	for _, v := range values {
+		dataset = append(dataset, map[string]interface{}{
+			"time":  time.Time(v.Time).Format("15:04:05"),
+			"value": v.Value,
+		})
+	}
+	var value interface{} = ""
+	if hasResting {
+		value = map[string]interface{}{
+			"customHeartRateZones": []interface{}{},
+			"heartRateZones":       []interface{}{},
+			"restingHeartRate":     resting,
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"activities-heart": []map[string]interface{}{{
+			"dateTime":       parts[0],
+			"heartRateZones": []interface{}{},
+			"value":          value,
+		}},
+		"activities-heart-intraday": map[string]interface{}{
+			"dataset":         dataset,
+			"datasetInterval": 1,
+			"datasetType":     parts[2],
+		},
+	})
+}
+
+func (s *Server) handleSteps(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRequest(w, r) {
+		return
+	}
+	// {date}/1d.json
+	date := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, stepsPrefix), "/1d.json")
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		writeError(w, http.StatusNotFound, "not_found", "unknown resource "+r.URL.Path)
+		return
+	}
+	s.mu.Lock()
+	steps := s.steps[date]
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"activities-steps": []map[string]interface{}{{
+			"dateTime": date,
+			"value":    strconv.Itoa(steps),
+		}},
+	})
+}
+
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRequest(w, r) {
+		return
+	}
+	s.mu.Lock()
+	tz := s.Timezone
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user": map[string]interface{}{
+			"encodedId": UserID,
+			"timezone":  tz,
+		},
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{
+			"errorType": errorType,
+			"message":   message,
+		}},
+		"success": false,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package health serves the health and readiness checks of the exporter.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeout is the time after which a check that did not return fails.
+const Timeout = 10 * time.Second
+
+// Check returns an error when the checked dependency is not healthy.
+type Check func() error
+
+// Checks are checks by name.
+type Checks map[string]Check
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Handler returns a handler running the checks concurrently on every request.
+// It responds with 200 if all of them pass and 503 otherwise, with the
+// result of each check:
+//
+//	{"status": "ok", "checks": {"storage": "ok", "token": "ok"}}
+func Handler(checks Checks) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := checks.run()
+		code := http.StatusOK
+		if res.Status != "ok" {
+			code = http.StatusServiceUnavailable
+			log.WithField("checks", res.Checks).Warn("health check failed")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+func (c Checks) run() response {
+	res := response{Status: "ok", Checks: make(map[string]string, len(c))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			err := runWithTimeout(check)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Status = "failing"
+				res.Checks[name] = err.Error()
+			} else {
+				res.Checks[name] = "ok"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return res
+}
+
+func runWithTimeout(check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(Timeout):
+		return fmt.Errorf("timeout after %v", Timeout)
+	}
+}
+
+// SyncAge returns a check failing when the last sync that completed without
+// error, as returned by last, is older than maxAge. Until the first sync
+// completes, the age is counted from start.
+func SyncAge(last func() time.Time, start time.Time, maxAge time.Duration) Check {
+	return func() error {
+		t := last()
+		if t.IsZero() {
+			t = start
+		}
+		if age := time.Since(t); age > maxAge {
+			return fmt.Errorf("last sync %v ago, more than %v", age.Round(time.Second), maxAge)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		checks   Checks
+		wantCode int
+		want     response
+	}{
+		{"no checks", Checks{}, http.StatusOK, response{"ok", map[string]string{}}},
+		{
+			"passing",
+			Checks{"a": func() error { return nil }, "b": func() error { return nil }},
+			http.StatusOK,
+			response{"ok", map[string]string{"a": "ok", "b": "ok"}},
+		},
+		{
+			"failing",
+			Checks{"a": func() error { return nil }, "b": func() error { return errors.New("down") }},
+			http.StatusServiceUnavailable,
+			response{"failing", map[string]string{"a": "ok", "b": "down"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Handler(tt.checks).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("got code %v, want %v", w.Code, tt.wantCode)
+			}
+			var got response
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncAge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		last    time.Time
+		start   time.Time
+		wantErr bool
+	}{
+		{"recent sync", now.Add(-time.Minute), now.Add(-time.Hour * 3), false},
+		{"old sync", now.Add(-time.Hour * 2), now.Add(-time.Hour * 3), true},
+		{"no sync yet", time.Time{}, now.Add(-time.Minute), false},
+		{"no sync since long", time.Time{}, now.Add(-time.Hour * 2), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			last := tt.last
+			err := SyncAge(func() time.Time { return last }, tt.start, time.Hour)()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// The latest readings, registered only when they are exported.
+var (
+	// HeartRate is the latest heart rate reading.
+	HeartRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "heart_rate_bpm",
+		Help:      "Latest heart rate reading.",
+	})
+	// HeartRateTime is the time of the latest heart rate reading.
+	HeartRateTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "heart_rate_timestamp_seconds",
+		Help:      "Unix time of the latest heart rate reading.",
+	})
+	// RestingHeartRate is the resting heart rate of the current day.
+	RestingHeartRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resting_heart_rate_bpm",
+		Help:      "Resting heart rate of the current day.",
+	})
+	// Steps is the step count of the current day.
+	Steps = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "steps",
+		Help:      "Step count of the current day.",
+	})
+)
+
+// RegisterLatest registers the gauges of the latest readings, labeled with
+// the user, to r.
+func RegisterLatest(r prometheus.Registerer, username string) error {
+	r = prometheus.WrapRegistererWith(prometheus.Labels{"user": username}, r)
+	for _, c := range []prometheus.Collector{HeartRate, HeartRateTime, RestingHeartRate, Steps} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetLatest updates the gauges of the latest readings. The heart rate is
+// kept when l has none, as at the start of a day, and so is the resting
+// heart rate until Fitbit computes the new one.
+func SetLatest(l model.Latest) {
+	if l.HeartRate != nil {
+		HeartRate.Set(float64(l.HeartRate.Value.BMP))
+		HeartRateTime.Set(float64(l.HeartRate.DateTime.Unix()))
+	}
+	if l.RestingHeartRate > 0 {
+		RestingHeartRate.Set(float64(l.RestingHeartRate))
+	}
+	Steps.Set(float64(l.Steps))
+}
+
+// LatestPublisher publishes the latest readings to the gauges.
+type LatestPublisher struct{}
+
+// Publish TODO.
+func (LatestPublisher) Publish(_ time.Time, l model.Latest) error {
+	SetLatest(l)
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics holds the Prometheus metrics of the exporter itself.
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fde"
+
+var (
+	// DaysSynced counts the days read from the source and saved.
+	DaysSynced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "days_synced_total",
+		Help:      "Number of days read from the source and saved.",
+	})
+	// LastSync is the time of the last sync that completed without error.
+	LastSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync that completed without error.",
+	})
+	// ReadingsSaved counts the readings written by backend.
+	ReadingsSaved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "readings_saved_total",
+		Help:      "Number of readings written to the storage backend.",
+	}, []string{"backend"})
+	// APIRequests counts the Fitbit API requests by status code, "error"
+	// when no response was received.
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of Fitbit API requests by response status code.",
+	}, []string{"code"})
+	// APIRequestDuration observes the duration of the Fitbit API requests.
+	APIRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of the Fitbit API requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	// RateLimitRemaining is the number of API requests left before the rate
+	// limit is reached, as last reported by Fitbit.
+	RateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "api_rate_limit_remaining",
+		Help:      "Fitbit API requests left before the rate limit is reached.",
+	})
+	// TokenRefreshes counts the refreshed and persisted OAuth2 tokens.
+	TokenRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of OAuth2 token refreshes.",
+	})
+	// InfluxFlushDuration observes the duration of the InfluxDB batch
+	// writes.
+	InfluxFlushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "influxdb_flush_duration_seconds",
+		Help:      "Duration of the InfluxDB batch writes.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	// DaysWithoutReadings counts the synced days without heart rate
+	// readings, when the device was not worn or has not synced.
+	DaysWithoutReadings = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "days_without_readings_total",
+		Help:      "Number of synced days without heart rate readings.",
+	})
+	// DaysWaitingForDevice is the number of days that were not synced at
+	// the last sync, because the device has not synced them yet.
+	DaysWaitingForDevice = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "days_waiting_for_device_sync",
+		Help:      "Number of days not synced because the device has not synced them yet.",
+	})
+	// DeviceBatteryLevel is the battery level of every device, in percent.
+	DeviceBatteryLevel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_battery_level_percent",
+		Help:      "Battery level of the device.",
+	}, []string{"device", "model"})
+	// DeviceLastSync is the time of the last sync of every device.
+	DeviceLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "device_last_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync of the device with Fitbit.",
+	}, []string{"device", "model"})
+	// InfluxFlushErrors counts the failed InfluxDB batch writes.
+	InfluxFlushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "influxdb_flush_errors_total",
+		Help:      "Number of failed InfluxDB batch writes.",
+	})
+)
+
+var lastSync atomic.Value
+
+// SyncDone records a sync that completed without error in LastSync.
+func SyncDone() {
+	now := time.Now()
+	lastSync.Store(now)
+	LastSync.Set(float64(now.UnixNano()) / 1e9)
+}
+
+// LastSyncTime returns the time of the last sync that completed without
+// error, zero if there was none.
+func LastSyncTime() time.Time {
+	t, _ := lastSync.Load().(time.Time)
+
+	return t
+}
+
+// Register registers the metrics, labeled with the user whose data is
+// exported, to r.
+func Register(r prometheus.Registerer, username string) error {
+	r = prometheus.WrapRegistererWith(prometheus.Labels{"user": username}, r)
+	for _, c := range []prometheus.Collector{
+		DaysSynced,
+		LastSync,
+		ReadingsSaved,
+		APIRequests,
+		APIRequestDuration,
+		RateLimitRemaining,
+		TokenRefreshes,
+		InfluxFlushDuration,
+		InfluxFlushErrors,
+		DaysWithoutReadings,
+		DaysWaitingForDevice,
+		DeviceBatteryLevel,
+		DeviceLastSync,
+	} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler returns a handler serving the metrics of the exporter, labeled
+// with the user, along with the Go runtime and process metrics and, if
+// latest, the latest readings.
+func Handler(username string, latest bool) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(prometheus.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+	if err := Register(reg, username); err != nil {
+		return nil, err
+	}
+	if latest {
+		if err := RegisterLatest(reg, username); err != nil {
+			return nil, err
+		}
+	}
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
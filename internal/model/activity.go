@@ -0,0 +1,163 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"strconv"
+	"time"
+)
+
+// The series of the logged activities, see ActivityListAPIData and TCX.
+var (
+	// Activity are the logged activities (workouts), at their start. The
+	// durations are in seconds and the average heart rate in beats per
+	// minute. The name is the type of the activity (ex. Run) and the log
+	// type tells how it was logged (ex. auto_detected, manual, tracker).
+	Activity = Series{
+		Name:   "activity",
+		Fields: []string{"duration", "active_duration", "calories", "average_heart_rate", "active_zone_minutes", "steps"},
+		Scope:  "activity",
+		Tags:   []string{"name", "log_type", "log_id"},
+		Events: true,
+	}
+	// ActivityTrackpoint are the points of the GPS tracks of the logged
+	// activities, with the altitude and the distance from the start in
+	// meters and the heart rate in beats per minute.
+	ActivityTrackpoint = Series{
+		Name:   "activity_trackpoint",
+		Fields: []string{"latitude", "longitude", "altitude", "distance", "heart_rate"},
+		Scope:  "location",
+		Tags:   []string{"log_id"},
+		Events: true,
+	}
+)
+
+// ActivityLog TODO.
+type ActivityLog struct {
+	LogID             int64   `json:"logId"`
+	ActivityName      string  `json:"activityName"`
+	LogType           string  `json:"logType"`
+	StartTime         string  `json:"startTime"`
+	Duration          int64   `json:"duration"`
+	ActiveDuration    int64   `json:"activeDuration"`
+	Calories          float64 `json:"calories"`
+	AverageHeartRate  float64 `json:"averageHeartRate"`
+	Steps             float64 `json:"steps"`
+	ActiveZoneMinutes *struct {
+		TotalMinutes float64 `json:"totalMinutes"`
+	} `json:"activeZoneMinutes"`
+	TCXLink string `json:"tcxLink"`
+}
+
+// Start returns the start time of the activity, whose wall clock time is in
+// loc when it has no zone.
+func (a ActivityLog) Start(loc *time.Location) (time.Time, error) {
+	return ParseLocalTime(a.StartTime, loc)
+}
+
+// Reading converts the activity to a reading of the Activity series, in UTC.
+func (a ActivityLog) Reading(loc *time.Location) (Reading, error) {
+	start, err := a.Start(loc)
+	if err != nil {
+		return Reading{}, err
+	}
+	values := map[string]float64{
+		"duration":        float64(a.Duration) / 1000,
+		"active_duration": float64(a.ActiveDuration) / 1000,
+		"calories":        a.Calories,
+	}
+	// the activities without a heart rate or steps have none of them
+	if a.AverageHeartRate > 0 {
+		values["average_heart_rate"] = a.AverageHeartRate
+	}
+	if a.Steps > 0 {
+		values["steps"] = a.Steps
+	}
+	if a.ActiveZoneMinutes != nil {
+		values["active_zone_minutes"] = a.ActiveZoneMinutes.TotalMinutes
+	}
+	tags := map[string]string{"log_id": strconv.FormatInt(a.LogID, 10)}
+	if a.ActivityName != "" {
+		tags["name"] = a.ActivityName
+	}
+	if a.LogType != "" {
+		tags["log_type"] = a.LogType
+	}
+
+	return Reading{Time: start.UTC(), Values: values, Tags: tags}, nil
+}
+
+// ActivityListAPIData is a page of the activity log list endpoint. The next
+// page is empty when there are no more activities.
+type ActivityListAPIData struct {
+	Activities []ActivityLog `json:"activities"`
+	Pagination struct {
+		Next string `json:"next"`
+	} `json:"pagination"`
+}
+
+// TCX is a Training Center XML document, the format of the GPS tracks of the
+// activities.
+type TCX struct {
+	Activities []struct {
+		Laps []struct {
+			Trackpoints []struct {
+				Time      string   `xml:"Time"`
+				Latitude  *float64 `xml:"Position>LatitudeDegrees"`
+				Longitude *float64 `xml:"Position>LongitudeDegrees"`
+				Altitude  *float64 `xml:"AltitudeMeters"`
+				Distance  *float64 `xml:"DistanceMeters"`
+				HeartRate *float64 `xml:"HeartRateBpm>Value"`
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+// Readings converts the trackpoints of the activity with the log id to
+// readings of the ActivityTrackpoint series, in UTC. The points without
+// a position are skipped.
+func (d TCX) Readings(logID int64) ([]Reading, error) {
+	var res []Reading
+	tags := map[string]string{"log_id": strconv.FormatInt(logID, 10)}
+	for _, a := range d.Activities {
+		for _, l := range a.Laps {
+			for _, p := range l.Trackpoints {
+				if p.Latitude == nil || p.Longitude == nil {
+					continue
+				}
+				ts, err := time.Parse(time.RFC3339Nano, p.Time)
+				if err != nil {
+					return nil, err
+				}
+				values := map[string]float64{"latitude": *p.Latitude, "longitude": *p.Longitude}
+				for field, v := range map[string]*float64{
+					"altitude":   p.Altitude,
+					"distance":   p.Distance,
+					"heart_rate": p.HeartRate,
+				} {
+					if v != nil {
+						values[field] = *v
+					}
+				}
+				res = append(res, Reading{Time: ts.UTC(), Values: values, Tags: tags})
+			}
+		}
+	}
+
+	return res, nil
+}
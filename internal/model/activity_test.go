@@ -0,0 +1,109 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestActivityLogReading(t *testing.T) {
+	var a ActivityLog
+	body := `{"logId":4213,"activityName":"Run","logType":"mobile_run","startTime":"2021-10-25T07:00:00.000+03:00",` +
+		`"duration":1805000,"activeDuration":1800000,"calories":310,"averageHeartRate":148,"steps":4200,` +
+		`"activeZoneMinutes":{"totalMinutes":25},"tcxLink":"https://api.fitbit.com/1/user/-/activities/4213.tcx"}`
+	if err := json.Unmarshal([]byte(body), &a); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Reading(time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Reading{
+		Time: time.Date(2021, 10, 25, 4, 0, 0, 0, time.UTC),
+		Values: map[string]float64{
+			"duration":            1805,
+			"active_duration":     1800,
+			"calories":            310,
+			"average_heart_rate":  148,
+			"active_zone_minutes": 25,
+			"steps":               4200,
+		},
+		Tags: map[string]string{"name": "Run", "log_type": "mobile_run", "log_id": "4213"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTCXReadings(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2">
+  <Activities>
+    <Activity Sport="Running">
+      <Id>2021-10-25T07:00:00.000+03:00</Id>
+      <Lap StartTime="2021-10-25T07:00:00.000+03:00">
+        <Track>
+          <Trackpoint>
+            <Time>2021-10-25T07:00:00.000+03:00</Time>
+            <Position><LatitudeDegrees>42.6977</LatitudeDegrees><LongitudeDegrees>23.3219</LongitudeDegrees></Position>
+            <AltitudeMeters>550.2</AltitudeMeters>
+            <DistanceMeters>0.0</DistanceMeters>
+            <HeartRateBpm><Value>98</Value></HeartRateBpm>
+          </Trackpoint>
+          <Trackpoint>
+            <Time>2021-10-25T07:00:01.000+03:00</Time>
+            <HeartRateBpm><Value>99</Value></HeartRateBpm>
+          </Trackpoint>
+          <Trackpoint>
+            <Time>2021-10-25T07:00:02.000+03:00</Time>
+            <Position><LatitudeDegrees>42.6978</LatitudeDegrees><LongitudeDegrees>23.3221</LongitudeDegrees></Position>
+          </Trackpoint>
+        </Track>
+      </Lap>
+    </Activity>
+  </Activities>
+</TrainingCenterDatabase>`
+	var tcx TCX
+	if err := xml.Unmarshal([]byte(body), &tcx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tcx.Readings(4213)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{"log_id": "4213"}
+	want := []Reading{
+		{
+			Time:   time.Date(2021, 10, 25, 4, 0, 0, 0, time.UTC),
+			Values: map[string]float64{"latitude": 42.6977, "longitude": 23.3219, "altitude": 550.2, "distance": 0, "heart_rate": 98},
+			Tags:   tags,
+		},
+		{
+			Time:   time.Date(2021, 10, 25, 4, 0, 2, 0, time.UTC),
+			Values: map[string]float64{"latitude": 42.6978, "longitude": 23.3221},
+			Tags:   tags,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"time"
+)
+
+// DeviceSeries is the history of the paired devices, with the battery level in
+// percent and the unix time of the last sync of every device when it was
+// polled. The battery is the coarse level (ex. High, Empty).
+var DeviceSeries = Series{
+	Name:   "device",
+	Fields: []string{"battery_level", "last_sync"},
+	Scope:  "settings",
+	Tags:   []string{"device_id", "model", "type", "battery"},
+	Key:    "device_id",
+}
+
+// Device is a device paired with the account of the user, ex. a tracker or a
+// scale.
+type Device struct {
+	ID    string
+	Model string
+	// Type is TRACKER or SCALE.
+	Type         string
+	Battery      string
+	BatteryLevel int
+	LastSync     time.Time
+}
+
+// Reading converts the state of the device at t to a reading of the
+// DeviceSeries.
+func (d Device) Reading(t time.Time) Reading {
+	return Reading{
+		Time: t.UTC(),
+		Values: map[string]float64{
+			"battery_level": float64(d.BatteryLevel),
+			"last_sync":     float64(d.LastSync.Unix()),
+		},
+		Tags: map[string]string{"device_id": d.ID, "model": d.Model, "type": d.Type, "battery": d.Battery},
+	}
+}
+
+// DevicesAPIData is the response of the devices endpoint.
+type DevicesAPIData []struct {
+	ID            string `json:"id"`
+	DeviceVersion string `json:"deviceVersion"`
+	Type          string `json:"type"`
+	Battery       string `json:"battery"`
+	BatteryLevel  int    `json:"batteryLevel"`
+	LastSyncTime  string `json:"lastSyncTime"`
+}
+
+// Devices converts the devices, whose last sync times are wall clock times
+// in loc, the time zone of the user's profile.
+func (d DevicesAPIData) Devices(loc *time.Location) ([]Device, error) {
+	var res []Device
+	for _, v := range d {
+		lastSync, err := ParseLocalTime(v.LastSyncTime, loc)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Device{
+			ID:           v.ID,
+			Model:        v.DeviceVersion,
+			Type:         v.Type,
+			Battery:      v.Battery,
+			BatteryLevel: v.BatteryLevel,
+			LastSync:     lastSync,
+		})
+	}
+
+	return res, nil
+}
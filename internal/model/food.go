@@ -0,0 +1,113 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"strconv"
+	"time"
+)
+
+// The series of the nutrition logs, see FoodAPIData and WaterAPIData.
+var (
+	// Food are the logged foods, at the start of the day they were logged
+	// for, with their calories and nutritional values in grams (sodium in
+	// milligrams) and the amount of the unit that was eaten.
+	Food = Series{
+		Name:   "food_log",
+		Fields: []string{"calories", "carbs", "fat", "fiber", "protein", "sodium", "amount"},
+		Scope:  "nutrition",
+		Tags:   []string{"log_id", "meal_type", "name", "brand", "unit"},
+		Key:    "log_id",
+	}
+	// Water is the daily water intake, in milliliters.
+	Water = Series{Name: "water", Fields: []string{"amount"}, Scope: "nutrition", Daily: true}
+)
+
+// MealTypes are the names of the meal types of the food logs by id.
+var MealTypes = map[int]string{
+	1: "Breakfast",
+	2: "Morning Snack",
+	3: "Lunch",
+	4: "Afternoon Snack",
+	5: "Dinner",
+	6: "Evening Snack",
+	7: "Anytime",
+}
+
+// FoodAPIData is the response of the food log endpoint.
+type FoodAPIData struct {
+	Foods []struct {
+		LogID      int64 `json:"logId"`
+		LoggedFood struct {
+			Name       string  `json:"name"`
+			Brand      string  `json:"brand"`
+			Amount     float64 `json:"amount"`
+			MealTypeID int     `json:"mealTypeId"`
+			Unit       struct {
+				Name string `json:"name"`
+			} `json:"unit"`
+		} `json:"loggedFood"`
+		NutritionalValues map[string]float64 `json:"nutritionalValues"`
+	} `json:"foods"`
+}
+
+// Readings TODO.
+func (d FoodAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, f := range d.Foods {
+		values := map[string]float64{"amount": f.LoggedFood.Amount}
+		for _, field := range Food.Fields {
+			if v, ok := f.NutritionalValues[field]; ok {
+				values[field] = v
+			}
+		}
+		tags := map[string]string{"log_id": strconv.FormatInt(f.LogID, 10)}
+		for tag, v := range map[string]string{
+			"meal_type": MealTypes[f.LoggedFood.MealTypeID],
+			"name":      f.LoggedFood.Name,
+			"brand":     f.LoggedFood.Brand,
+			"unit":      f.LoggedFood.Unit.Name,
+		} {
+			if v != "" {
+				tags[tag] = v
+			}
+		}
+		res = append(res, Reading{Time: t.UTC(), Values: values, Tags: tags})
+	}
+
+	return res, nil
+}
+
+// WaterAPIData is the response of the water log endpoint.
+type WaterAPIData struct {
+	Summary struct {
+		Water float64 `json:"water"`
+	} `json:"summary"`
+	Water []struct {
+		Amount float64 `json:"amount"`
+	} `json:"water"`
+}
+
+// Readings returns the total of the day, if water was logged.
+func (d WaterAPIData) Readings(t time.Time) ([]Reading, error) {
+	if len(d.Water) == 0 {
+		return nil, nil
+	}
+
+	return []Reading{{Time: t.UTC(), Values: map[string]float64{"amount": d.Summary.Water}}}, nil
+}
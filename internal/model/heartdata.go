@@ -18,6 +18,7 @@
 package model
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -66,7 +67,25 @@ type HeartAPIData struct {
 type ActivitiesHeart struct {
 	Date  string      `json:"dateTime"`
 	Zones []HeartZone `json:"heartRateZones"`
-	Value string      `json:"value"`
+	Value HeartValue  `json:"value"`
+}
+
+// HeartValue is the daily heart rate summary. The API returns it as an
+// object holding the resting heart rate, but older responses had a string
+// instead, which is ignored.
+type HeartValue struct {
+	RestingHeartRate int `json:"restingHeartRate"`
+}
+
+// UnmarshalJSON TODO.
+func (v *HeartValue) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*v = HeartValue{}
+		return nil
+	}
+	type plain HeartValue
+
+	return json.Unmarshal(b, (*plain)(v))
 }
 
 // HeartZone TODO.
@@ -89,14 +108,18 @@ type APIValue struct {
 	Value int      `json:"value"`
 }
 
-// ToHeartData TODO.
+// ToHeartData converts the readings of the day starting at t. The API
+// returns the wall clock times of the readings in the time zone of the user's
+// profile, which must be t.Location(). The readings are returned in UTC.
 func ToHeartData(d HeartAPIData, t time.Time) []HeartData {
 	var res []HeartData
+	var prev time.Time
 	for _, r := range d.ActivitiesHeartInteraday.Dataset {
 		rt := time.Time(r.Time)
-		ts := time.Date(t.Year(), t.Month(), t.Day(), rt.Hour(), rt.Minute(), rt.Second(), 0, t.Location())
+		ts := wallClock(t, rt.Hour(), rt.Minute(), rt.Second(), prev)
+		prev = ts
 		res = append(res, HeartData{
-			DateTime: time.Time(ts),
+			DateTime: ts.UTC(),
 			Value: Value{
 				BMP:        r.Value,
 				Confidence: 1,
@@ -106,3 +129,35 @@ func ToHeartData(d HeartAPIData, t time.Time) []HeartData {
 
 	return res
 }
+
+// wallClock returns the instant at which the clock showed h:m:s on the day
+// of t, in t.Location(). When the clock is moved back, the wall clock times
+// of the repeated hour happen twice, and the first one after prev is
+// returned, as the readings are sorted.
+func wallClock(t time.Time, h, m, s int, prev time.Time) time.Time {
+	ts := time.Date(t.Year(), t.Month(), t.Day(), h, m, s, 0, t.Location())
+	_, before := ts.Add(-12 * time.Hour).Zone()
+	_, after := ts.Add(12 * time.Hour).Zone()
+	if before == after {
+		return ts
+	}
+	shift := time.Duration(before-after) * time.Second
+	if shift < 0 {
+		shift = -shift
+	}
+	var res time.Time
+	for _, c := range []time.Time{ts.Add(-shift), ts, ts.Add(shift)} {
+		if c.Hour() != h || c.Minute() != m || c.Second() != s || c.Day() != ts.Day() {
+			continue
+		}
+		if res.IsZero() || (c.After(prev) && (!res.After(prev) || c.Before(res))) {
+			res = c
+		}
+	}
+	if res.IsZero() {
+		// skipped when the clock moved forward, normalized by time.Date
+		return ts
+	}
+
+	return res
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToHeartData(t *testing.T) {
+	sofia, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	clock := func(h, m, s int) APIValue {
+		return APIValue{Time: DateTime(time.Date(0, 1, 1, h, m, s, 0, time.UTC))}
+	}
+	utc := func(month time.Month, day, h, m int) time.Time {
+		return time.Date(2019, month, day, h, m, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		day     time.Time
+		dataset []APIValue
+		want    []time.Time
+	}{
+		{
+			name:    "utc",
+			day:     utc(6, 1, 0, 0),
+			dataset: []APIValue{clock(0, 0, 0), clock(23, 59, 0)},
+			want:    []time.Time{utc(6, 1, 0, 0), utc(6, 1, 23, 59)},
+		},
+		{
+			name:    "profile time zone",
+			day:     time.Date(2019, 6, 1, 0, 0, 0, 0, sofia),
+			dataset: []APIValue{clock(0, 0, 0), clock(23, 59, 0)},
+			want:    []time.Time{utc(5, 31, 21, 0), utc(6, 1, 20, 59)},
+		},
+		{
+			name:    "clock moved forward",
+			day:     time.Date(2019, 3, 31, 0, 0, 0, 0, sofia),
+			dataset: []APIValue{clock(2, 59, 0), clock(4, 0, 0)},
+			want:    []time.Time{utc(3, 31, 0, 59), utc(3, 31, 1, 0)},
+		},
+		{
+			name: "clock moved back",
+			day:  time.Date(2019, 10, 27, 0, 0, 0, 0, sofia),
+			dataset: []APIValue{
+				clock(2, 59, 0), clock(3, 0, 0), clock(3, 59, 0),
+				clock(3, 0, 0), clock(3, 59, 0), clock(4, 0, 0),
+			},
+			want: []time.Time{
+				utc(10, 26, 23, 59), utc(10, 27, 0, 0), utc(10, 27, 0, 59),
+				utc(10, 27, 1, 0), utc(10, 27, 1, 59), utc(10, 27, 2, 0),
+			},
+		},
+		{
+			name:    "clock moved back, second pass only",
+			day:     time.Date(2019, 10, 27, 0, 0, 0, 0, sofia),
+			dataset: []APIValue{clock(2, 59, 0), clock(3, 30, 0)},
+			want:    []time.Time{utc(10, 26, 23, 59), utc(10, 27, 0, 30)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := HeartAPIData{ActivitiesHeartInteraday: ActivitiesHeartInteraday{Dataset: tt.dataset}}
+			got := ToHeartData(d, tt.day)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d readings, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !got[i].DateTime.Equal(tt.want[i]) || got[i].DateTime.Location() != time.UTC {
+					t.Errorf("reading %d at %v, want %v", i, got[i].DateTime, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+// Latest holds the latest readings of a day.
+type Latest struct {
+	// HeartRate is the last heart rate reading of the day, if any.
+	HeartRate *HeartData
+	// RestingHeartRate is zero until Fitbit computes it.
+	RestingHeartRate int
+	Steps            int
+}
+
+// StepsAPIData TODO.
+type StepsAPIData struct {
+	ActivitiesSteps []StepsValue `json:"activities-steps"`
+}
+
+// StepsValue TODO.
+type StepsValue struct {
+	Date  string `json:"dateTime"`
+	Value string `json:"value"`
+}
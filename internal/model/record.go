@@ -0,0 +1,67 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+// Record are the readings recorded by the devices of other vendors, ex. every
+// second or few during the activities in the FIT files of the Garmin devices
+// or every minute by the devices of Gadgetbridge, with the heart rate in
+// beats per minute, the cadence in steps or revolutions per minute, the
+// position in degrees, the altitude and the distance from the start in
+// meters and the speed in meters per second. The source is the vendor or the
+// device, which have a reading each at a time.
+var Record = Series{
+	Name:   "record",
+	Fields: []string{"heart_rate", "cadence", "latitude", "longitude", "altitude", "distance", "speed"},
+	Tags:   []string{"source"},
+	Key:    "source",
+}
+
+// The series read from the exports of the health apps, whose source is the
+// app or the device that recorded the readings. They have a reading per
+// source at a time.
+var (
+	// Steps are the steps counted in the intervals starting at the times
+	// of the readings, which may overlap for different sources.
+	Steps = Series{
+		Name:   "steps",
+		Fields: []string{"steps"},
+		Scope:  "activity",
+		Tags:   []string{"source"},
+		Key:    "source",
+	}
+	// RestingHeartRate is the daily resting heart rate, in beats per
+	// minute.
+	RestingHeartRate = Series{
+		Name:   "resting_heart_rate",
+		Fields: []string{"value"},
+		Scope:  "heartrate",
+		Daily:  true,
+		Tags:   []string{"source"},
+		Key:    "source",
+	}
+	// SleepStage are the stages of the sleep (light, deep, rem or awake)
+	// starting at the times of the readings and lasting duration seconds,
+	// ex. the minute samples of a tracker.
+	SleepStage = Series{
+		Name:   "sleep_stage",
+		Fields: []string{"duration"},
+		Scope:  "sleep",
+		Tags:   []string{"source", "stage"},
+		Key:    "source",
+	}
+)
@@ -0,0 +1,492 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Series describes a series of readings other than the intraday heart rate,
+// ex. the nightly SpO2. Its readings are stored in a table (PostgreSQL) or a
+// measurement (InfluxDB) named after the series, with a column or field for
+// each of the Fields.
+type Series struct {
+	Name   string
+	Fields []string
+	// Scope is the OAuth2 scope needed to read the series from the API.
+	Scope string
+	// Daily series have a reading per day, at its start.
+	Daily bool
+	// Tags are the string attributes of the readings, ex. the source of a
+	// weight log.
+	Tags []string
+	// Key is the tag that tells apart the readings at the same time, ex.
+	// the foods logged on a day. Without it, the time is unique.
+	Key string
+	// Events series have infrequent readings at irregular times, ex. the
+	// weight logs, and are synced by date ranges rather than day by day.
+	Events bool
+}
+
+// Reading is a reading of a Series. Values holds the fields of the series
+// that were recorded and Tags its tags that are known.
+type Reading struct {
+	Time   time.Time
+	Values map[string]float64
+	Tags   map[string]string
+}
+
+// The series read from the API and the offline export.
+var (
+	// SpO2 is the nightly blood oxygen saturation, in percent.
+	SpO2 = Series{Name: "spo2", Fields: []string{"avg", "min", "max"}, Scope: "oxygen_saturation", Daily: true}
+	// SpO2Intraday is the SpO2 during the night, about every minute.
+	SpO2Intraday = Series{Name: "spo2_intraday", Fields: []string{"value"}, Scope: "oxygen_saturation"}
+	// HRV is the nightly heart rate variability (RMSSD), in milliseconds.
+	HRV = Series{Name: "hrv", Fields: []string{"daily_rmssd", "deep_rmssd"}, Scope: "heartrate", Daily: true}
+	// HRVIntraday is the HRV of every five minutes of sleep, along with
+	// the coverage of the data and its low and high frequency power.
+	HRVIntraday = Series{Name: "hrv_intraday", Fields: []string{"rmssd", "coverage", "lf", "hf"}, Scope: "heartrate"}
+	// BreathingRate is the nightly breathing rate by sleep stage, in
+	// breaths per minute.
+	BreathingRate = Series{
+		Name:   "breathing_rate",
+		Fields: []string{"full_sleep", "deep_sleep", "light_sleep", "rem_sleep"},
+		Scope:  "respiratory_rate",
+		Daily:  true,
+	}
+	// SkinTemperature is the nightly variation of the skin temperature
+	// from the personal baseline, in degrees Celsius.
+	SkinTemperature = Series{Name: "skin_temperature", Fields: []string{"nightly_relative"}, Scope: "temperature", Daily: true}
+	// ActiveZoneMinutes are the Active Zone Minutes of every minute, by
+	// heart rate zone, and their total, where the minutes in the cardio and
+	// the peak zones count twice.
+	ActiveZoneMinutes = Series{
+		Name:   "active_zone_minutes",
+		Fields: []string{"fat_burn", "cardio", "peak", "total"},
+		Scope:  "activity",
+	}
+	// VO2Max is the daily cardio fitness score, the range of the estimated
+	// VO2 max in ml/kg/min.
+	VO2Max = Series{Name: "vo2_max", Fields: []string{"low", "high"}, Scope: "cardio_fitness", Daily: true}
+	// Weight are the body weight logs, in kilograms, with the BMI and the
+	// body fat in percent. The source of a log is the scale that recorded
+	// it (ex. Aria), Web for the manual logs or API.
+	Weight = Series{
+		Name:   "weight",
+		Fields: []string{"weight", "bmi", "fat"},
+		Scope:  "weight",
+		Tags:   []string{"source"},
+		Events: true,
+	}
+
+	// AllSeries are all the known series by name.
+	AllSeries = seriesByName(SpO2, SpO2Intraday, HRV, HRVIntraday, BreathingRate, SkinTemperature, ActiveZoneMinutes, VO2Max,
+		Weight, Activity, ActivityTrackpoint, Food, Water)
+)
+
+func seriesByName(series ...Series) map[string]Series {
+	res := make(map[string]Series, len(series))
+	for _, s := range series {
+		res[s.Name] = s
+	}
+
+	return res
+}
+
+// ParseSeries returns the series with the comma separated names.
+func ParseSeries(names string) ([]Series, error) {
+	var res []Series
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		s, ok := AllSeries[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown series %q, expected one of %v", name, SeriesNames())
+		}
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+// SeriesNames returns the sorted names of all the known series.
+func SeriesNames() []string {
+	res := make([]string, 0, len(AllSeries))
+	for name := range AllSeries {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// SeriesAPIData is the response of the API endpoint of a series.
+type SeriesAPIData interface {
+	// Readings converts the readings of the day starting at t, whose
+	// location must be the time zone of the user's profile. The readings
+	// are returned in UTC.
+	Readings(t time.Time) ([]Reading, error)
+}
+
+// SpO2APIData TODO.
+type SpO2APIData struct {
+	DateTime string `json:"dateTime"`
+	Value    *struct {
+		Avg float64 `json:"avg"`
+		Min float64 `json:"min"`
+		Max float64 `json:"max"`
+	} `json:"value"`
+}
+
+// Readings TODO.
+func (d SpO2APIData) Readings(t time.Time) ([]Reading, error) {
+	if d.Value == nil {
+		return nil, nil
+	}
+
+	return []Reading{{
+		Time:   t.UTC(),
+		Values: map[string]float64{"avg": d.Value.Avg, "min": d.Value.Min, "max": d.Value.Max},
+	}}, nil
+}
+
+// SpO2IntradayAPIData TODO.
+type SpO2IntradayAPIData struct {
+	DateTime string `json:"dateTime"`
+	Minutes  []struct {
+		Minute string  `json:"minute"`
+		Value  float64 `json:"value"`
+	} `json:"minutes"`
+}
+
+// Readings TODO.
+func (d SpO2IntradayAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, m := range d.Minutes {
+		ts, err := ParseLocalTime(m.Minute, t.Location())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Reading{Time: ts.UTC(), Values: map[string]float64{"value": m.Value}})
+	}
+
+	return res, nil
+}
+
+// HRVAPIData TODO.
+type HRVAPIData struct {
+	HRV []struct {
+		DateTime string `json:"dateTime"`
+		Value    struct {
+			DailyRMSSD float64 `json:"dailyRmssd"`
+			DeepRMSSD  float64 `json:"deepRmssd"`
+		} `json:"value"`
+		Minutes []struct {
+			Minute string `json:"minute"`
+			Value  struct {
+				RMSSD    float64 `json:"rmssd"`
+				Coverage float64 `json:"coverage"`
+				HF       float64 `json:"hf"`
+				LF       float64 `json:"lf"`
+			} `json:"value"`
+		} `json:"minutes"`
+	} `json:"hrv"`
+}
+
+// Readings returns the daily summary of the HRV.
+func (d HRVAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, h := range d.HRV {
+		res = append(res, Reading{
+			Time:   t.UTC(),
+			Values: map[string]float64{"daily_rmssd": h.Value.DailyRMSSD, "deep_rmssd": h.Value.DeepRMSSD},
+		})
+	}
+
+	return res, nil
+}
+
+// HRVIntradayAPIData is the response of the intraday HRV endpoint, which has
+// the same format as the summary one.
+type HRVIntradayAPIData HRVAPIData
+
+// Readings TODO.
+func (d HRVIntradayAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, h := range d.HRV {
+		for _, m := range h.Minutes {
+			ts, err := ParseLocalTime(m.Minute, t.Location())
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, Reading{Time: ts.UTC(), Values: map[string]float64{
+				"rmssd":    m.Value.RMSSD,
+				"coverage": m.Value.Coverage,
+				"lf":       m.Value.LF,
+				"hf":       m.Value.HF,
+			}})
+		}
+	}
+
+	return res, nil
+}
+
+type breathingRate struct {
+	BreathingRate float64 `json:"breathingRate"`
+}
+
+// BreathingRateAPIData is the response of the intraday breathing rate
+// endpoint, which has the rate of every sleep stage.
+type BreathingRateAPIData struct {
+	BR []struct {
+		DateTime string `json:"dateTime"`
+		Value    struct {
+			FullSleep  *breathingRate `json:"fullSleepSummary"`
+			DeepSleep  *breathingRate `json:"deepSleepSummary"`
+			LightSleep *breathingRate `json:"lightSleepSummary"`
+			REMSleep   *breathingRate `json:"remSleepSummary"`
+		} `json:"value"`
+	} `json:"br"`
+}
+
+// Readings TODO.
+func (d BreathingRateAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, br := range d.BR {
+		values := make(map[string]float64)
+		for field, v := range map[string]*breathingRate{
+			"full_sleep":  br.Value.FullSleep,
+			"deep_sleep":  br.Value.DeepSleep,
+			"light_sleep": br.Value.LightSleep,
+			"rem_sleep":   br.Value.REMSleep,
+		} {
+			// a stage without enough data is reported as 0
+			if v != nil && v.BreathingRate > 0 {
+				values[field] = v.BreathingRate
+			}
+		}
+		if len(values) > 0 {
+			res = append(res, Reading{Time: t.UTC(), Values: values})
+		}
+	}
+
+	return res, nil
+}
+
+// SkinTemperatureAPIData TODO.
+type SkinTemperatureAPIData struct {
+	TempSkin []struct {
+		DateTime string `json:"dateTime"`
+		Value    struct {
+			NightlyRelative float64 `json:"nightlyRelative"`
+		} `json:"value"`
+		LogType string `json:"logType"`
+	} `json:"tempSkin"`
+}
+
+// Readings TODO.
+func (d SkinTemperatureAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, s := range d.TempSkin {
+		res = append(res, Reading{Time: t.UTC(), Values: map[string]float64{"nightly_relative": s.Value.NightlyRelative}})
+	}
+
+	return res, nil
+}
+
+// ActiveZoneMinutesAPIData is the response of the intraday Active Zone
+// Minutes endpoint.
+type ActiveZoneMinutesAPIData struct {
+	Intraday []struct {
+		DateTime string `json:"dateTime"`
+		Minutes  []struct {
+			Minute string `json:"minute"`
+			Value  struct {
+				FatBurn *float64 `json:"fatBurnActiveZoneMinutes"`
+				Cardio  *float64 `json:"cardioActiveZoneMinutes"`
+				Peak    *float64 `json:"peakActiveZoneMinutes"`
+				Total   float64  `json:"activeZoneMinutes"`
+			} `json:"value"`
+		} `json:"minutes"`
+	} `json:"activities-active-zone-minutes-intraday"`
+}
+
+// Readings TODO.
+func (d ActiveZoneMinutesAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, day := range d.Intraday {
+		for _, m := range day.Minutes {
+			ts, err := ParseLocalTime(m.Minute, t.Location())
+			if err != nil {
+				return nil, err
+			}
+			// the zones without minutes are missing
+			values := map[string]float64{"total": m.Value.Total}
+			for field, v := range map[string]*float64{"fat_burn": m.Value.FatBurn, "cardio": m.Value.Cardio, "peak": m.Value.Peak} {
+				if v != nil {
+					values[field] = *v
+				}
+			}
+			res = append(res, Reading{Time: ts.UTC(), Values: values})
+		}
+	}
+
+	return res, nil
+}
+
+// VO2MaxAPIData is the response of the cardio fitness score endpoint. The
+// VO2 max is a range (ex. 44-48) or, when estimated from a run with GPS, a
+// single value.
+type VO2MaxAPIData struct {
+	CardioScore []struct {
+		DateTime string `json:"dateTime"`
+		Value    struct {
+			VO2Max string `json:"vo2Max"`
+		} `json:"value"`
+	} `json:"cardioScore"`
+}
+
+// Readings TODO.
+func (d VO2MaxAPIData) Readings(t time.Time) ([]Reading, error) {
+	var res []Reading
+	for _, c := range d.CardioScore {
+		low, high, err := parseRange(c.Value.VO2Max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VO2 max: %v", err)
+		}
+		res = append(res, Reading{Time: t.UTC(), Values: map[string]float64{"low": low, "high": high}})
+	}
+
+	return res, nil
+}
+
+// parseRange parses a range of numbers (ex. 44-48) or a single number, whose
+// range is the number itself.
+func parseRange(s string) (float64, float64, error) {
+	parts := strings.SplitN(s, "-", 2)
+	low, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || len(parts) == 1 {
+		return low, low, err
+	}
+	high, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+
+	return low, high, err
+}
+
+// RangeAPIData is the response of the API endpoints of an events series,
+// which have the readings of a date range.
+type RangeAPIData interface {
+	// Readings converts the readings, whose times are wall clock times in
+	// loc, the time zone of the user's profile. The readings are returned
+	// in UTC.
+	Readings(loc *time.Location) ([]Reading, error)
+}
+
+// PoundsToKilograms converts a weight in pounds to kilograms.
+const PoundsToKilograms = 0.45359237
+
+// WeightLog is a weight or body fat log of the API or the offline export.
+type WeightLog struct {
+	LogID  int64   `json:"logId"`
+	Date   string  `json:"date"`
+	Time   string  `json:"time"`
+	Weight float64 `json:"weight"`
+	BMI    float64 `json:"bmi"`
+	Fat    float64 `json:"fat"`
+	Source string  `json:"source"`
+}
+
+// WeightAPIData is the response of the weight and the body fat log
+// endpoints, which are decoded in the same value.
+type WeightAPIData struct {
+	Weight []WeightLog `json:"weight"`
+	Fat    []WeightLog `json:"fat"`
+}
+
+// Readings TODO.
+func (d WeightAPIData) Readings(loc *time.Location) ([]Reading, error) {
+	return WeightReadings(append(d.Weight, d.Fat...), "2006-01-02", 1, loc)
+}
+
+// WeightReadings converts the logs, whose dates have the given layout, to
+// readings of the Weight series sorted by time. The weights are multiplied
+// by kilograms, the weight of a unit in kilograms. The logs at the same time,
+// ex. the weight and the body fat measured by a scale, are merged.
+func WeightReadings(logs []WeightLog, dateLayout string, kilograms float64, loc *time.Location) ([]Reading, error) {
+	byTime := make(map[int64]*Reading)
+	var res []*Reading
+	for _, l := range logs {
+		ts, err := time.ParseInLocation(dateLayout+" 15:04:05", l.Date+" "+l.Time, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time of the weight log %v: %v", l.LogID, err)
+		}
+		r, ok := byTime[ts.UnixNano()]
+		if !ok {
+			r = &Reading{Time: ts.UTC(), Values: make(map[string]float64)}
+			byTime[ts.UnixNano()] = r
+			res = append(res, r)
+		}
+		for field, v := range map[string]float64{"weight": l.Weight * kilograms, "bmi": l.BMI, "fat": l.Fat} {
+			if v > 0 {
+				r.Values[field] = v
+			}
+		}
+		if l.Source != "" && r.Tags == nil {
+			r.Tags = map[string]string{"source": l.Source}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	readings := make([]Reading, len(res))
+	for i, r := range res {
+		readings[i] = *r
+	}
+
+	return readings, nil
+}
+
+var localTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	// the older exports
+	"01/02/06 15:04:05",
+}
+
+// ParseLocalTime parses a time as reported by the API or in the offline
+// export. The times without a zone are wall clock times in loc.
+func ParseLocalTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
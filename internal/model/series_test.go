@@ -0,0 +1,192 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSeriesAPIData(t *testing.T) {
+	sofia, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	day := time.Date(2021, 10, 25, 0, 0, 0, 0, sofia)
+	start := time.Date(2021, 10, 24, 21, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		data SeriesAPIData
+		body string
+		want []Reading
+	}{
+		{
+			"spo2",
+			&SpO2APIData{},
+			`{"dateTime":"2021-10-25","value":{"avg":97.5,"min":94.0,"max":100.0}}`,
+			[]Reading{{Time: start, Values: map[string]float64{"avg": 97.5, "min": 94, "max": 100}}},
+		},
+		{"spo2 without data", &SpO2APIData{}, `{}`, nil},
+		{
+			"spo2 intraday",
+			&SpO2IntradayAPIData{},
+			`{"dateTime":"2021-10-25","minutes":[{"value":95.7,"minute":"2021-10-25T04:18:45"}]}`,
+			[]Reading{{Time: time.Date(2021, 10, 25, 1, 18, 45, 0, time.UTC), Values: map[string]float64{"value": 95.7}}},
+		},
+		{
+			"hrv",
+			&HRVAPIData{},
+			`{"hrv":[{"value":{"dailyRmssd":34.938,"deepRmssd":31.567},"dateTime":"2021-10-25"}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"daily_rmssd": 34.938, "deep_rmssd": 31.567}}},
+		},
+		{
+			"hrv intraday",
+			&HRVIntradayAPIData{},
+			`{"hrv":[{"minutes":[{"minute":"2021-10-25T09:10:00.000","value":{"rmssd":26.617,"coverage":0.935,"hf":126.037,"lf":217.0}}],"dateTime":"2021-10-25"}]}`,
+			[]Reading{{Time: time.Date(2021, 10, 25, 6, 10, 0, 0, time.UTC), Values: map[string]float64{"rmssd": 26.617, "coverage": 0.935, "hf": 126.037, "lf": 217}}},
+		},
+		{
+			"breathing rate",
+			&BreathingRateAPIData{},
+			`{"br":[{"value":{"deepSleepSummary":{"breathingRate":16.8},"remSleepSummary":{"breathingRate":0},"fullSleepSummary":{"breathingRate":17.8},"lightSleepSummary":{"breathingRate":16.6}},"dateTime":"2021-10-25"}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"full_sleep": 17.8, "deep_sleep": 16.8, "light_sleep": 16.6}}},
+		},
+		{"breathing rate without data", &BreathingRateAPIData{}, `{"br":[]}`, nil},
+		{
+			"skin temperature",
+			&SkinTemperatureAPIData{},
+			`{"tempSkin":[{"dateTime":"2021-10-25","value":{"nightlyRelative":-0.094},"logType":"dedicated_temp_sensor"}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"nightly_relative": -0.094}}},
+		},
+		{
+			"active zone minutes",
+			&ActiveZoneMinutesAPIData{},
+			`{"activities-active-zone-minutes-intraday":[{"dateTime":"2021-10-25","minutes":[` +
+				`{"minute":"2021-10-25T07:01:00","value":{"activeZoneMinutes":0}},` +
+				`{"minute":"2021-10-25T07:02:00","value":{"cardioActiveZoneMinutes":2,"activeZoneMinutes":2}}]}]}`,
+			[]Reading{
+				{Time: time.Date(2021, 10, 25, 4, 1, 0, 0, time.UTC), Values: map[string]float64{"total": 0}},
+				{Time: time.Date(2021, 10, 25, 4, 2, 0, 0, time.UTC), Values: map[string]float64{"cardio": 2, "total": 2}},
+			},
+		},
+		{
+			"vo2 max range",
+			&VO2MaxAPIData{},
+			`{"cardioScore":[{"dateTime":"2021-10-25","value":{"vo2Max":"44-48"}}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"low": 44, "high": 48}}},
+		},
+		{
+			"vo2 max value",
+			&VO2MaxAPIData{},
+			`{"cardioScore":[{"dateTime":"2021-10-25","value":{"vo2Max":"45.5"}}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"low": 45.5, "high": 45.5}}},
+		},
+		{
+			"food",
+			&FoodAPIData{},
+			`{"foods":[{"isFavorite":false,"logDate":"2021-10-25","logId":7001,"loggedFood":{"amount":1.5,"brand":"",` +
+				`"calories":142,"mealTypeId":1,"name":"Apple","unit":{"id":304,"name":"serving","plural":"servings"}},` +
+				`"nutritionalValues":{"calories":142,"carbs":37.5,"fat":0.5,"fiber":6.6,"protein":0.8,"sodium":3}}],` +
+				`"summary":{"calories":142,"water":0}}`,
+			[]Reading{{
+				Time:   start,
+				Values: map[string]float64{"calories": 142, "carbs": 37.5, "fat": 0.5, "fiber": 6.6, "protein": 0.8, "sodium": 3, "amount": 1.5},
+				Tags:   map[string]string{"log_id": "7001", "meal_type": "Breakfast", "name": "Apple", "unit": "serving"},
+			}},
+		},
+		{
+			"water",
+			&WaterAPIData{},
+			`{"summary":{"water":750},"water":[{"amount":500,"logId":1},{"amount":250,"logId":2}]}`,
+			[]Reading{{Time: start, Values: map[string]float64{"amount": 750}}},
+		},
+		{"water without logs", &WaterAPIData{}, `{"summary":{"water":0},"water":[]}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := json.Unmarshal([]byte(tt.body), tt.data); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.data.Readings(day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSeries(t *testing.T) {
+	got, err := ParseSeries(" spo2, hrv_intraday ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Series{SpO2, HRVIntraday}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := ParseSeries("spo2,pulse"); err == nil {
+		t.Error("unknown series accepted")
+	}
+}
+
+func TestWeightAPIData(t *testing.T) {
+	sofia, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	var data WeightAPIData
+	for _, body := range []string{
+		`{"weight":[{"bmi":22.41,"date":"2021-10-25","fat":18.5,"logId":1,"source":"Aria","time":"07:12:34","weight":72.5},` +
+			`{"bmi":22.2,"date":"2021-10-24","logId":2,"source":"Web","time":"23:59:59","weight":71.8}]}`,
+		`{"fat":[{"date":"2021-10-25","fat":18.5,"logId":1,"source":"Aria","time":"07:12:34"},` +
+			`{"date":"2021-10-25","fat":19.0,"logId":3,"source":"API","time":"20:00:00"}]}`,
+	} {
+		if err := json.Unmarshal([]byte(body), &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := data.Readings(sofia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Reading{
+		{
+			Time:   time.Date(2021, 10, 24, 20, 59, 59, 0, time.UTC),
+			Values: map[string]float64{"weight": 71.8, "bmi": 22.2},
+			Tags:   map[string]string{"source": "Web"},
+		},
+		{
+			Time:   time.Date(2021, 10, 25, 4, 12, 34, 0, time.UTC),
+			Values: map[string]float64{"weight": 72.5, "bmi": 22.41, "fat": 18.5},
+			Tags:   map[string]string{"source": "Aria"},
+		},
+		{
+			Time:   time.Date(2021, 10, 25, 17, 0, 0, 0, time.UTC),
+			Values: map[string]float64{"fat": 19},
+			Tags:   map[string]string{"source": "API"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
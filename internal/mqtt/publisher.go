@@ -0,0 +1,261 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package mqtt publishes the latest readings to an MQTT broker, optionally
+// with the Home Assistant MQTT discovery configs of the sensors.
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+const (
+	qos     = 1
+	timeout = 10 * time.Second
+
+	online  = "online"
+	offline = "offline"
+)
+
+// message is an MQTT message, always retained so that the subscribers get
+// the last value as soon as they subscribe.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// Publisher publishes the latest readings of a user. It implements
+// algorithm.Publisher.
+type Publisher struct {
+	client    paho.Client
+	topics    topics
+	discovery []message
+}
+
+// NewPublisher connects to the broker at brokerURL (ex.
+// tcp://localhost:1883) and returns a Publisher for the readings of the user
+// under topic (ex. fitbit/me):
+//
+//   - topic/heart_rate: {"bpm": 72, "time": "2019-06-01T12:00:00Z"}
+//   - topic/summary: {"date": "2019-06-01", "resting_heart_rate": 58, "steps": 1234}
+//   - topic/availability: online or offline
+//
+// If discoveryPrefix is not empty (usually homeassistant), the Home
+// Assistant discovery configs of the sensors are published under it.
+func NewPublisher(username, brokerURL, brokerUsername, brokerPassword, topic, discoveryPrefix string) (*Publisher, error) {
+	p := &Publisher{topics: newTopics(topic)}
+	if discoveryPrefix != "" {
+		var err error
+		if p.discovery, err = discoveryMessages(username, discoveryPrefix, p.topics); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID("fde-"+username).
+		SetUsername(brokerUsername).
+		SetPassword(brokerPassword).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetWill(p.topics.availability, offline, qos, true).
+		SetOnConnectHandler(func(c paho.Client) {
+			// announced again after every reconnection, as the broker
+			// published the will in between
+			for _, m := range append(p.discovery, message{p.topics.availability, []byte(online)}) {
+				c.Publish(m.topic, qos, true, m.payload)
+			}
+		})
+	p.client = paho.NewClient(opts)
+	if err := wait(p.client.Connect()); err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", brokerURL, err)
+	}
+	log.WithFields(log.Fields{"broker": brokerURL, "topic": topic}).Info("connected to the MQTT broker")
+
+	return p, nil
+}
+
+// Publish TODO.
+func (p *Publisher) Publish(day time.Time, l model.Latest) error {
+	msgs, err := p.topics.messages(day, l)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if err := wait(p.client.Publish(m.topic, qos, true, m.payload)); err != nil {
+			return fmt.Errorf("failed to publish to %v: %v", m.topic, err)
+		}
+	}
+
+	return nil
+}
+
+// Close marks the readings as unavailable and disconnects.
+func (p *Publisher) Close() error {
+	err := wait(p.client.Publish(p.topics.availability, qos, true, offline))
+	p.client.Disconnect(uint(timeout / time.Millisecond))
+
+	return err
+}
+
+func wait(t paho.Token) error {
+	if !t.WaitTimeout(timeout) {
+		return fmt.Errorf("timeout after %v", timeout)
+	}
+
+	return t.Error()
+}
+
+type topics struct {
+	heartRate    string
+	summary      string
+	availability string
+}
+
+func newTopics(base string) topics {
+	base = strings.TrimSuffix(base, "/")
+
+	return topics{
+		heartRate:    base + "/heart_rate",
+		summary:      base + "/summary",
+		availability: base + "/availability",
+	}
+}
+
+type heartRate struct {
+	BPM  int       `json:"bpm"`
+	Time time.Time `json:"time"`
+}
+
+type summary struct {
+	Date             string `json:"date"`
+	RestingHeartRate *int   `json:"resting_heart_rate"`
+	Steps            int    `json:"steps"`
+}
+
+// messages returns the messages for the latest readings of the day. The heart
+// rate is not published when there is none yet, keeping the previous one,
+// and the resting heart rate is null until Fitbit computes it, so the
+// templates reading it always find the key.
+func (t topics) messages(day time.Time, l model.Latest) ([]message, error) {
+	var res []message
+	var restingHeartRate *int
+	if l.RestingHeartRate != 0 {
+		restingHeartRate = &l.RestingHeartRate
+	}
+	if l.HeartRate != nil {
+		b, err := json.Marshal(heartRate{BPM: l.HeartRate.Value.BMP, Time: l.HeartRate.DateTime.UTC()})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, message{t.heartRate, b})
+	}
+	b, err := json.Marshal(summary{
+		Date:             day.Format("2006-01-02"),
+		RestingHeartRate: restingHeartRate,
+		Steps:            l.Steps,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(res, message{t.summary, b}), nil
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type sensorConfig struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	StateTopic        string `json:"state_topic"`
+	ValueTemplate     string `json:"value_template"`
+	UnitOfMeasurement string `json:"unit_of_measurement"`
+	Icon              string `json:"icon"`
+	AvailabilityTopic string `json:"availability_topic"`
+	Device            device `json:"device"`
+}
+
+// discoveryMessages returns the Home Assistant MQTT discovery configs of the
+// sensors, published to <prefix>/sensor/<unique id>/config.
+func discoveryMessages(username, prefix string, t topics) ([]message, error) {
+	id := "fde_" + sanitize(username)
+	dev := device{
+		Identifiers:  []string{id},
+		Name:         "Fitbit " + username,
+		Manufacturer: "Fitbit",
+	}
+	sensors := []sensorConfig{
+		{
+			Name:              "Fitbit " + username + " heart rate",
+			UniqueID:          id + "_heart_rate",
+			StateTopic:        t.heartRate,
+			ValueTemplate:     "{{ value_json.bpm }}",
+			UnitOfMeasurement: "bpm",
+			Icon:              "mdi:heart-pulse",
+		},
+		{
+			Name:              "Fitbit " + username + " resting heart rate",
+			UniqueID:          id + "_resting_heart_rate",
+			StateTopic:        t.summary,
+			ValueTemplate:     "{{ value_json.resting_heart_rate }}",
+			UnitOfMeasurement: "bpm",
+			Icon:              "mdi:heart",
+		},
+		{
+			Name:              "Fitbit " + username + " steps",
+			UniqueID:          id + "_steps",
+			StateTopic:        t.summary,
+			ValueTemplate:     "{{ value_json.steps }}",
+			UnitOfMeasurement: "steps",
+			Icon:              "mdi:walk",
+		},
+	}
+	var res []message
+	for _, s := range sensors {
+		s.AvailabilityTopic = t.availability
+		s.Device = dev
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, message{strings.TrimSuffix(prefix, "/") + "/sensor/" + s.UniqueID + "/config", b})
+	}
+
+	return res, nil
+}
+
+// sanitize keeps the characters allowed in the Home Assistant object ids.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package mqtt
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+func TestMessages(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	tp := newTopics("fitbit/me/")
+	l := model.Latest{
+		HeartRate:        &model.HeartData{DateTime: time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC), Value: model.Value{BMP: 72}},
+		RestingHeartRate: 58,
+		Steps:            1234,
+	}
+
+	msgs, err := tp.messages(day, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []message{
+		{"fitbit/me/heart_rate", []byte(`{"bpm":72,"time":"2019-06-01T12:00:00Z"}`)},
+		{"fitbit/me/summary", []byte(`{"date":"2019-06-01","resting_heart_rate":58,"steps":1234}`)},
+	}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+
+	msgs, err = tp.messages(day, model.Latest{Steps: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []message{{"fitbit/me/summary", []byte(`{"date":"2019-06-01","resting_heart_rate":null,"steps":10}`)}}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("without heart rate got %q, want %q", msgs, want)
+	}
+}
+
+func TestDiscoveryMessages(t *testing.T) {
+	tp := newTopics("fitbit/john.doe")
+	msgs, err := discoveryMessages("john.doe", "homeassistant", tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("got %d configs, want 3", len(msgs))
+	}
+	wantTopics := []string{
+		"homeassistant/sensor/fde_john_doe_heart_rate/config",
+		"homeassistant/sensor/fde_john_doe_resting_heart_rate/config",
+		"homeassistant/sensor/fde_john_doe_steps/config",
+	}
+	for i, m := range msgs {
+		if m.topic != wantTopics[i] {
+			t.Errorf("config %d: got topic %v, want %v", i, m.topic, wantTopics[i])
+		}
+		var s sensorConfig
+		if err := json.Unmarshal(m.payload, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.AvailabilityTopic != tp.availability {
+			t.Errorf("config %d: got availability topic %v, want %v", i, s.AvailabilityTopic, tp.availability)
+		}
+		if !reflect.DeepEqual(s.Device.Identifiers, []string{"fde_john_doe"}) {
+			t.Errorf("config %d: got device %v", i, s.Device.Identifiers)
+		}
+	}
+}
+
+// TestPublisher runs against the broker at FDE_TEST_MQTT_URL (ex.
+// tcp://localhost:1883).
+func TestPublisher(t *testing.T) {
+	url := os.Getenv("FDE_TEST_MQTT_URL")
+	if url == "" {
+		t.Skip("FDE_TEST_MQTT_URL is not set")
+	}
+	sub := paho.NewClient(paho.NewClientOptions().AddBroker(url).SetClientID("fde-test-subscriber"))
+	if err := wait(sub.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+	received := make(chan paho.Message, 10)
+	if err := wait(sub.Subscribe("fde-test/#", qos, func(_ paho.Client, m paho.Message) {
+		received <- m
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPublisher("test", url, "", "", "fde-test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), model.Latest{Steps: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for len(got) < 2 {
+		select {
+		case m := <-received:
+			got[m.Topic()] = string(m.Payload())
+		case <-time.After(timeout):
+			t.Fatalf("timeout waiting for the messages, got %v", got)
+		}
+	}
+	if s := got["fde-test/summary"]; s != `{"date":"2019-06-01","steps":42}` {
+		t.Errorf("got summary %v", s)
+	}
+}
@@ -19,17 +19,15 @@ package oauth2
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
-
-	log "github.com/sirupsen/logrus"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/fitbit"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
 )
 
 var (
@@ -44,24 +42,33 @@ type Config struct {
 	ClientID     string
 	ClientSecret string
 	Scopes       []string
+	// UserID and GrantedScopes are reported by Fitbit along with the token.
+	UserID        string   `json:",omitempty"`
+	GrantedScopes []string `json:",omitempty"`
+	// Endpoint and RevokeURL default to the Fitbit ones and are not stored.
+	Endpoint  oauth2.Endpoint `json:"-"`
+	RevokeURL string          `json:"-"`
 }
 
 // Client TODO.
 type Client struct {
-	config     Config
-	configFile string
-	client     *http.Client
-	source     oauth2.TokenSource
+	client *http.Client
+	conf   *oauth2.Config
+	source *persistingSource
 }
 
 // Close prepares the client to be deleted.
 func (c *Client) Close() error {
-	var err error
-	c.config.Token, err = c.source.Token()
-	if err != nil {
-		return err
-	}
-	err = c.config.WriteToFile(c.configFile)
+	_, err := c.source.Token()
+
+	return err
+}
+
+// Check returns an error if no valid token can be obtained, refreshing the
+// token if needed.
+func (c *Client) Check() error {
+	_, err := c.source.Token()
+
 	return err
 }
 
@@ -71,91 +78,160 @@ func (c *Client) Get(url string) (*http.Response, error) {
 }
 
 // New returns an Client whose Get method is configured to work with fitbit
-// oauth2 authentication.
-func New(configFile, bindAddr string, c Config) (*Client, error) {
-	ctx := context.Background()
-	if _, err := os.Stat(configFile); err == nil {
-		c, err = readConfFromFile(configFile, c)
-		if err != nil {
-			return nil, err
+// oauth2 authentication. The config is read from the store and merged with
+// c, and every refreshed token is saved back to it.
+//
+// When the stored token is missing or can not be refreshed and login is not
+// nil, the user is asked to authorize the application. Otherwise
+// ErrLoginRequired is returned, so that a daemon never blocks waiting for
+// user interaction.
+func New(store Store, c Config, login *LoginOptions) (*Client, error) {
+	c, err := loadConfig(store, c)
+	if err != nil {
+		return nil, err
+	}
+	conf := c.oauth2Config()
+	t, err := conf.TokenSource(context.Background(), c.Token).Token()
+	if err != nil {
+		if !needsLogin(c.Token, err) {
+			return nil, fmt.Errorf("failed to refresh the token: %v", err)
 		}
+		if login == nil {
+			return nil, ErrLoginRequired
+		}
+		return login.run(store, c, conf)
 	}
-	conf := &oauth2.Config{
-		ClientID:     c.ClientID,
-		ClientSecret: c.ClientSecret,
-		Scopes:       c.Scopes,
-		Endpoint:     fitbit.Endpoint,
+	if !sameToken(t, c.Token) {
+		metrics.TokenRefreshes.Inc()
 	}
-	var err error
-	source := conf.TokenSource(ctx, c.Token)
-	if c.Token, err = source.Token(); err != nil {
-		if c.Token, err = authCode(bindAddr, conf); err != nil {
-			return nil, err
-		}
-		source = conf.TokenSource(ctx, c.Token)
+	c.setToken(t)
+
+	return newClient(store, c, conf)
+}
+
+// needsLogin reports whether the token refresh failed because the user needs
+// to authorize the application again, as opposed to a transient failure.
+func needsLogin(t *oauth2.Token, err error) bool {
+	if t == nil || t.RefreshToken == "" {
+		return true
+	}
+	rErr, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return false
 	}
-	_ = c.WriteToFile(configFile)
-	res := Client{
-		configFile: configFile,
-		config:     c,
-		client:     conf.Client(ctx, c.Token),
-		source:     source,
+
+	return strings.Contains(string(rErr.Body), "invalid_grant")
+}
+
+// Login asks the user to authorize the application, even if a valid token
+// is already stored, and saves the obtained token to the store.
+func Login(store Store, c Config, opts LoginOptions) (*Client, error) {
+	c, err := loadConfig(store, c)
+	if err != nil {
+		return nil, err
 	}
-	return &res, nil
+
+	return opts.run(store, c, c.oauth2Config())
 }
 
-func readConfFromFile(configFile string, curConfig Config) (Config, error) {
-	var config Config
-	buf, err := ioutil.ReadFile(configFile)
+func (o LoginOptions) run(store Store, c Config, conf *oauth2.Config) (*Client, error) {
+	t, err := authorize(conf, o)
 	if err != nil {
-		return config, err
+		return nil, err
+	}
+	c.setToken(t)
+
+	return newClient(store, c, conf)
+}
+
+func newClient(store Store, c Config, conf *oauth2.Config) (*Client, error) {
+	ctx := context.Background()
+	source := newPersistingSource(conf.TokenSource(ctx, c.Token), c, store)
+	if err := source.persist(); err == ErrReadOnlyStore {
+		// the refresh token in the store is invalid after the first
+		// refresh, as Fitbit rotates it
+		return nil, fmt.Errorf("the token store %v is read only, the rotated tokens would be lost", store)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to persist the token: %v", err)
+	}
+
+	return &Client{
+		client: oauth2.NewClient(ctx, source),
+		conf:   conf,
+		source: source,
+	}, nil
+}
+
+// DefaultScopes are requested when neither the caller nor the store specify
+// any scopes. The profile gives the time zone of the readings.
+var DefaultScopes = []string{"heartrate", "profile"}
+
+// loadConfig returns the stored config. The client information in c, when
+// complete, takes precedence over the stored one, as do the scopes in c. When
+// no scopes are given or stored, DefaultScopes are used.
+func loadConfig(store Store, c Config) (Config, error) {
+	config, err := store.Load()
+	if err == ErrNoConfig {
+		return c.withDefaultScopes(), nil
 	}
-	err = json.Unmarshal(buf, &config)
 	if err != nil {
-		return config, err
+		return c, fmt.Errorf("failed to load config from %v: %v", store, err)
+	}
+	config.Endpoint = c.Endpoint
+	config.RevokeURL = c.RevokeURL
+	if c.ClientID != "" && c.ClientSecret != "" {
+		config.ClientID = c.ClientID
+		config.ClientSecret = c.ClientSecret
 	}
-	if curConfig.ClientID != "" && curConfig.ClientSecret != "" && len(curConfig.Scopes) > 0 {
-		curConfig.Token = config.Token
-		return curConfig, nil
+	if len(c.Scopes) > 0 {
+		config.Scopes = c.Scopes
 	}
 
-	return config, nil
+	return config.withDefaultScopes(), nil
 }
 
-func authCode(bindAddr string, conf *oauth2.Config) (*oauth2.Token, error) {
-	codeCh := make(chan string)
-	http.HandleFunc("/auth/fitbit/callback", func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		codeCh <- code
-		_, _ = w.Write([]byte(code))
-	})
-	srv := http.Server{
-		Addr: bindAddr,
+func (c Config) withDefaultScopes() Config {
+	if len(c.Scopes) == 0 {
+		c.Scopes = DefaultScopes
 	}
-	go func() {
-		_ = srv.ListenAndServe()
-	}()
-	if conf.ClientID == "" || conf.ClientSecret == "" {
-		return nil, ErrMissingClientInformation
+
+	return c
+}
+
+// setToken updates the token and the information Fitbit returns with it.
+func (c *Config) setToken(t *oauth2.Token) {
+	c.Token = t
+	if userID, ok := t.Extra("user_id").(string); ok && userID != "" {
+		c.UserID = userID
 	}
-	url := conf.AuthCodeURL("state", oauth2.AccessTypeOffline)
-	fmt.Printf("Visit the URL for the auth dialog: %v\n", url)
-	code := <-codeCh
-	ctx := context.Background()
-	_ = srv.Shutdown(ctx)
-	ctx = context.Background()
+	if scope, ok := t.Extra("scope").(string); ok && scope != "" {
+		c.GrantedScopes = strings.Fields(scope)
+	}
+}
 
-	return conf.Exchange(ctx, code)
+func (c *Config) oauth2Config() *oauth2.Config {
+	endpoint := c.Endpoint
+	if endpoint.AuthURL == "" || endpoint.TokenURL == "" {
+		endpoint = fitbit.Endpoint
+	}
+
+	return &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Scopes:       c.Scopes,
+		Endpoint:     endpoint,
+	}
 }
 
-// WriteToFile persists the config to a file.
-func (c *Config) WriteToFile(configFile string) error {
-	b, err := json.Marshal(c)
-	if err != nil {
-		return err
+func (c *Config) revokeURL() string {
+	if c.RevokeURL == "" {
+		return RevokeURL
 	}
-	log.WithField("conf", string(b)).Debug("Conf file")
-	log.WithField("conf-file", configFile).Debug("Writing conf file")
+	return c.RevokeURL
+}
 
-	return ioutil.WriteFile(configFile, b, 0644)
+// WriteToFile persists the config to a file readable only by the current
+// user. The file is replaced atomically, so it is never left half written.
+func (c *Config) WriteToFile(configFile string) error {
+	return NewFileStore(configFile).Save(*c)
 }
@@ -0,0 +1,249 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth2
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const callbackPath = "/auth/fitbit/callback"
+
+var (
+	// ErrLoginRequired is returned when there is no usable token and the
+	// client is not allowed to ask the user to authorize the application.
+	ErrLoginRequired = errors.New("no valid token found, run `auth login` first")
+	// ErrEmptyCode is returned when the authorization response did not
+	// contain a code.
+	ErrEmptyCode = errors.New("empty authorization code")
+	// ErrStateMismatch is returned when the state of the authorization
+	// response is not the one that was sent with the request.
+	ErrStateMismatch = errors.New("state mismatch in the authorization response")
+)
+
+var resultPage = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Fitbit Data Exporter</title></head>
+<body>
+{{if .Err}}<h1>Authorization failed</h1>
+<p>{{.Err}}</p>
+<p>Please restart the login and try again.</p>
+{{else}}<h1>Authorization successful</h1>
+<p>You can close this window and return to the terminal.</p>
+{{end}}</body>
+</html>
+`))
+
+// LoginOptions describes how the user is asked to authorize the application.
+type LoginOptions struct {
+	// BindAddr is the address of the local server that receives the
+	// redirect from Fitbit when not running headless.
+	BindAddr string
+	// Headless disables the local server. The authorization URL is printed
+	// and the redirected URL (or only the code) is read from Input.
+	Headless bool
+	// Input is where the redirected URL is read from in headless mode.
+	// Defaults to os.Stdin.
+	Input io.Reader
+	// Output is where the instructions are printed. Defaults to os.Stdout.
+	Output io.Writer
+}
+
+func (o LoginOptions) input() io.Reader {
+	if o.Input == nil {
+		return os.Stdin
+	}
+	return o.Input
+}
+
+func (o LoginOptions) output() io.Writer {
+	if o.Output == nil {
+		return os.Stdout
+	}
+	return o.Output
+}
+
+// authorize runs the authorization code flow and returns the obtained token.
+func authorize(conf *oauth2.Config, opts LoginOptions) (*oauth2.Token, error) {
+	if conf.ClientID == "" || conf.ClientSecret == "" {
+		return nil, ErrMissingClientInformation
+	}
+	req, err := newAuthRequest()
+	if err != nil {
+		return nil, err
+	}
+	var code string
+	if opts.Headless {
+		code, err = authCodeHeadless(conf, req, opts)
+	} else {
+		code, err = authCode(conf, req, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return conf.Exchange(context.Background(), code,
+		oauth2.SetAuthURLParam("code_verifier", req.verifier))
+}
+
+// authRequest holds the per-login secrets: the state protecting against
+// forged redirects and the PKCE code verifier.
+type authRequest struct {
+	state    string
+	verifier string
+}
+
+func newAuthRequest() (authRequest, error) {
+	state, err := randomString(16)
+	if err != nil {
+		return authRequest{}, fmt.Errorf("failed to generate state: %v", err)
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return authRequest{}, fmt.Errorf("failed to generate code verifier: %v", err)
+	}
+
+	return authRequest{state: state, verifier: verifier}, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// url returns the authorization URL using a S256 PKCE code challenge.
+func (r authRequest) url(conf *oauth2.Config) string {
+	sum := sha256.Sum256([]byte(r.verifier))
+
+	return conf.AuthCodeURL(r.state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+}
+
+// code validates the authorization response and returns its code.
+func (r authRequest) code(values url.Values) (string, error) {
+	if e := values.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %v %v", e, values.Get("error_description"))
+	}
+	if values.Get("state") != r.state {
+		return "", ErrStateMismatch
+	}
+	code := values.Get("code")
+	if code == "" {
+		return "", ErrEmptyCode
+	}
+
+	return code, nil
+}
+
+type authResult struct {
+	code string
+	err  error
+}
+
+func authCode(conf *oauth2.Config, req authRequest, opts LoginOptions) (string, error) {
+	resCh := make(chan authResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		code, err := req.code(r.URL.Query())
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		_ = resultPage.Execute(w, struct{ Err error }{err})
+		select {
+		case resCh <- authResult{code, err}:
+		default:
+		}
+	})
+	srv := http.Server{
+		Addr:    opts.BindAddr,
+		Handler: mux,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	defer func() {
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	fmt.Fprintf(opts.output(), "Visit the URL for the auth dialog: %v\n", req.url(conf))
+	select {
+	case res := <-resCh:
+		return res.code, res.err
+	case err := <-errCh:
+		return "", fmt.Errorf("failed to start the callback server: %v", err)
+	}
+}
+
+func authCodeHeadless(conf *oauth2.Config, req authRequest, opts LoginOptions) (string, error) {
+	out := opts.output()
+	fmt.Fprintf(out, "Visit the URL for the auth dialog: %v\n", req.url(conf))
+	fmt.Fprintf(out, "After authorizing, paste the URL you were redirected to (or only the code): ")
+
+	line, err := bufio.NewReader(opts.input()).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("failed to read the authorization response: %v", err)
+	}
+
+	return parseAuthResponse(req, line)
+}
+
+// parseAuthResponse extracts the authorization code from either the full
+// redirected URL or the bare code. The state can only be verified in the
+// former case.
+func parseAuthResponse(req authRequest, s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "code=") && !strings.Contains(s, "error=") {
+		if s == "" {
+			return "", ErrEmptyCode
+		}
+		return s, nil
+	}
+	query := s
+	if i := strings.Index(s, "?"); i >= 0 {
+		query = s[i+1:]
+	}
+	if i := strings.Index(query, "#"); i >= 0 {
+		query = query[:i]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the redirected URL: %v", err)
+	}
+
+	return req.code(values)
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth2
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+)
+
+// persistingSource is an oauth2.TokenSource that saves the config to the
+// store as soon as the token returned by the wrapped source changes.
+//
+// Fitbit rotates the refresh token on every refresh, so the new one needs to
+// be stored before it is used, otherwise a crash leaves an invalid refresh
+// token behind.
+type persistingSource struct {
+	mu     sync.Mutex
+	base   oauth2.TokenSource
+	config Config
+	store  Store
+}
+
+func newPersistingSource(base oauth2.TokenSource, c Config, store Store) *persistingSource {
+	return &persistingSource{
+		base:   base,
+		config: c,
+		store:  store,
+	}
+}
+
+// Token returns the current token, refreshing and persisting it if needed.
+func (s *persistingSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	if sameToken(t, s.config.Token) {
+		return t, nil
+	}
+	log.WithField("expiry", t.Expiry).Debug("token refreshed")
+	c := s.config
+	c.setToken(t)
+	if err := s.store.Save(c); err != nil {
+		// the token is still valid for this process, so only report it. The
+		// config is not updated, so the save is retried on the next call.
+		log.WithError(err).WithField("store", s.store).Error("failed to persist the refreshed token")
+		return t, nil
+	}
+	s.config = c
+	metrics.TokenRefreshes.Inc()
+
+	return t, nil
+}
+
+// reset replaces the wrapped source and returns its token.
+func (s *persistingSource) reset(base oauth2.TokenSource) (*oauth2.Token, error) {
+	s.mu.Lock()
+	s.base = base
+	s.mu.Unlock()
+
+	return s.Token()
+}
+
+// current returns a copy of the config holding the last seen token.
+func (s *persistingSource) current() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config
+}
+
+// clear removes the token from the store. Any further attempt to get a token
+// fails with ErrLoginRequired.
+func (s *persistingSource) clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.base = errSource{ErrLoginRequired}
+	s.config.Token = nil
+	s.config.UserID = ""
+	s.config.GrantedScopes = nil
+
+	return s.store.Save(s.config)
+}
+
+func (s *persistingSource) persist() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.store.Save(s.config)
+}
+
+func sameToken(a, b *oauth2.Token) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.AccessToken == b.AccessToken && a.RefreshToken == b.RefreshToken && a.Expiry.Equal(b.Expiry)
+}
+
+type errSource struct {
+	err error
+}
+
+func (e errSource) Token() (*oauth2.Token, error) {
+	return nil, e.err
+}
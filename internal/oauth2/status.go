@@ -0,0 +1,160 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth2
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// RevokeURL is the Fitbit endpoint used to revoke tokens.
+const RevokeURL = "https://api.fitbit.com/oauth2/revoke"
+
+// Status describes the stored credentials.
+type Status struct {
+	UserID          string
+	Expiry          time.Time
+	HasToken        bool
+	HasRefreshToken bool
+	// RequestedScopes are the scopes configured for the next login, while
+	// GrantedScopes are the ones the user agreed to.
+	RequestedScopes []string
+	GrantedScopes   []string
+}
+
+// Expired reports whether the access token needs to be refreshed.
+func (s Status) Expired() bool {
+	return !s.HasToken || (!s.Expiry.IsZero() && s.Expiry.Before(time.Now()))
+}
+
+// MissingScopes returns the requested scopes that were not granted. It is
+// empty when the granted scopes are not known, as for tokens stored by older
+// versions.
+func (s Status) MissingScopes() []string {
+	if len(s.GrantedScopes) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool, len(s.GrantedScopes))
+	for _, scope := range s.GrantedScopes {
+		granted[scope] = true
+	}
+	var res []string
+	for _, scope := range s.RequestedScopes {
+		if !granted[scope] {
+			res = append(res, scope)
+		}
+	}
+
+	return res
+}
+
+func (c Config) status() Status {
+	s := Status{
+		UserID:          c.UserID,
+		HasToken:        c.Token != nil && c.Token.AccessToken != "",
+		RequestedScopes: c.Scopes,
+		GrantedScopes:   c.GrantedScopes,
+	}
+	if c.Token != nil {
+		s.Expiry = c.Token.Expiry
+		s.HasRefreshToken = c.Token.RefreshToken != ""
+	}
+
+	return s
+}
+
+// ReadStatus returns the status of the credentials in the store without
+// refreshing them. The requested scopes are the ones the next login would
+// use, given c as for New.
+func ReadStatus(store Store, c Config) (Status, error) {
+	config, err := loadConfig(store, c)
+	if err != nil {
+		return Status{}, err
+	}
+
+	return config.status(), nil
+}
+
+// Status returns the status of the credentials used by the client.
+func (c *Client) Status() Status {
+	return c.source.current().status()
+}
+
+// Refresh exchanges the refresh token for a new token, even if the current
+// one is still valid, and persists it.
+func (c *Client) Refresh() error {
+	cur := c.source.current().Token
+	if cur == nil || cur.RefreshToken == "" {
+		return ErrLoginRequired
+	}
+	// a token without an access token is never valid, forcing a refresh
+	expired := &oauth2.Token{RefreshToken: cur.RefreshToken}
+	_, err := c.source.reset(c.conf.TokenSource(context.Background(), expired))
+
+	return err
+}
+
+// Revoke revokes the refresh token, and with it all access tokens, and
+// removes the token from the store.
+func (c *Client) Revoke() error {
+	conf := c.source.current()
+	if conf.Token == nil {
+		return ErrLoginRequired
+	}
+	token := conf.Token.RefreshToken
+	if token == "" {
+		token = conf.Token.AccessToken
+	}
+	if err := revoke(c.conf, conf.revokeURL(), token); err != nil {
+		return err
+	}
+
+	return c.source.clear()
+}
+
+func revoke(conf *oauth2.Config, revokeURL, token string) error {
+	body := url.Values{"token": {token}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, revokeURL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to revoke the token: %v %s", resp.Status, b)
+	}
+	log.Debug("token revoked")
+
+	return nil
+}
@@ -0,0 +1,338 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrNoConfig is returned by a Store that does not hold a config yet.
+	ErrNoConfig = errors.New("no stored config")
+	// ErrReadOnlyStore is returned when saving to a Store that can not be
+	// written to.
+	ErrReadOnlyStore = errors.New("store is read only")
+	// ErrMissingPassphrase is returned when an encrypted store is created
+	// without a passphrase.
+	ErrMissingPassphrase = errors.New("missing passphrase for the encrypted store")
+	// ErrEncrypted is returned when a plain file store is pointed at an
+	// encrypted file.
+	ErrEncrypted = errors.New("the conf file is encrypted, use the encrypted store")
+)
+
+// Store persists the Config, including the client secret and the token,
+// between runs.
+type Store interface {
+	// Load returns the stored config or ErrNoConfig.
+	Load() (Config, error)
+	// Save replaces the stored config.
+	Save(c Config) error
+	// String describes the store without revealing any secrets.
+	String() string
+}
+
+// NewFileStore returns a Store that keeps the config as plain json in the
+// given file.
+func NewFileStore(fileName string) Store {
+	return &fileStore{fileName}
+}
+
+type fileStore struct {
+	fileName string
+}
+
+func (f *fileStore) Load() (Config, error) {
+	var c Config
+	b, err := readFile(f.fileName)
+	if err != nil {
+		return c, err
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return c, err
+	}
+	if env.Version > 0 {
+		return c, ErrEncrypted
+	}
+
+	return c, json.Unmarshal(b, &c)
+}
+
+func (f *fileStore) Save(c Config) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	log.WithField("conf-file", f.fileName).Debug("Writing conf file")
+
+	return writeFileAtomic(f.fileName, b)
+}
+
+func (f *fileStore) String() string {
+	return "file:" + f.fileName
+}
+
+// readFile returns ErrNoConfig if the file does not exist or is empty.
+func readFile(fileName string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) || (err == nil && len(b) == 0) {
+		return nil, ErrNoConfig
+	}
+
+	return b, err
+}
+
+const (
+	encryptedVersion = 1
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	keyLen           = 32
+	saltLen          = 16
+)
+
+// envelope is the on-disk format of the encrypted store.
+type envelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// NewEncryptedFileStore returns a Store that keeps the config in the given
+// file encrypted with AES-256-GCM, using a key derived from the passphrase
+// with scrypt.
+//
+// A plain json file is accepted when loading, so an existing file store can
+// be migrated by switching to the encrypted one: the file is encrypted the
+// next time the token is saved.
+func NewEncryptedFileStore(fileName, passphrase string) (Store, error) {
+	if passphrase == "" {
+		return nil, ErrMissingPassphrase
+	}
+
+	return &encryptedFileStore{fileName: fileName, passphrase: []byte(passphrase)}, nil
+}
+
+type encryptedFileStore struct {
+	fileName   string
+	passphrase []byte
+}
+
+func (e *encryptedFileStore) Load() (Config, error) {
+	var c Config
+	b, err := readFile(e.fileName)
+	if err != nil {
+		return c, err
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return c, err
+	}
+	if env.Version == 0 {
+		log.WithField("conf-file", e.fileName).Warn("conf file is not encrypted, it will be encrypted on the next save")
+		return c, json.Unmarshal(b, &c)
+	}
+	if env.Version != encryptedVersion || env.KDF != "scrypt" {
+		return c, fmt.Errorf("unsupported encrypted conf file version %d (%v)", env.Version, env.KDF)
+	}
+	gcm, err := e.cipher(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return c, err
+	}
+	plain, err := gcm.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return c, errors.New("failed to decrypt the conf file, wrong passphrase?")
+	}
+
+	return c, json.Unmarshal(plain, &c)
+}
+
+func (e *encryptedFileStore) Save(c Config) error {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	env := envelope{
+		Version: encryptedVersion,
+		KDF:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, saltLen),
+	}
+	if _, err := rand.Read(env.Salt); err != nil {
+		return err
+	}
+	gcm, err := e.cipher(env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return err
+	}
+	env.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return err
+	}
+	env.Ciphertext = gcm.Seal(nil, env.Nonce, plain, nil)
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	log.WithField("conf-file", e.fileName).Debug("Writing encrypted conf file")
+
+	return writeFileAtomic(e.fileName, b)
+}
+
+func (e *encryptedFileStore) cipher(salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(e.passphrase, salt, n, r, p, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (e *encryptedFileStore) String() string {
+	return "encrypted:" + e.fileName
+}
+
+// NewEnvStore returns a Store that reads the initial config from the json in
+// the value (typically an environment variable) or, if it is empty, from
+// secretFile (typically a docker secret).
+//
+// As Fitbit rotates the refresh token, the refreshed config is saved to
+// state, which takes precedence over the initial config once it exists. If
+// state is nil, the store is read only and creating a client with it fails,
+// as the stored refresh token is invalid after the first refresh.
+func NewEnvStore(value, secretFile string, state Store) Store {
+	return &envStore{value: value, secretFile: secretFile, state: state}
+}
+
+type envStore struct {
+	value      string
+	secretFile string
+	state      Store
+}
+
+func (e *envStore) Load() (Config, error) {
+	if e.state != nil {
+		c, err := e.state.Load()
+		if err != ErrNoConfig {
+			return c, err
+		}
+	}
+	var c Config
+	b := []byte(strings.TrimSpace(e.value))
+	if len(b) == 0 && e.secretFile != "" {
+		var err error
+		if b, err = readFile(e.secretFile); err != nil {
+			return c, err
+		}
+	}
+	if len(b) == 0 {
+		return c, ErrNoConfig
+	}
+
+	return c, json.Unmarshal(b, &c)
+}
+
+func (e *envStore) Save(c Config) error {
+	if e.state == nil {
+		return ErrReadOnlyStore
+	}
+
+	return e.state.Save(c)
+}
+
+func (e *envStore) String() string {
+	if e.state == nil {
+		return "env"
+	}
+	return "env+" + e.state.String()
+}
+
+func writeFileAtomic(fileName string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer func() {
+		// no-op when the rename succeeded
+		_ = os.Remove(tmpName)
+	}()
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		// renaming over a file that is bind mounted in a container fails,
+		// so fall back to rewriting it in place
+		log.WithError(err).WithField("file", fileName).Warn("atomic replace failed, rewriting in place")
+		return writeFileInPlace(fileName, b)
+	}
+
+	return nil
+}
+
+func writeFileInPlace(fileName string, b []byte) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
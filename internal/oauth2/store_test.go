@@ -0,0 +1,287 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fde-oauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+func testConfig(refresh string) Config {
+	return Config{
+		Token: &oauth2.Token{
+			AccessToken:  "access",
+			TokenType:    "Bearer",
+			RefreshToken: refresh,
+			Expiry:       time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		Scopes:        []string{"heartrate"},
+		UserID:        "user",
+		GrantedScopes: []string{"heartrate"},
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		plain      bool   // the file is first written by a plain file store
+		passphrase string // used to load the file, saved with "right"
+		wantErr    string
+	}{
+		{name: "round trip", passphrase: "right"},
+		{name: "wrong passphrase", passphrase: "wrong", wantErr: "wrong passphrase"},
+		{name: "plain file migration", plain: true, passphrase: "right"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			fileName := filepath.Join(dir, "conf.json")
+			want := testConfig("refresh")
+
+			store, err := NewEncryptedFileStore(fileName, "right")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.plain {
+				err = NewFileStore(fileName).Save(want)
+			} else {
+				err = store.Save(want)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.plain {
+				b, err := ioutil.ReadFile(fileName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(b), "secret") || strings.Contains(string(b), "refresh") {
+					t.Fatalf("encrypted file contains secrets: %s", b)
+				}
+			}
+
+			loader, err := NewEncryptedFileStore(fileName, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := loader.Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Load() = %+v, want %+v", got, want)
+			}
+
+			if tt.plain {
+				// the next save encrypts the migrated file
+				if err := loader.Save(got); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := NewFileStore(fileName).Load(); err != ErrEncrypted {
+					t.Fatalf("plain Load() of migrated file error = %v, want %v", err, ErrEncrypted)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptedFileStoreMissingPassphrase(t *testing.T) {
+	if _, err := NewEncryptedFileStore("conf.json", ""); err != ErrMissingPassphrase {
+		t.Fatalf("NewEncryptedFileStore() error = %v, want %v", err, ErrMissingPassphrase)
+	}
+}
+
+func TestEnvStore(t *testing.T) {
+	initial := testConfig("initial")
+	b, err := jsonString(initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		secret      string // content of the secret file, if any
+		withState   bool
+		stateConfig *Config // saved to the state store before loading
+		wantRefresh string
+		wantLoadErr error
+		wantSaveErr error
+	}{
+		{name: "value", value: b, wantRefresh: "initial", wantSaveErr: ErrReadOnlyStore},
+		{name: "secret file", secret: b, wantRefresh: "initial", wantSaveErr: ErrReadOnlyStore},
+		{name: "nothing", wantLoadErr: ErrNoConfig, wantSaveErr: ErrReadOnlyStore},
+		{name: "empty state", value: b, withState: true, wantRefresh: "initial"},
+		{
+			name:        "state takes precedence",
+			value:       b,
+			withState:   true,
+			stateConfig: configPtr(testConfig("rotated")),
+			wantRefresh: "rotated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			secretFile := filepath.Join(dir, "secret")
+			if tt.secret != "" {
+				if err := ioutil.WriteFile(secretFile, []byte(tt.secret), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var state Store
+			if tt.withState {
+				state = NewFileStore(filepath.Join(dir, "state.json"))
+				if tt.stateConfig != nil {
+					if err := state.Save(*tt.stateConfig); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			store := NewEnvStore(tt.value, secretFile, state)
+
+			got, err := store.Load()
+			if err != tt.wantLoadErr {
+				t.Fatalf("Load() error = %v, want %v", err, tt.wantLoadErr)
+			}
+			if err == nil && got.Token.RefreshToken != tt.wantRefresh {
+				t.Fatalf("Load() refresh token = %q, want %q", got.Token.RefreshToken, tt.wantRefresh)
+			}
+
+			saved := testConfig("saved")
+			if err := store.Save(saved); err != tt.wantSaveErr {
+				t.Fatalf("Save() error = %v, want %v", err, tt.wantSaveErr)
+			}
+			if tt.wantSaveErr != nil {
+				return
+			}
+			got, err = store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Token.RefreshToken != "saved" {
+				t.Fatalf("Load() after Save() refresh token = %q, want %q", got.Token.RefreshToken, "saved")
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing os.FileMode // 0 when the file does not exist
+	}{
+		{name: "new file"},
+		{name: "replaces private file", existing: 0600},
+		{name: "replaces world readable file", existing: 0644},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			fileName := filepath.Join(dir, "conf.json")
+			if tt.existing != 0 {
+				if err := ioutil.WriteFile(fileName, []byte("old"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(fileName, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := writeFileAtomic(fileName, []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Fatalf("permissions = %v, want %v", perm, os.FileMode(0600))
+			}
+			b, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "new" {
+				t.Fatalf("content = %q, want %q", b, "new")
+			}
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("%d files left in the directory, want 1", len(files))
+			}
+		})
+	}
+}
+
+func TestFileStoreRejectsEncryptedFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fileName := filepath.Join(dir, "conf.json")
+	store, err := NewEncryptedFileStore(fileName, "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(testConfig("refresh")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileStore(fileName).Load(); err != ErrEncrypted {
+		t.Fatalf("Load() error = %v, want %v", err, ErrEncrypted)
+	}
+}
+
+func configPtr(c Config) *Config {
+	return &c
+}
+
+func jsonString(c Config) (string, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// activityPageSize is the number of activities of a page of the list, the
+// most allowed by the API.
+const activityPageSize = 100
+
+// activityReader reads the logged activities or, if trackpoints is set, the
+// trackpoints of their TCX files.
+type activityReader struct {
+	*seriesReader
+	trackpoints bool
+}
+
+// ReadSeries TODO.
+func (r *activityReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	return r.ReadSeriesRange(t, t.AddDate(0, 0, 1))
+}
+
+// ReadSeriesRange TODO.
+func (r *activityReader) ReadSeriesRange(from, to time.Time) ([]model.Reading, error) {
+	logs, err := r.activities(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var res []model.Reading
+	for _, a := range logs {
+		if !r.trackpoints {
+			d, err := a.Reading(from.Location())
+			if err != nil {
+				return nil, fmt.Errorf("invalid activity %v: %v", a.LogID, err)
+			}
+			res = append(res, d)
+			continue
+		}
+		// the activities without a GPS track have no TCX
+		if a.TCXLink == "" {
+			continue
+		}
+		var tcx model.TCX
+		if err := r.getAs(fmt.Sprintf("%v/activities/%d.tcx", r.baseURL, a.LogID), &tcx, xml.Unmarshal); err != nil {
+			return nil, err
+		}
+		d, err := tcx.Readings(a.LogID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TCX of the activity %v: %v", a.LogID, err)
+		}
+		res = append(res, d...)
+	}
+
+	return res, nil
+}
+
+// activities returns the activities that started in [from, to), going
+// through the pages of the list of the activities after from.
+func (r *activityReader) activities(from, to time.Time) ([]model.ActivityLog, error) {
+	var res []model.ActivityLog
+	// the activities strictly after the date and time are listed
+	after := from.Add(-time.Second).Format("2006-01-02T15:04:05")
+	for offset := 0; ; offset += activityPageSize {
+		q := url.Values{}
+		q.Set("afterDate", after)
+		q.Set("sort", "asc")
+		q.Set("offset", fmt.Sprint(offset))
+		q.Set("limit", fmt.Sprint(activityPageSize))
+		var page model.ActivityListAPIData
+		if err := r.get(r.baseURL+"/activities/list.json?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, a := range page.Activities {
+			start, err := a.Start(from.Location())
+			if err != nil {
+				return nil, fmt.Errorf("invalid activity %v: %v", a.LogID, err)
+			}
+			if !start.Before(to) {
+				return res, nil
+			}
+			if !start.Before(from) {
+				res = append(res, a)
+			}
+		}
+		if page.Pagination.Next == "" || len(page.Activities) == 0 {
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// NewDeviceReader creates a new source.DeviceSource that reads the devices
+// from the Fitbit web API, rooted at apiURL (see URL), whose times are in loc,
+// the time zone of the user's profile. It needs the settings scope.
+func NewDeviceReader(client *oauth2.Client, apiURL string, loc *time.Location) source.DeviceSource {
+	return &deviceReader{
+		reader: reader{
+			client:       client,
+			baseURL:      apiURL,
+			maxRateLimit: maxRateLimitWait,
+			done:         make(chan struct{}),
+		},
+		loc: loc,
+	}
+}
+
+type deviceReader struct {
+	reader
+	loc *time.Location
+}
+
+// ReadDevices TODO.
+func (r *deviceReader) ReadDevices() ([]model.Device, error) {
+	var data model.DevicesAPIData
+	if err := r.get(r.baseURL+"/devices.json", &data); err != nil {
+		return nil, err
+	}
+
+	return data.Devices(r.loc)
+}
@@ -0,0 +1,351 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// Endpoint is a json endpoint read as a series, which is configured rather
+// than coded, see LoadEndpoints. The paths are JSONPath-style expressions,
+// ex. $['activities-heart'][0].value.
+type Endpoint struct {
+	// Name is the name of the series, also the one of its table or
+	// measurement.
+	Name string `json:"name"`
+	// URL is the url of the readings of a day, relative to the root of the
+	// resources of the user unless absolute. {date} is replaced by the day
+	// (yyyy-mm-dd), {end_date} by the next one, {year}, {month} and {day}
+	// by the parts of the day and {unix} and {end_unix} by the unix times
+	// of the start and the end of the day. The token of the user is sent
+	// along, so the host must be trusted.
+	URL string `json:"url"`
+	// Items is the path of the readings in the response, the whole
+	// response being a reading if empty.
+	Items string `json:"items"`
+	// Time is the path of the time of a reading, which is at the start of
+	// the day if empty.
+	Time string `json:"time"`
+	// TimeLayout is the layout of the times, see time.Parse, or unix or
+	// unix_ms for the numbers of seconds or milliseconds. By default, the
+	// times are in one of the layouts of the API or numbers of seconds.
+	// The times without a zone are wall clock times in the time zone of
+	// the user and those without a date are on the day read.
+	TimeLayout string `json:"time_layout"`
+	// Values are the paths of the fields of the readings by name. The
+	// readings without values are skipped.
+	Values map[string]string `json:"values"`
+	// Tags are the paths of the tags of the readings by name.
+	Tags map[string]string `json:"tags"`
+	// Key is the tag that tells apart the readings at the same time, see
+	// model.Series.
+	Key string `json:"key"`
+	// Scope is the OAuth2 scope needed to read the endpoint, if it is a
+	// Fitbit one.
+	Scope string `json:"scope"`
+}
+
+// LoadEndpoints reads a json file holding a list of endpoints, none if
+// fileName is empty.
+func LoadEndpoints(fileName string) ([]Endpoint, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var res []Endpoint
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("invalid endpoints in %v: %v", fileName, err)
+	}
+
+	return res, nil
+}
+
+// Series returns the series of the readings of the endpoint, whose fields
+// and tags are sorted by name.
+func (e Endpoint) Series() model.Series {
+	return model.Series{
+		Name:   e.Name,
+		Fields: sortedKeys(e.Values),
+		Scope:  e.Scope,
+		Daily:  e.Time == "",
+		Tags:   sortedKeys(e.Tags),
+		Key:    e.Key,
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	var res []string
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// identifier matches the names of the series, the fields and the tags, which
+// are the ones of tables and columns.
+var identifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// reservedNames are the names of the other series and the tables of the
+// storages.
+var reservedNames = []string{
+	model.DeviceSeries.Name, model.Record.Name, model.Steps.Name, model.RestingHeartRate.Name, model.SleepStage.Name,
+	"heart_reading", "food_nutrient", "gorp_migrations",
+}
+
+// validate checks that the names of the endpoint can be stored.
+func (e Endpoint) validate() error {
+	_, known := model.AllSeries[e.Name]
+	for _, name := range reservedNames {
+		known = known || e.Name == name
+	}
+	if !identifier.MatchString(e.Name) || known {
+		return fmt.Errorf("invalid series name %q, expected a new lower case identifier", e.Name)
+	}
+	if e.URL == "" || len(e.Values) == 0 {
+		return fmt.Errorf("the endpoint %v has no url or values", e.Name)
+	}
+	names := make(map[string]bool)
+	for _, name := range append(sortedKeys(e.Values), sortedKeys(e.Tags)...) {
+		if !identifier.MatchString(name) || name == "id" || name == "username" || name == "time" || names[name] {
+			return fmt.Errorf("invalid field or tag name %q of %v", name, e.Name)
+		}
+		names[name] = true
+	}
+	if _, ok := e.Tags[e.Key]; e.Key != "" && !ok {
+		return fmt.Errorf("the key %q of %v is not a tag", e.Key, e.Name)
+	}
+
+	return nil
+}
+
+// NewEndpointReader creates a new source.SeriesSource that reads the series
+// of the endpoint, rooted at apiURL (see URL) if relative, day by day.
+func NewEndpointReader(client *oauth2.Client, apiURL string, e Endpoint) (source.SeriesSource, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	r := &endpointReader{
+		seriesReader: &seriesReader{
+			reader: reader{
+				client:       client,
+				baseURL:      apiURL,
+				maxRateLimit: maxRateLimitWait,
+				done:         make(chan struct{}),
+			},
+			series: e.Series(),
+		},
+		endpoint: e,
+		values:   make(map[string]jsonPath),
+		tags:     make(map[string]jsonPath),
+	}
+	var err error
+	if r.items, err = parseJSONPath(e.Items); err != nil {
+		return nil, err
+	}
+	// the items are selected in the document
+	r.items.root = true
+	if r.time, err = parseJSONPath(e.Time); err != nil {
+		return nil, err
+	}
+	for name, s := range e.Values {
+		if r.values[name], err = parseJSONPath(s); err != nil {
+			return nil, err
+		}
+	}
+	for name, s := range e.Tags {
+		if r.tags[name], err = parseJSONPath(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+type endpointReader struct {
+	*seriesReader
+	endpoint Endpoint
+	items    jsonPath
+	time     jsonPath
+	values   map[string]jsonPath
+	tags     map[string]jsonPath
+}
+
+// ReadSeries TODO.
+func (r *endpointReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	var doc interface{}
+	if err := r.getAs(r.url(t), &doc, unmarshalNumbers); err != nil {
+		return nil, err
+	}
+	var res []model.Reading
+	for _, item := range r.items.eval(doc, doc) {
+		ts := t
+		if r.endpoint.Time != "" {
+			var err error
+			if ts, err = r.parseTime(r.time.first(doc, item), t); err != nil {
+				return nil, fmt.Errorf("invalid time of %v: %v", r.endpoint.Name, err)
+			}
+		}
+		d := model.Reading{Time: ts.UTC(), Values: make(map[string]float64)}
+		for name, p := range r.values {
+			v, ok, err := toFloat(p.first(doc, item))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v of %v: %v", name, r.endpoint.Name, err)
+			}
+			if ok {
+				d.Values[name] = v
+			}
+		}
+		if len(d.Values) == 0 {
+			continue
+		}
+		for name, p := range r.tags {
+			if v := p.first(doc, item); v != nil {
+				if d.Tags == nil {
+					d.Tags = make(map[string]string)
+				}
+				d.Tags[name] = fmt.Sprint(v)
+			}
+		}
+		res = append(res, d)
+	}
+
+	return res, nil
+}
+
+// url returns the url of the day starting at t.
+func (r *endpointReader) url(t time.Time) string {
+	end := t.AddDate(0, 0, 1)
+	res := strings.NewReplacer(
+		"{date}", t.Format("2006-01-02"),
+		"{end_date}", end.Format("2006-01-02"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{unix}", strconv.FormatInt(t.Unix(), 10),
+		"{end_unix}", strconv.FormatInt(end.Unix(), 10),
+	).Replace(r.endpoint.URL)
+	if strings.HasPrefix(res, "http://") || strings.HasPrefix(res, "https://") {
+		return res
+	}
+
+	return r.baseURL + "/" + strings.TrimPrefix(res, "/")
+}
+
+// timesOfDay are the layouts of the times without a date.
+var timesOfDay = []string{"15:04:05", "15:04"}
+
+// parseTime parses the time of a reading of the day starting at t.
+func (r *endpointReader) parseTime(v interface{}, t time.Time) (time.Time, error) {
+	layout := r.endpoint.TimeLayout
+	n, isNumber := v.(json.Number)
+	s, isString := v.(string)
+	switch {
+	case layout == "unix" || layout == "unix_ms" || (layout == "" && isNumber):
+		if isString {
+			n, isNumber = json.Number(s), true
+		}
+		f, err := n.Float64()
+		if !isNumber || err != nil {
+			return time.Time{}, fmt.Errorf("invalid unix time %v", v)
+		}
+		if layout == "unix_ms" {
+			f /= 1000
+		}
+		sec, frac := math.Modf(f)
+
+		return time.Unix(int64(sec), int64(frac*1e9)).In(t.Location()), nil
+	case !isString:
+		return time.Time{}, fmt.Errorf("invalid time %v", v)
+	case layout != "":
+		ts, err := time.ParseInLocation(layout, s, t.Location())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ts.Year() == 0 {
+			return onDay(t, ts), nil
+		}
+
+		return ts, nil
+	}
+	if ts, err := model.ParseLocalTime(s, t.Location()); err == nil {
+		return ts, nil
+	}
+	for _, l := range timesOfDay {
+		if ts, err := time.Parse(l, s); err == nil {
+			return onDay(t, ts), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// onDay returns the wall clock time of ts on the day of t.
+func onDay(t, ts time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), ts.Hour(), ts.Minute(), ts.Second(), ts.Nanosecond(), t.Location())
+}
+
+// toFloat converts a value, false if it is missing.
+func toFloat(v interface{}) (float64, bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, false, nil
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil, err
+	case bool:
+		if v {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case string:
+		if v == "" {
+			return 0, false, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil, err
+	default:
+		return 0, false, fmt.Errorf("not a number: %v", v)
+	}
+}
+
+// unmarshalNumbers decodes json keeping the numbers as json.Number, so that
+// the ids are not rounded.
+func unmarshalNumbers(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	return d.Decode(v)
+}
@@ -19,57 +19,191 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
 	"github.com/ivajloip/fitbit-data-exporter/internal/model"
 	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
 	"github.com/ivajloip/fitbit-data-exporter/internal/source"
 	log "github.com/sirupsen/logrus"
 )
 
-// New creates a new source.Source that is backed by a folder with json files
-// representing readings for different days.
+const (
+	rateLimitRemainingHeader = "Fitbit-Rate-Limit-Remaining"
+	rateLimitResetHeader     = "Fitbit-Rate-Limit-Reset"
+	// maxRateLimitWait is the longest the reader waits for the rate limit
+	// to be reset before giving up. Fitbit resets it at the start of every
+	// hour.
+	maxRateLimitWait = time.Hour
+	// defaultRateLimitWait is used when the response does not tell when
+	// the rate limit is reset.
+	defaultRateLimitWait = time.Minute
+)
+
+// ErrClosed is returned when the source is closed while waiting for the
+// rate limit to be reset.
+var ErrClosed = errors.New("source closed")
+
+// RateLimitError is returned when the Fitbit API rate limit is exceeded.
+type RateLimitError struct {
+	// Reset is the time until the rate limit is reset.
+	Reset time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, reset in %v", e.Reset)
+}
+
+// StatusError is returned when the API responds with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d: %v", e.StatusCode, e.Body)
+}
+
+// New creates a new source.Source that reads the intraday heart rate from
+// the Fitbit web API.
 //
-// The files in the folder should be named heart_rate-yyyy-mm-dd.json.
+// baseURL is the url of the heart rate endpoint, the date and the precision
+// are appended to it.
 func New(client *oauth2.Client, baseURL, precision string) (source.Source, error) {
-	return &reader{
-		client:    client,
-		baseURL:   baseURL,
-		precision: precision,
-	}, nil
+	return &heartReader{reader{
+		client:       client,
+		baseURL:      baseURL,
+		precision:    precision,
+		maxRateLimit: maxRateLimitWait,
+		done:         make(chan struct{}),
+	}}, nil
+}
+
+// heartReader is the heart rate source, which owns the client shared with
+// the other readers.
+type heartReader struct {
+	reader
+}
+
+func (r *heartReader) Close() error {
+	_ = r.reader.Close()
+
+	return r.client.Close()
 }
 
 type reader struct {
-	client    *oauth2.Client
-	baseURL   string
-	precision string
+	client       *oauth2.Client
+	baseURL      string
+	precision    string
+	maxRateLimit time.Duration
+	done         chan struct{}
+	closeOnce    sync.Once
 }
 
 // ReadData TODO.
 func (r *reader) ReadData(t time.Time) ([]model.HeartData, error) {
 	url := fmt.Sprintf("%v/%d-%0.2d-%0.2d/1d/%v/time/00:00/23:59.json", r.baseURL, t.Year(), t.Month(), t.Day(), r.precision)
 
+	var res model.HeartAPIData
+	if err := r.get(url, &res); err != nil {
+		return nil, err
+	}
+	d := model.ToHeartData(res, t)
+	log.Debugf("body: %v", d)
+
+	return d, nil
+}
+
+// get reads the json response of the url into v. When the rate limit is
+// exceeded, it waits for it to be reset and retries, unless the reader is
+// closed in the meantime.
+func (r *reader) get(url string, v interface{}) error {
+	return r.getAs(url, v, json.Unmarshal)
+}
+
+// getAs is get for a response decoded by unmarshal.
+func (r *reader) getAs(url string, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	for {
+		err := r.getOnce(url, v, unmarshal)
+		rlErr, ok := err.(*RateLimitError)
+		if !ok {
+			return err
+		}
+		if rlErr.Reset > r.maxRateLimit {
+			return err
+		}
+		log.WithField("reset", rlErr.Reset).Warn("rate limit exceeded, waiting for it to be reset")
+		if rlErr.Reset < time.Second {
+			rlErr.Reset = time.Second
+		}
+		timer := time.NewTimer(rlErr.Reset)
+		select {
+		case <-timer.C:
+		case <-r.done:
+			timer.Stop()
+			return ErrClosed
+		}
+	}
+}
+
+func (r *reader) getOnce(url string, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	start := time.Now()
 	response, err := r.client.Get(url)
+	metrics.APIRequestDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Fatalf("get reading failed: %v", err)
+		metrics.APIRequests.WithLabelValues("error").Inc()
+		return fmt.Errorf("get reading failed: %v", err)
 	}
+	metrics.APIRequests.WithLabelValues(strconv.Itoa(response.StatusCode)).Inc()
+	if remaining, err := strconv.Atoi(response.Header.Get(rateLimitRemainingHeader)); err == nil {
+		metrics.RateLimitRemaining.Set(float64(remaining))
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
 	b, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	log.WithFields(log.Fields{
+		"status":    response.StatusCode,
+		"remaining": response.Header.Get(rateLimitRemainingHeader),
+	}).Debug("api response")
 
-	var res model.HeartAPIData
-	if err := json.Unmarshal(b, &res); err != nil {
-		return nil, err
+	switch response.StatusCode {
+	case http.StatusOK:
+		return unmarshal(b, v)
+	case http.StatusTooManyRequests:
+		return &RateLimitError{Reset: rateLimitReset(response)}
+	default:
+		return &StatusError{StatusCode: response.StatusCode, Body: string(b)}
 	}
-	d := model.ToHeartData(res, t)
-	log.Debugf("body: %v", d)
+}
 
-	return d, nil
+// rateLimitReset returns the time until the rate limit is reset, according
+// to the Fitbit or the standard Retry-After header.
+func rateLimitReset(response *http.Response) time.Duration {
+	for _, h := range []string{rateLimitResetHeader, "Retry-After"} {
+		if s, err := strconv.Atoi(response.Header.Get(h)); err == nil && s >= 0 {
+			return time.Duration(s) * time.Second
+		}
+	}
+
+	return defaultRateLimitWait
 }
 
+// Close stops waiting for the rate limit, but does not close the client,
+// which is shared with the heart rate source.
 func (r *reader) Close() error {
-	return r.client.Close()
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	return nil
 }
@@ -0,0 +1,145 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a JSONPath-style expression selecting values in a json
+// document decoded in interface{}, ex. $['activities-heart'][0].value: the
+// members of the objects by name, after a dot or quoted in brackets, the
+// elements of the arrays by index and all of them with *. The paths starting
+// with $ are rooted at the document, the others, which may start with @, at
+// the current item.
+type jsonPath struct {
+	root  bool
+	steps []pathStep
+}
+
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func parseJSONPath(s string) (jsonPath, error) {
+	var res jsonPath
+	rest := strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(rest, "$"):
+		res.root = true
+		rest = rest[1:]
+	case strings.HasPrefix(rest, "@"):
+		rest = rest[1:]
+	case rest != "" && rest[0] != '.' && rest[0] != '[':
+		// a relative path starting with a name
+		rest = "." + rest
+	}
+	for rest != "" {
+		var step pathStep
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.name, rest = rest[:end], rest[end:]
+			if step.name == "" {
+				return res, fmt.Errorf("invalid path %q: empty name", s)
+			}
+			step.wildcard = step.name == "*"
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return res, fmt.Errorf("invalid path %q: missing ]", s)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.name = inner[1 : len(inner)-1]
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return res, fmt.Errorf("invalid path %q: invalid index %q", s, inner)
+				}
+				step.index, step.isIndex = i, true
+			}
+		default:
+			return res, fmt.Errorf("invalid path %q: unexpected %q", s, rest[0])
+		}
+		res.steps = append(res.steps, step)
+	}
+
+	return res, nil
+}
+
+// eval returns the values selected in the document root, from the item
+// unless the path is rooted, skipping the missing ones.
+func (p jsonPath) eval(root, item interface{}) []interface{} {
+	values := []interface{}{item}
+	if p.root {
+		values[0] = root
+	}
+	for _, step := range p.steps {
+		var next []interface{}
+		for _, v := range values {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					keys := make([]string, 0, len(v))
+					for k := range v {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						next = append(next, v[k])
+					}
+				} else if m, ok := v[step.name]; ok && !step.isIndex {
+					next = append(next, m)
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, v...)
+				} else if step.isIndex && step.index < len(v) {
+					next = append(next, v[step.index])
+				}
+			}
+		}
+		values = next
+	}
+
+	return values
+}
+
+// first returns the first value selected, nil if none.
+func (p jsonPath) first(root, item interface{}) interface{} {
+	if values := p.eval(root, item); len(values) > 0 {
+		return values[0]
+	}
+
+	return nil
+}
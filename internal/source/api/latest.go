@@ -0,0 +1,78 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// URL is the root of the Fitbit web API resources of the current user.
+const URL = "https://api.fitbit.com/1/user/-"
+
+// NewLatestReader creates a new source.LatestReader that reads the latest
+// heart rate, resting heart rate and steps from the Fitbit web API, rooted at
+// apiURL. It requires the heartrate and activity scopes.
+func NewLatestReader(client *oauth2.Client, apiURL string) source.LatestReader {
+	return &latestReader{reader{
+		client:       client,
+		baseURL:      apiURL,
+		maxRateLimit: maxRateLimitWait,
+		done:         make(chan struct{}),
+	}}
+}
+
+type latestReader struct {
+	reader
+}
+
+// ReadLatest TODO.
+func (r *latestReader) ReadLatest(day time.Time) (model.Latest, error) {
+	var res model.Latest
+	date := day.Format("2006-01-02")
+
+	var heart model.HeartAPIData
+	if err := r.get(fmt.Sprintf("%v/activities/heart/date/%v/1d/1min/time/00:00/23:59.json", r.baseURL, date), &heart); err != nil {
+		return res, err
+	}
+	if data := model.ToHeartData(heart, day); len(data) > 0 {
+		res.HeartRate = &data[len(data)-1]
+	}
+	if len(heart.ActivitiesHeart) > 0 {
+		res.RestingHeartRate = heart.ActivitiesHeart[0].Value.RestingHeartRate
+	}
+
+	var steps model.StepsAPIData
+	if err := r.get(fmt.Sprintf("%v/activities/steps/date/%v/1d.json", r.baseURL, date), &steps); err != nil {
+		return res, err
+	}
+	if len(steps.ActivitiesSteps) > 0 {
+		n, err := strconv.Atoi(steps.ActivitiesSteps[0].Value)
+		if err != nil {
+			return res, fmt.Errorf("invalid steps %q: %v", steps.ActivitiesSteps[0].Value, err)
+		}
+		res.Steps = n
+	}
+
+	return res, nil
+}
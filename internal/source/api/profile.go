@@ -0,0 +1,49 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+)
+
+type profile struct {
+	User struct {
+		Timezone string `json:"timezone"`
+	} `json:"user"`
+}
+
+// ProfileLocation returns the time zone of the user's Fitbit profile, read
+// from the Fitbit web API rooted at apiURL (see URL), in which the API reports
+// the time of the readings. It requires the profile scope.
+func ProfileLocation(client *oauth2.Client, apiURL string) (*time.Location, error) {
+	r := &reader{client: client, maxRateLimit: maxRateLimitWait, done: make(chan struct{})}
+	var p profile
+	if err := r.getOnce(apiURL+"/profile.json", &p, json.Unmarshal); err != nil {
+		return nil, fmt.Errorf("failed to read the profile: %v", err)
+	}
+	if p.User.Timezone == "" {
+		return nil, errors.New("the profile has no time zone")
+	}
+
+	return time.LoadLocation(p.User.Timezone)
+}
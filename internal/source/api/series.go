@@ -0,0 +1,160 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/oauth2"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// seriesEndpoint is the resource of a series, relative to the root of the
+// resources of the user, and the type of its response.
+type seriesEndpoint struct {
+	path    string
+	newData func() model.SeriesAPIData
+}
+
+var seriesEndpoints = map[string]seriesEndpoint{
+	model.SpO2.Name: {"spo2/date/%v.json", func() model.SeriesAPIData {
+		return &model.SpO2APIData{}
+	}},
+	model.SpO2Intraday.Name: {"spo2/date/%v/all.json", func() model.SeriesAPIData {
+		return &model.SpO2IntradayAPIData{}
+	}},
+	model.HRV.Name: {"hrv/date/%v.json", func() model.SeriesAPIData {
+		return &model.HRVAPIData{}
+	}},
+	model.HRVIntraday.Name: {"hrv/date/%v/all.json", func() model.SeriesAPIData {
+		return &model.HRVIntradayAPIData{}
+	}},
+	model.BreathingRate.Name: {"br/date/%v/all.json", func() model.SeriesAPIData {
+		return &model.BreathingRateAPIData{}
+	}},
+	model.SkinTemperature.Name: {"temp/skin/date/%v.json", func() model.SeriesAPIData {
+		return &model.SkinTemperatureAPIData{}
+	}},
+	model.ActiveZoneMinutes.Name: {"activities/active-zone-minutes/date/%v/1d/1min.json", func() model.SeriesAPIData {
+		return &model.ActiveZoneMinutesAPIData{}
+	}},
+	model.VO2Max.Name: {"cardioscore/date/%v.json", func() model.SeriesAPIData {
+		return &model.VO2MaxAPIData{}
+	}},
+	model.Food.Name: {"foods/log/date/%v.json", func() model.SeriesAPIData {
+		return &model.FoodAPIData{}
+	}},
+	model.Water.Name: {"foods/log/water/date/%v.json", func() model.SeriesAPIData {
+		return &model.WaterAPIData{}
+	}},
+}
+
+// rangeEndpoint are the resources of an events series, with the first and the
+// last day of a range, and the type of their responses, which are decoded in
+// the same value.
+type rangeEndpoint struct {
+	paths   []string
+	newData func() model.RangeAPIData
+}
+
+var rangeEndpoints = map[string]rangeEndpoint{
+	model.Weight.Name: {[]string{"body/log/weight/date/%v/%v.json", "body/log/fat/date/%v/%v.json"}, func() model.RangeAPIData {
+		return &model.WeightAPIData{}
+	}},
+}
+
+// NewSeriesReader creates a new source.SeriesSource that reads the series
+// from the Fitbit web API, rooted at apiURL (see URL). The scope of the
+// series must have been granted.
+//
+// The readers of the events series implement source.SeriesRangeSource.
+func NewSeriesReader(client *oauth2.Client, apiURL string, series model.Series) (source.SeriesSource, error) {
+	r := &seriesReader{
+		reader: reader{
+			client:       client,
+			baseURL:      apiURL,
+			maxRateLimit: maxRateLimitWait,
+			done:         make(chan struct{}),
+		},
+		series: series,
+	}
+	switch series.Name {
+	case model.Activity.Name:
+		return &activityReader{seriesReader: r}, nil
+	case model.ActivityTrackpoint.Name:
+		return &activityReader{seriesReader: r, trackpoints: true}, nil
+	}
+	if endpoint, ok := rangeEndpoints[series.Name]; ok {
+		return &rangeSeriesReader{seriesReader: r, endpoint: endpoint}, nil
+	}
+	endpoint, ok := seriesEndpoints[series.Name]
+	if !ok {
+		return nil, fmt.Errorf("the series %v can not be read from the api", series.Name)
+	}
+	r.endpoint = endpoint
+
+	return r, nil
+}
+
+type seriesReader struct {
+	reader
+	series   model.Series
+	endpoint seriesEndpoint
+}
+
+// Series TODO.
+func (r *seriesReader) Series() model.Series {
+	return r.series
+}
+
+// ReadSeries TODO.
+func (r *seriesReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	url := fmt.Sprintf("%v/"+r.endpoint.path, r.baseURL, t.Format("2006-01-02"))
+	data := r.endpoint.newData()
+	if err := r.get(url, data); err != nil {
+		return nil, err
+	}
+
+	return data.Readings(t)
+}
+
+type rangeSeriesReader struct {
+	*seriesReader
+	endpoint rangeEndpoint
+}
+
+// ReadSeries TODO.
+func (r *rangeSeriesReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	return r.ReadSeriesRange(t, t.AddDate(0, 0, 1))
+}
+
+// ReadSeriesRange TODO.
+func (r *rangeSeriesReader) ReadSeriesRange(from, to time.Time) ([]model.Reading, error) {
+	// the last day of the range is inclusive
+	first, last := from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02")
+	data := r.endpoint.newData()
+	for _, path := range r.endpoint.paths {
+		if err := r.get(fmt.Sprintf("%v/"+path, r.baseURL, first, last), data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data.Readings(from.Location())
+}
@@ -0,0 +1,416 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package applehealth
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// DefaultMaxRecords is the default number of records kept in memory, about
+// a hundred megabytes.
+const DefaultMaxRecords = 1000000
+
+// heartRate is the kind of the heart rate records, the other kinds being the
+// names of their series.
+const heartRate = "heart_rate"
+
+// kinds are the kinds of the records read by type.
+var kinds = map[string]string{
+	"HKQuantityTypeIdentifierHeartRate":        heartRate,
+	"HKQuantityTypeIdentifierStepCount":        model.Steps.Name,
+	"HKQuantityTypeIdentifierRestingHeartRate": model.RestingHeartRate.Name,
+}
+
+// dateLayout is the layout of the dates of the records.
+const dateLayout = "2006-01-02 15:04:05 -0700"
+
+var errClosed = errors.New("the Apple Health source is closed")
+
+// record is a record of the export.
+type record struct {
+	kind   string
+	start  time.Time
+	value  float64
+	source string
+}
+
+// Reader reads the heart rate, the step count and the resting heart rate
+// records of an Apple Health export. It is the source.Source of the heart
+// rate and provides the sources of the model.Steps and
+// model.RestingHeartRate series, see SeriesSources.
+//
+// The export, which can be gigabytes, is streamed once on the first read,
+// grouping the records by the day of their start in the time zone. When
+// there are more than the maximum number of records, they are written to a
+// temporary file per day instead of being kept in memory, which is removed
+// on Close.
+type Reader struct {
+	fileName   string
+	maxRecords int
+	loc        *time.Location
+
+	mu     sync.Mutex
+	once   sync.Once
+	err    error
+	closed bool
+	// days are the records by day, unless they are in the files of
+	// spillDir.
+	days     map[string][]record
+	spillDir string
+}
+
+// New creates a Reader of the export.xml file of an Apple Health export, or
+// of the export.zip holding it, keeping up to maxRecords records in memory,
+// DefaultMaxRecords if not positive. The days are calendar days in loc.
+func New(fileName string, maxRecords int, loc *time.Location) (*Reader, error) {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	if maxRecords <= 0 {
+		maxRecords = DefaultMaxRecords
+	}
+
+	return &Reader{fileName: fileName, maxRecords: maxRecords, loc: loc}, nil
+}
+
+// ReadData returns the heart rate records starting in the day starting at t.
+func (r *Reader) ReadData(t time.Time) ([]model.HeartData, error) {
+	records, err := r.readDay(t)
+	if err != nil {
+		return nil, err
+	}
+	var res []model.HeartData
+	for _, rec := range records {
+		if rec.kind != heartRate {
+			continue
+		}
+		res = append(res, model.HeartData{
+			DateTime: rec.start.UTC(),
+			Value:    model.Value{BMP: int(math.Round(rec.value)), Confidence: 1},
+		})
+	}
+
+	return res, nil
+}
+
+// SeriesSources returns the sources of the series read from the export.
+func (r *Reader) SeriesSources() []source.SeriesSource {
+	return []source.SeriesSource{
+		&seriesReader{Reader: r, series: model.Steps},
+		&seriesReader{Reader: r, series: model.RestingHeartRate},
+	}
+}
+
+// Close removes the temporary files.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.days = nil
+	if r.spillDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(r.spillDir)
+}
+
+// readDay returns the records of the day starting at t sorted by time,
+// reading the export on the first call.
+func (r *Reader) readDay(t time.Time) ([]record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errClosed
+	}
+	r.once.Do(func() {
+		r.err = r.readExport()
+	})
+	if r.err != nil {
+		return nil, r.err
+	}
+	day := t.In(r.loc).Format("2006-01-02")
+	res := r.days[day]
+	if r.spillDir != "" {
+		var err error
+		if res, err = readSpilled(filepath.Join(r.spillDir, day+".csv")); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].start.Before(res[j].start)
+	})
+
+	return res, nil
+}
+
+// readExport streams the export, grouping its records by day.
+func (r *Reader) readExport() error {
+	f, err := r.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	days := make(map[string][]record)
+	// the names of the sources, shared by their records
+	sources := make(map[string]string)
+	n := 0
+	d := xml.NewDecoder(bufio.NewReader(f))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %v: %v", r.fileName, err)
+		}
+		e, ok := tok.(xml.StartElement)
+		if !ok || e.Name.Local != "Record" {
+			continue
+		}
+		rec, ok, err := parseRecord(e.Attr, sources)
+		if err != nil {
+			return fmt.Errorf("failed to parse %v: %v", r.fileName, err)
+		}
+		if !ok {
+			continue
+		}
+		day := rec.start.In(r.loc).Format("2006-01-02")
+		days[day] = append(days[day], rec)
+		if n++; n < r.maxRecords {
+			continue
+		}
+		if err := r.spill(days); err != nil {
+			return err
+		}
+		days = make(map[string][]record)
+		n = 0
+	}
+	if r.spillDir != "" {
+		return r.spill(days)
+	}
+	r.days = days
+
+	return nil
+}
+
+// open opens the export.xml file, which may be in a zip file.
+func (r *Reader) open() (io.ReadCloser, error) {
+	if !strings.EqualFold(filepath.Ext(r.fileName), ".zip") {
+		return os.Open(r.fileName)
+	}
+	z, err := zip.OpenReader(r.fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range z.File {
+		if path.Base(f.Name) != "export.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			_ = z.Close()
+			return nil, err
+		}
+
+		return zipFile{ReadCloser: rc, zip: z}, nil
+	}
+	_ = z.Close()
+
+	return nil, fmt.Errorf("no export.xml in %v", r.fileName)
+}
+
+// zipFile is a file in a zip file, which is closed along with it.
+type zipFile struct {
+	io.ReadCloser
+	zip *zip.ReadCloser
+}
+
+func (f zipFile) Close() error {
+	err := f.ReadCloser.Close()
+	if zipErr := f.zip.Close(); err == nil {
+		err = zipErr
+	}
+
+	return err
+}
+
+// parseRecord parses the attributes of a record, false if its type is not
+// read.
+func parseRecord(attrs []xml.Attr, sources map[string]string) (record, bool, error) {
+	var res record
+	var start, value string
+	for _, a := range attrs {
+		switch a.Name.Local {
+		case "type":
+			res.kind = kinds[a.Value]
+		case "sourceName":
+			name, ok := sources[a.Value]
+			if !ok {
+				name = a.Value
+				sources[name] = name
+			}
+			res.source = name
+		case "startDate":
+			start = a.Value
+		case "value":
+			value = a.Value
+		}
+	}
+	if res.kind == "" {
+		return res, false, nil
+	}
+	var err error
+	if res.start, err = time.Parse(dateLayout, start); err != nil {
+		return res, false, err
+	}
+	if res.value, err = strconv.ParseFloat(value, 64); err != nil {
+		return res, false, fmt.Errorf("invalid value %q: %v", value, err)
+	}
+
+	return res, true, nil
+}
+
+// spill appends the records to the files of their days, creating the
+// temporary folder on the first call.
+func (r *Reader) spill(days map[string][]record) error {
+	if r.spillDir == "" {
+		dir, err := ioutil.TempDir("", "fde-apple-health")
+		if err != nil {
+			return err
+		}
+		r.spillDir = dir
+	}
+	for day, records := range days {
+		f, err := os.OpenFile(filepath.Join(r.spillDir, day+".csv"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		for _, rec := range records {
+			_ = w.Write([]string{
+				rec.kind,
+				strconv.FormatInt(rec.start.Unix(), 10),
+				strconv.FormatFloat(rec.value, 'g', -1, 64),
+				rec.source,
+			})
+		}
+		w.Flush()
+		err = w.Error()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write the records of %v: %v", day, err)
+		}
+	}
+
+	return nil
+}
+
+// readSpilled reads the records of a day written by spill, none if there is
+// no file.
+func readSpilled(fileName string) ([]record, error) {
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]record, 0, len(rows))
+	for _, row := range rows {
+		sec, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(row[2], 64)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, record{kind: row[0], start: time.Unix(sec, 0), value: value, source: row[3]})
+	}
+
+	return res, nil
+}
+
+// seriesReader is the source.SeriesSource of a series of the export.
+type seriesReader struct {
+	*Reader
+	series model.Series
+}
+
+// Series TODO.
+func (r *seriesReader) Series() model.Series {
+	return r.series
+}
+
+// ReadSeries returns the records of the series starting in the day starting
+// at t. The daily readings are at the start of the day.
+func (r *seriesReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	records, err := r.readDay(t)
+	if err != nil {
+		return nil, err
+	}
+	var res []model.Reading
+	for _, rec := range records {
+		if rec.kind != r.series.Name {
+			continue
+		}
+		ts := rec.start
+		if r.series.Daily {
+			ts = t
+		}
+		res = append(res, model.Reading{
+			Time:   ts.UTC(),
+			Values: map[string]float64{r.series.Fields[0]: rec.value},
+			Tags:   map[string]string{"source": rec.source},
+		})
+	}
+
+	return res, nil
+}
+
+// Close does nothing, the Reader is closed as the source of the heart rate.
+func (r *seriesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package applehealth
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+const export = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE HealthData [
+<!ELEMENT HealthData (ExportDate,Me,(Record|Workout)*)>
+]>
+<HealthData locale="en_US">
+ <ExportDate value="2021-10-27 10:00:00 +0200"/>
+ <Me HKCharacteristicTypeIdentifierDateOfBirth=""/>
+ <Record type="HKQuantityTypeIdentifierStepCount" sourceName="iPhone" unit="count" startDate="2021-10-25 08:00:00 +0200" endDate="2021-10-25 08:10:00 +0200" value="420"/>
+ <Record type="HKQuantityTypeIdentifierStepCount" sourceName="Apple Watch" unit="count" startDate="2021-10-25 08:00:00 +0200" endDate="2021-10-25 08:10:00 +0200" value="415"/>
+ <Record type="HKQuantityTypeIdentifierHeartRate" sourceName="Apple Watch" unit="count/min" startDate="2021-10-25 07:12:40 +0200" endDate="2021-10-25 07:12:40 +0200" value="61.6">
+  <MetadataEntry key="HKMetadataKeyHeartRateMotionContext" value="0"/>
+ </Record>
+ <Record type="HKQuantityTypeIdentifierHeartRate" sourceName="Apple Watch" unit="count/min" startDate="2021-10-25 07:12:30 +0200" endDate="2021-10-25 07:12:30 +0200" value="60"/>
+ <Record type="HKQuantityTypeIdentifierHeartRate" sourceName="Apple Watch" unit="count/min" startDate="2021-10-26 00:30:00 +0200" endDate="2021-10-26 00:30:00 +0200" value="55"/>
+ <Record type="HKQuantityTypeIdentifierBodyMass" sourceName="Scale" unit="kg" startDate="2021-10-25 07:00:00 +0200" endDate="2021-10-25 07:00:00 +0200" value="70"/>
+ <Record type="HKQuantityTypeIdentifierRestingHeartRate" sourceName="Apple Watch" unit="count/min" startDate="2021-10-25 00:01:00 +0200" endDate="2021-10-25 23:59:00 +0200" value="52"/>
+ <Workout workoutActivityType="HKWorkoutActivityTypeRunning" duration="30"/>
+</HealthData>
+`
+
+func TestReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fde-apple-health-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "export.xml")
+	if err := ioutil.WriteFile(fileName, []byte(export), 0600); err != nil {
+		t.Fatal(err)
+	}
+	zipName := filepath.Join(dir, "export.zip")
+	f, err := os.Create(zipName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := zip.NewWriter(f)
+	w, err := z.Create("apple_health_export/export.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(export)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loc := time.FixedZone("CEST", 2*60*60)
+	day := time.Date(2021, 10, 25, 0, 0, 0, 0, loc)
+	wantHeart := []model.HeartData{
+		{DateTime: time.Date(2021, 10, 25, 5, 12, 30, 0, time.UTC), Value: model.Value{BMP: 60, Confidence: 1}},
+		{DateTime: time.Date(2021, 10, 25, 5, 12, 40, 0, time.UTC), Value: model.Value{BMP: 62, Confidence: 1}},
+	}
+	steps := time.Date(2021, 10, 25, 6, 0, 0, 0, time.UTC)
+	wantSeries := map[string][]model.Reading{
+		model.Steps.Name: {
+			{Time: steps, Values: map[string]float64{"steps": 420}, Tags: map[string]string{"source": "iPhone"}},
+			{Time: steps, Values: map[string]float64{"steps": 415}, Tags: map[string]string{"source": "Apple Watch"}},
+		},
+		model.RestingHeartRate.Name: {
+			{Time: day.UTC(), Values: map[string]float64{"value": 52}, Tags: map[string]string{"source": "Apple Watch"}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		fileName   string
+		maxRecords int
+	}{
+		{"memory", fileName, 0},
+		{"spilled", fileName, 2},
+		{"zip", zipName, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.fileName, tt.maxRecords, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.ReadData(day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, wantHeart) {
+				t.Errorf("got %v, want %v", got, wantHeart)
+			}
+			for _, s := range r.SeriesSources() {
+				got, err := s.ReadSeries(day)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := wantSeries[s.Series().Name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%v: got %v, want %v", s.Series().Name, got, want)
+				}
+			}
+			got, err = r.ReadData(day.AddDate(0, 0, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].Value.BMP != 55 {
+				t.Errorf("next day: got %v, want a reading of 55", got)
+			}
+
+			spillDir := r.spillDir
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if (spillDir != "") != (tt.maxRecords > 0) {
+				t.Errorf("got temporary folder %q with %d records in memory", spillDir, tt.maxRecords)
+			}
+			if _, err := os.Stat(spillDir); spillDir != "" && !os.IsNotExist(err) {
+				t.Errorf("the temporary folder was not removed: %v", err)
+			}
+			if _, err := r.ReadData(day); err != errClosed {
+				t.Errorf("got %v after Close, want %v", err, errClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package fit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// epoch is the origin of the FIT timestamps, in seconds.
+var epoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+const (
+	// recordMessage is the global number of the record messages.
+	recordMessage = 20
+	// timestampField is the number of the timestamp field of every message.
+	timestampField = 253
+)
+
+// recordField is a field of the record messages, whose value is
+// raw/scale - offset.
+type recordField struct {
+	num    byte
+	name   string
+	scale  float64
+	offset float64
+}
+
+// semicircles are the units of the positions per degree.
+const semicircles = 1 << 31 / 180.0
+
+// recordFields are the fields of the record messages that are read. The
+// enhanced fields, which have a larger range, come last to replace the
+// others.
+var recordFields = []recordField{
+	{num: 0, name: "latitude", scale: semicircles},
+	{num: 1, name: "longitude", scale: semicircles},
+	{num: 2, name: "altitude", scale: 5, offset: 500},
+	{num: 3, name: "heart_rate", scale: 1},
+	{num: 4, name: "cadence", scale: 1},
+	{num: 5, name: "distance", scale: 100},
+	{num: 6, name: "speed", scale: 1000},
+	{num: 73, name: "speed", scale: 1000},
+	{num: 78, name: "altitude", scale: 5, offset: 500},
+}
+
+// baseTypeSizes are the sizes of the base types by number, zero for the
+// strings. The fields whose size differ are arrays, which are not read.
+var baseTypeSizes = []int{1, 1, 1, 2, 2, 4, 4, 0, 4, 8, 1, 2, 4, 1, 8, 8, 8}
+
+type fieldDefinition struct {
+	num      byte
+	size     int
+	baseType byte
+}
+
+type messageDefinition struct {
+	global uint16
+	order  binary.ByteOrder
+	fields []fieldDefinition
+	// size is the size of the data messages, including the developer
+	// fields.
+	size int
+}
+
+var errNotFIT = errors.New("not a FIT file")
+
+// decode returns the readings of the record messages of the FIT files
+// chained in b, in the order of the files.
+func decode(b []byte) ([]model.Reading, error) {
+	var res []model.Reading
+	for len(b) > 0 {
+		readings, n, err := decodeFile(b)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, readings...)
+		b = b[n:]
+	}
+
+	return res, nil
+}
+
+// decodeFile decodes the first FIT file in b, returning its size.
+func decodeFile(b []byte) ([]model.Reading, int, error) {
+	if len(b) < 12 || string(b[8:12]) != ".FIT" {
+		return nil, 0, errNotFIT
+	}
+	headerSize := int(b[0])
+	end := headerSize + int(binary.LittleEndian.Uint32(b[4:8]))
+	if headerSize < 12 || len(b) < end+2 {
+		return nil, 0, fmt.Errorf("truncated FIT file")
+	}
+	if crc := binary.LittleEndian.Uint16(b[end:]); crc != checksum(b[:end]) {
+		return nil, 0, fmt.Errorf("invalid FIT checksum %#04x", crc)
+	}
+
+	definitions := make(map[byte]*messageDefinition)
+	var last uint32
+	var res []model.Reading
+	data := b[headerSize:end]
+	for len(data) > 0 {
+		header := data[0]
+		data = data[1:]
+		var local byte
+		compressed := false
+		var ts uint32
+		switch {
+		case header&0x80 != 0:
+			// compressed timestamp header, holding the 5 lower bits of
+			// the timestamp, which follows the last one
+			local = header >> 5 & 0x03
+			offset := uint32(header & 0x1f)
+			ts = last&^0x1f | offset
+			if offset < last&0x1f {
+				ts += 0x20
+			}
+			compressed = true
+		case header&0x40 != 0:
+			def, n, err := readDefinition(data, header&0x20 != 0)
+			if err != nil {
+				return nil, 0, err
+			}
+			definitions[header&0x0f] = def
+			data = data[n:]
+			continue
+		default:
+			local = header & 0x0f
+		}
+		def, ok := definitions[local]
+		if !ok {
+			return nil, 0, fmt.Errorf("undefined local message type %d", local)
+		}
+		if len(data) < def.size {
+			return nil, 0, fmt.Errorf("truncated FIT message")
+		}
+		msg := data[:def.size]
+		data = data[def.size:]
+		values := make(map[byte]float64, len(def.fields))
+		for _, f := range def.fields {
+			if v, ok := value(msg[:f.size], f.baseType, def.order); ok {
+				values[f.num] = v
+			}
+			msg = msg[f.size:]
+		}
+		if v, ok := values[timestampField]; ok {
+			last = uint32(v)
+		} else if compressed {
+			last = ts
+			values[timestampField] = float64(ts)
+		}
+		if def.global != recordMessage {
+			continue
+		}
+		if r, ok := toReading(values); ok {
+			res = append(res, r)
+		}
+	}
+
+	return res, end + 2, nil
+}
+
+// readDefinition reads a definition message, returning its size.
+func readDefinition(b []byte, developer bool) (*messageDefinition, int, error) {
+	if len(b) < 5 {
+		return nil, 0, fmt.Errorf("truncated FIT definition")
+	}
+	def := &messageDefinition{order: binary.LittleEndian}
+	if b[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.global = def.order.Uint16(b[2:4])
+	n := 5 + 3*int(b[4])
+	if len(b) < n {
+		return nil, 0, fmt.Errorf("truncated FIT definition")
+	}
+	for i := 5; i < n; i += 3 {
+		f := fieldDefinition{num: b[i], size: int(b[i+1]), baseType: b[i+2]}
+		def.fields = append(def.fields, f)
+		def.size += f.size
+	}
+	if developer {
+		if len(b) < n+1 {
+			return nil, 0, fmt.Errorf("truncated FIT definition")
+		}
+		start := n + 1
+		n = start + 3*int(b[n])
+		if len(b) < n {
+			return nil, 0, fmt.Errorf("truncated FIT definition")
+		}
+		// the developer fields are skipped, as a field of an unknown
+		// base type
+		for i := start; i < n; i += 3 {
+			f := fieldDefinition{num: 0xff, size: int(b[i+1]), baseType: 0xff}
+			def.fields = append(def.fields, f)
+			def.size += f.size
+		}
+	}
+
+	return def, n, nil
+}
+
+// value returns the value of a field, false if it is invalid or not a
+// number.
+func value(b []byte, baseType byte, order binary.ByteOrder) (float64, bool) {
+	t := int(baseType & 0x1f)
+	if t >= len(baseTypeSizes) || baseTypeSizes[t] != len(b) {
+		return 0, false
+	}
+	var u uint64
+	switch len(b) {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(order.Uint16(b))
+	case 4:
+		u = uint64(order.Uint32(b))
+	case 8:
+		u = order.Uint64(b)
+	}
+	bits := uint(len(b)) * 8
+	invalid := ^uint64(0) >> (64 - bits)
+	switch t {
+	case 1, 3, 5, 14:
+		// signed, invalid at the maximum
+		v := int64(u<<(64-bits)) >> (64 - bits)
+		return float64(v), u != invalid>>1
+	case 8:
+		return float64(math.Float32frombits(uint32(u))), u != invalid
+	case 9:
+		return math.Float64frombits(u), u != invalid
+	case 10, 11, 12, 16:
+		// unsigned, invalid at zero
+		return float64(u), u != 0
+	default:
+		return float64(u), u != invalid
+	}
+}
+
+// toReading converts the values of a record message, false if it has no
+// timestamp or values.
+func toReading(values map[byte]float64) (model.Reading, bool) {
+	ts, ok := values[timestampField]
+	if !ok {
+		return model.Reading{}, false
+	}
+	res := model.Reading{
+		Time:   epoch.Add(time.Duration(ts) * time.Second),
+		Values: make(map[string]float64),
+	}
+	for _, f := range recordFields {
+		if v, ok := values[f.num]; ok {
+			res.Values[f.name] = v/f.scale - f.offset
+		}
+	}
+
+	return res, len(res.Values) > 0
+}
+
+// crcTable is the table of the FIT checksum.
+var crcTable = [16]uint16{
+	0x0000, 0xcc01, 0xd801, 0x1400, 0xf001, 0x3c00, 0x2800, 0xe401,
+	0xa001, 0x6c00, 0x7800, 0xb401, 0x5000, 0x9c01, 0x8801, 0x4400,
+}
+
+// checksum returns the FIT checksum of b.
+func checksum(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		tmp := crcTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ crcTable[c&0xf]
+		tmp = crcTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ crcTable[(c>>4)&0xf]
+	}
+
+	return crc
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package fit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// Reader reads the record messages of the FIT files in a folder, ex. the
+// Activity folder of a Garmin device. It is the source.SeriesSource of the
+// model.Record series, whose heart rate is kept apart from the one of the
+// Fitbit trackers.
+type Reader struct {
+	dirPath string
+	name    string
+
+	once     sync.Once
+	readings []model.Reading
+	err      error
+}
+
+// New creates a Reader of the .fit files in dirPath and its subfolders,
+// whose records are tagged with the source name, ex. garmin.
+func New(dirPath, name string) (*Reader, error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+
+	return &Reader{dirPath: dirPath, name: name}, nil
+}
+
+// Series TODO.
+func (r *Reader) Series() model.Series {
+	return model.Record
+}
+
+// ReadSeries reads all the files on the first call.
+func (r *Reader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	return r.ReadSeriesRange(t, t.AddDate(0, 0, 1))
+}
+
+// ReadSeriesRange reads all the files on the first call.
+func (r *Reader) ReadSeriesRange(from, to time.Time) ([]model.Reading, error) {
+	r.once.Do(func() {
+		r.readings, r.err = r.readAll()
+	})
+	if r.err != nil {
+		return nil, r.err
+	}
+	i := sort.Search(len(r.readings), func(i int) bool {
+		return !r.readings[i].Time.Before(from)
+	})
+	var res []model.Reading
+	for _, d := range r.readings[i:] {
+		if !d.Time.Before(to) {
+			break
+		}
+		res = append(res, d)
+	}
+
+	return res, nil
+}
+
+// readAll reads the records of all the files sorted by time.
+func (r *Reader) readAll() ([]model.Reading, error) {
+	var res []model.Reading
+	err := filepath.Walk(r.dirPath, func(fileName string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.EqualFold(filepath.Ext(fileName), ".fit") {
+			return err
+		}
+		b, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		readings, err := decode(b)
+		if err != nil {
+			return fmt.Errorf("failed to decode %v: %v", fileName, err)
+		}
+		for i := range readings {
+			readings[i].Tags = map[string]string{"source": r.name}
+		}
+		res = append(res, readings...)
+
+		return nil
+	})
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+
+	return res, err
+}
+
+// Close TODO.
+func (r *Reader) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// encode returns a FIT file with the messages, which include their headers.
+func encode(messages ...[]byte) []byte {
+	data := bytes.Join(messages, nil)
+	header := []byte{12, 0x10, 0, 0, 0, 0, 0, 0, '.', 'F', 'I', 'T'}
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+	b := append(header, data...)
+	crc := make([]byte, 2)
+	binary.LittleEndian.PutUint16(crc, checksum(b))
+
+	return append(b, crc...)
+}
+
+func le(v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, x := range v {
+		_ = binary.Write(&buf, binary.LittleEndian, x)
+	}
+
+	return buf.Bytes()
+}
+
+func be(v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, x := range v {
+		_ = binary.Write(&buf, binary.BigEndian, x)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	start := time.Date(2021, 10, 25, 7, 0, 0, 0, time.UTC)
+	ts := uint32(start.Sub(epoch) / time.Second)
+	file := encode(
+		// file_id: type, manufacturer
+		[]byte{0x40, 0, 0, 0, 0, 2, 0, 1, 0x00, 1, 2, 0x84},
+		[]byte{0x00, 4, 1, 0},
+		// record with a developer field: timestamp, heart_rate, cadence,
+		// position_lat, position_long, enhanced_altitude, distance
+		[]byte{0x61, 0, 0, 20, 0, 7, 253, 4, 0x86, 3, 1, 0x02, 4, 1, 0x02, 0, 4, 0x85, 1, 4, 0x85, 78, 4, 0x86, 5, 4, 0x86, 1, 0, 2, 0},
+		append([]byte{0x01}, le(ts, uint8(120), uint8(80), int32(504468802), int32(278462191), uint32(3000), uint32(1250), uint16(7))...),
+		// invalid values are missing
+		append([]byte{0x01}, le(ts+3, uint8(0xff), uint8(82), int32(0x7fffffff), int32(0x7fffffff), uint32(3005), uint32(0xffffffff), uint16(7))...),
+		// big endian record with the heart rate only and a compressed
+		// timestamp
+		[]byte{0x42, 0, 1, 0, 20, 1, 3, 1, 0x02},
+		[]byte{0x80 | 2<<5 | byte((ts+5)&0x1f), 121},
+	)
+	nextDay := uint32(start.AddDate(0, 0, 1).Sub(epoch) / time.Second)
+	other := encode(
+		[]byte{0x40, 0, 1, 0, 20, 2, 253, 4, 0x86, 3, 1, 0x02},
+		append([]byte{0x00}, be(nextDay, uint8(90))...),
+	)
+
+	dir, err := ioutil.TempDir("", "fde-fit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "Activity"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{"Activity/a.FIT": append(other, file...), "notes.txt": []byte("not a fit file")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := New(dir, "garmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC)
+	got, err := r.ReadSeries(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{"source": "garmin"}
+	want := []model.Reading{
+		{Time: start, Values: map[string]float64{
+			"heart_rate": 120,
+			"cadence":    80,
+			"latitude":   504468802 / semicircles,
+			"longitude":  278462191 / semicircles,
+			"altitude":   100,
+			"distance":   12.5,
+		}, Tags: tags},
+		{Time: start.Add(3 * time.Second), Values: map[string]float64{"cadence": 82, "altitude": 101}, Tags: tags},
+		{Time: start.Add(5 * time.Second), Values: map[string]float64{"heart_rate": 121}, Tags: tags},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = r.ReadSeries(day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Values["heart_rate"] != 90 {
+		t.Errorf("next day: got %v, want a reading of 90", got)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	file := encode([]byte{0x40, 0, 0, 20, 0, 1, 3, 1, 0x02}, []byte{0x00, 60})
+	file[len(file)-3]++
+	if _, err := decode(file); err == nil {
+		t.Error("expected an error for an invalid checksum")
+	}
+	if _, err := decode([]byte("not a fit file")); err != errNotFIT {
+		t.Errorf("got %v, want %v", err, errNotFIT)
+	}
+	if _, err := decode(encode([]byte{0x00, 60})); err == nil {
+		t.Error("expected an error for an undefined message")
+	}
+}
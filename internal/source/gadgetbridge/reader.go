@@ -0,0 +1,448 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package gadgetbridge
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// the driver of the database
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// sampleTableSuffix is the suffix of the tables of the activity samples of
+// the devices, ex. MI_BAND_ACTIVITY_SAMPLE.
+const sampleTableSuffix = "_ACTIVITY_SAMPLE"
+
+// ErrNoCgo is returned when the executable was built without cgo, which the
+// driver of the database needs.
+var ErrNoCgo = errors.New("reading the Gadgetbridge databases needs cgo, which was disabled when building the executable (ex. by make build-static), use make build")
+
+// sleepSampleDuration is the longest duration of a sleep sample, as the
+// devices record a sample per minute.
+const sleepSampleDuration = 60
+
+// SleepKinds are the raw kinds of the samples of a table that are sleep.
+type SleepKinds struct {
+	// Mask is applied to the raw kinds if not zero, as some devices keep
+	// flags in their high bits.
+	Mask int
+	// Stages are the sleep stages by raw kind, ex. light or deep.
+	Stages map[int]string
+}
+
+// DefaultSleepKinds are the sleep kinds of the Huami devices (Mi Band 2 and
+// later, Amazfit), whose samples are in MI_BAND_ACTIVITY_SAMPLE.
+var DefaultSleepKinds = map[string]SleepKinds{
+	"MI_BAND_ACTIVITY_SAMPLE": {Mask: 0x0f, Stages: map[int]string{9: "light", 11: "deep"}},
+}
+
+// ParseSleepKinds parses the sleep kinds of tables separated by semicolons,
+// ex. PEBBLE_HEALTH_ACTIVITY_SAMPLE:1=light,2=deep, which replace the
+// default ones of the tables.
+func ParseSleepKinds(s string) (map[string]SleepKinds, error) {
+	res := make(map[string]SleepKinds, len(DefaultSleepKinds))
+	for table, kinds := range DefaultSleepKinds {
+		res[table] = kinds
+	}
+	for _, t := range strings.Split(s, ";") {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		parts := strings.SplitN(t, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid sleep kinds %q, expected table:kind=stage,...", t)
+		}
+		kinds := SleepKinds{Stages: make(map[int]string)}
+		for _, kv := range strings.Split(parts[1], ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 {
+				return nil, fmt.Errorf("invalid sleep kind %q, expected kind=stage", kv)
+			}
+			kind, err := strconv.Atoi(strings.TrimSpace(p[0]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid sleep kind %q: %v", p[0], err)
+			}
+			kinds.Stages[kind] = strings.TrimSpace(p[1])
+		}
+		res[strings.ToUpper(strings.TrimSpace(parts[0]))] = kinds
+	}
+
+	return res, nil
+}
+
+// sampleTable is a table of activity samples. The columns other than the
+// time and the device are optional.
+type sampleTable struct {
+	name      string
+	steps     bool
+	heartRate bool
+	rawKind   bool
+}
+
+// sample is an activity sample, whose missing values are negative.
+type sample struct {
+	time      time.Time
+	table     string
+	device    int64
+	steps     int
+	heartRate int
+	rawKind   int
+}
+
+// Reader reads the activity samples of the devices of a Gadgetbridge
+// database export. It provides the sources of the model.Record (the heart
+// rate), model.Steps and model.SleepStage series, see SeriesSources, whose
+// source is the alias or the name of the device.
+//
+// The samples of all the tables named like MI_BAND_ACTIVITY_SAMPLE are read,
+// which have the time in seconds, the device and optionally the steps, the
+// heart rate and the raw kind of activity of every sample. The raw kinds are
+// specific to the devices, so only those of the tables in sleepKinds are
+// converted to sleep stages.
+type Reader struct {
+	db         *sql.DB
+	sleepKinds map[string]SleepKinds
+
+	once    sync.Once
+	err     error
+	tables  []sampleTable
+	devices map[int64]string
+}
+
+// New creates a Reader of the Gadgetbridge database export in fileName, with
+// the sleep kinds of the tables, ex. DefaultSleepKinds.
+func New(fileName string, sleepKinds map[string]SleepKinds) (*Reader, error) {
+	if !cgoEnabled {
+		return nil, ErrNoCgo
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	dsn, err := readOnlyURI(fileName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{db: db, sleepKinds: sleepKinds}, nil
+}
+
+// readOnlyURI returns the URI opening the database in fileName read only, in
+// which the path is escaped, as ? and # would start the query and the
+// fragment.
+func readOnlyURI(fileName string) (string, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return "", err
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		// ex. C:/Users on Windows
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+
+	return u.String(), nil
+}
+
+// SeriesSources returns the sources of the series read from the database.
+func (r *Reader) SeriesSources() []source.SeriesSource {
+	return []source.SeriesSource{
+		&seriesReader{Reader: r, series: model.Record, readings: r.heartRate},
+		&seriesReader{Reader: r, series: model.Steps, readings: r.steps},
+		&seriesReader{Reader: r, series: model.SleepStage, readings: r.sleepStages},
+	}
+}
+
+// Close TODO.
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
+
+// heartRate returns the readings of the samples with a heart rate.
+func (r *Reader) heartRate(samples []sample) []model.Reading {
+	var res []model.Reading
+	for _, s := range samples {
+		// the devices use 0 or 255 when the heart rate was not measured
+		if s.heartRate <= 0 || s.heartRate >= 255 {
+			continue
+		}
+		res = append(res, model.Reading{
+			Time:   s.time,
+			Values: map[string]float64{"heart_rate": float64(s.heartRate)},
+			Tags:   map[string]string{"source": r.deviceName(s.device)},
+		})
+	}
+
+	return res
+}
+
+// steps returns the readings of the samples with steps.
+func (r *Reader) steps(samples []sample) []model.Reading {
+	var res []model.Reading
+	for _, s := range samples {
+		if s.steps <= 0 {
+			continue
+		}
+		res = append(res, model.Reading{
+			Time:   s.time,
+			Values: map[string]float64{"steps": float64(s.steps)},
+			Tags:   map[string]string{"source": r.deviceName(s.device)},
+		})
+	}
+
+	return res
+}
+
+// deviceName returns the name of a device, its id if unknown.
+func (r *Reader) deviceName(id int64) string {
+	if name := r.devices[id]; name != "" {
+		return name
+	}
+
+	return fmt.Sprintf("device %d", id)
+}
+
+// sleepStages returns the readings of the samples of sleep, lasting until
+// the next sample of the device.
+func (r *Reader) sleepStages(samples []sample) []model.Reading {
+	var res []model.Reading
+	for i, s := range samples {
+		kinds, ok := r.sleepKinds[s.table]
+		if !ok || s.rawKind < 0 {
+			continue
+		}
+		kind := s.rawKind
+		if kinds.Mask != 0 {
+			kind &= kinds.Mask
+		}
+		stage, ok := kinds.Stages[kind]
+		if !ok {
+			continue
+		}
+		duration := int64(sleepSampleDuration)
+		for _, next := range samples[i+1:] {
+			if next.table != s.table || next.device != s.device || !next.time.After(s.time) {
+				continue
+			}
+			if d := next.time.Unix() - s.time.Unix(); d < duration {
+				duration = d
+			}
+			break
+		}
+		res = append(res, model.Reading{
+			Time:   s.time,
+			Values: map[string]float64{"duration": float64(duration)},
+			Tags:   map[string]string{"source": r.deviceName(s.device), "stage": stage},
+		})
+	}
+
+	return res
+}
+
+// readDay returns the samples of all the tables in the day starting at t
+// sorted by time, finding the tables on the first call.
+func (r *Reader) readDay(t time.Time) ([]sample, error) {
+	r.once.Do(func() {
+		r.err = r.readSchema()
+	})
+	if r.err != nil {
+		return nil, r.err
+	}
+	var res []sample
+	for _, table := range r.tables {
+		samples, err := r.readSamples(table, t.Unix(), t.AddDate(0, 0, 1).Unix())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", table.name, err)
+		}
+		res = append(res, samples...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].time.Before(res[j].time)
+	})
+
+	return res, nil
+}
+
+// readSamples reads the samples of a table in [from, to), in seconds.
+func (r *Reader) readSamples(table sampleTable, from, to int64) ([]sample, error) {
+	column := func(name string, present bool) string {
+		if present {
+			return name
+		}
+
+		return "-1"
+	}
+	query := fmt.Sprintf(`SELECT TIMESTAMP, DEVICE_ID, %s, %s, %s FROM "%s"
+WHERE TIMESTAMP >= ? AND TIMESTAMP < ? ORDER BY TIMESTAMP`,
+		column("IFNULL(STEPS, -1)", table.steps),
+		column("IFNULL(HEART_RATE, -1)", table.heartRate),
+		column("IFNULL(RAW_KIND, -1)", table.rawKind),
+		table.name)
+	rows, err := r.db.Query(query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []sample
+	for rows.Next() {
+		var ts int64
+		s := sample{table: table.name}
+		if err := rows.Scan(&ts, &s.device, &s.steps, &s.heartRate, &s.rawKind); err != nil {
+			return nil, err
+		}
+		s.time = time.Unix(ts, 0).UTC()
+		res = append(res, s)
+	}
+
+	return res, rows.Err()
+}
+
+// readSchema finds the tables of the samples and the names of the devices.
+func (r *Reader) readSchema() error {
+	rows, err := r.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`)
+	if err != nil {
+		return fmt.Errorf("failed to read the tables: %v", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.devices = make(map[int64]string)
+	for _, name := range names {
+		columns, err := r.columns(name)
+		if err != nil {
+			return err
+		}
+		if name == "DEVICE" {
+			if err := r.readDevices(columns["ALIAS"]); err != nil {
+				return fmt.Errorf("failed to read the devices: %v", err)
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, sampleTableSuffix) || !columns["TIMESTAMP"] || !columns["DEVICE_ID"] {
+			continue
+		}
+		r.tables = append(r.tables, sampleTable{
+			name:      name,
+			steps:     columns["STEPS"],
+			heartRate: columns["HEART_RATE"],
+			rawKind:   columns["RAW_KIND"],
+		})
+	}
+	if len(r.tables) == 0 {
+		return fmt.Errorf("no activity samples, not a Gadgetbridge database")
+	}
+
+	return nil
+}
+
+// columns returns the columns of a table.
+func (r *Reader) columns(table string) (map[string]bool, error) {
+	rows, err := r.db.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, strings.Replace(table, "'", "''", -1)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the columns of %v: %v", table, err)
+	}
+	defer rows.Close()
+	res := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res[strings.ToUpper(name)] = true
+	}
+
+	return res, rows.Err()
+}
+
+// readDevices reads the names of the devices, preferring their aliases.
+func (r *Reader) readDevices(alias bool) error {
+	name := "NAME"
+	if alias {
+		name = "COALESCE(NULLIF(ALIAS, ''), NAME)"
+	}
+	rows, err := r.db.Query(fmt.Sprintf(`SELECT _id, %s FROM DEVICE`, name))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		r.devices[id] = name.String
+	}
+
+	return rows.Err()
+}
+
+// seriesReader is the source.SeriesSource of a series of the database.
+type seriesReader struct {
+	*Reader
+	series   model.Series
+	readings func(samples []sample) []model.Reading
+}
+
+// Series TODO.
+func (r *seriesReader) Series() model.Series {
+	return r.series
+}
+
+// ReadSeries TODO.
+func (r *seriesReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	samples, err := r.readDay(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.readings(samples), nil
+}
+
+// Close does nothing, the Reader is closed as the source of the heart rate.
+func (r *seriesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package gadgetbridge
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+func TestReader(t *testing.T) {
+	if !cgoEnabled {
+		t.Skip("the driver needs cgo")
+	}
+	dir, err := ioutil.TempDir("", "fde-gadgetbridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "Gadgetbridge")
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC)
+	ts := day.Unix()
+	for _, stmt := range []string{
+		`CREATE TABLE DEVICE (_id INTEGER PRIMARY KEY, NAME TEXT, MANUFACTURER TEXT, IDENTIFIER TEXT, ALIAS TEXT)`,
+		`INSERT INTO DEVICE VALUES (1, 'Mi Band 4', 'Xiaomi', 'C8:0F', 'My band'), (2, 'Pebble Time', 'Pebble', 'B0:B4', NULL)`,
+		`CREATE TABLE MI_BAND_ACTIVITY_SAMPLE (TIMESTAMP INTEGER, DEVICE_ID INTEGER, USER_ID INTEGER, RAW_INTENSITY INTEGER,
+			STEPS INTEGER, RAW_KIND INTEGER, HEART_RATE INTEGER, PRIMARY KEY (TIMESTAMP, DEVICE_ID))`,
+		`CREATE TABLE PEBBLE_HEALTH_ACTIVITY_SAMPLE (TIMESTAMP INTEGER, DEVICE_ID INTEGER, USER_ID INTEGER, RAW_INTENSITY INTEGER,
+			STEPS INTEGER, RAW_KIND INTEGER, PRIMARY KEY (TIMESTAMP, DEVICE_ID))`,
+		`CREATE TABLE USER (_id INTEGER PRIMARY KEY, NAME TEXT)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []struct {
+		ts                        int64
+		steps, rawKind, heartRate int
+	}{
+		{ts - 60, 0, 121, 50},
+		{ts + 60, 0, 121, 52},
+		{ts + 90, 0, 123, 255},
+		{ts + 600, 0, 123, 0},
+		{ts + 8*3600, 42, 1, 90},
+		{ts + 24*3600, 0, 121, 60},
+	} {
+		if _, err := db.Exec(`INSERT INTO MI_BAND_ACTIVITY_SAMPLE VALUES (?, 1, 1, 10, ?, ?, ?)`, s.ts, s.steps, s.rawKind, s.heartRate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO PEBBLE_HEALTH_ACTIVITY_SAMPLE VALUES (?, 2, 1, 10, 40, 1), (?, 2, 1, 10, NULL, 2)`, ts+8*3600, ts+9*3600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the characters separating the parts of the uri of the database
+	exported := filepath.Join(dir, "Gadgetbridge?#50%")
+	if err := os.Rename(fileName, exported); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds, err := ParseSleepKinds("pebble_health_activity_sample:1=light, 2=deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(exported, kinds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	band := map[string]string{"source": "My band"}
+	pebble := map[string]string{"source": "Pebble Time"}
+	wantSeries := map[string][]model.Reading{
+		model.Record.Name: {
+			{Time: day.Add(time.Minute), Values: map[string]float64{"heart_rate": 52}, Tags: band},
+			{Time: day.Add(8 * time.Hour), Values: map[string]float64{"heart_rate": 90}, Tags: band},
+		},
+		model.Steps.Name: {
+			{Time: day.Add(8 * time.Hour), Values: map[string]float64{"steps": 42}, Tags: band},
+			{Time: day.Add(8 * time.Hour), Values: map[string]float64{"steps": 40}, Tags: pebble},
+		},
+		model.SleepStage.Name: {
+			{Time: day.Add(time.Minute), Values: map[string]float64{"duration": 30}, Tags: map[string]string{"source": "My band", "stage": "light"}},
+			{Time: day.Add(90 * time.Second), Values: map[string]float64{"duration": 60}, Tags: map[string]string{"source": "My band", "stage": "deep"}},
+			{Time: day.Add(10 * time.Minute), Values: map[string]float64{"duration": 60}, Tags: map[string]string{"source": "My band", "stage": "deep"}},
+			{Time: day.Add(8 * time.Hour), Values: map[string]float64{"duration": 60}, Tags: map[string]string{"source": "Pebble Time", "stage": "light"}},
+			{Time: day.Add(9 * time.Hour), Values: map[string]float64{"duration": 60}, Tags: map[string]string{"source": "Pebble Time", "stage": "deep"}},
+		},
+	}
+	sources := r.SeriesSources()
+	if len(sources) != len(wantSeries) {
+		t.Fatalf("got %d series, want %d", len(sources), len(wantSeries))
+	}
+	for _, s := range sources {
+		got, err := s.ReadSeries(day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := wantSeries[s.Series().Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", s.Series().Name, got, want)
+		}
+	}
+}
+
+func TestParseSleepKinds(t *testing.T) {
+	got, err := ParseSleepKinds("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, DefaultSleepKinds) {
+		t.Errorf("got %v, want %v", got, DefaultSleepKinds)
+	}
+	for _, s := range []string{"MI_BAND_ACTIVITY_SAMPLE", "MI_BAND_ACTIVITY_SAMPLE:light", "MI_BAND_ACTIVITY_SAMPLE:x=light"} {
+		if _, err := ParseSleepKinds(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -28,3 +28,36 @@ type Source interface {
 	Close() error
 	ReadData(t time.Time) ([]model.HeartData, error)
 }
+
+// LatestReader reads the latest readings of a day, which may not be over.
+type LatestReader interface {
+	Close() error
+	ReadLatest(day time.Time) (model.Latest, error)
+}
+
+// SeriesSource reads the readings of a series other than the heart rate.
+type SeriesSource interface {
+	Close() error
+	Series() model.Series
+	// ReadSeries returns the readings of the day starting at t.
+	ReadSeries(t time.Time) ([]model.Reading, error)
+}
+
+// SeriesRangeSource is implemented by the sources of the events series, see
+// model.Series, which read the readings of date ranges.
+type SeriesRangeSource interface {
+	SeriesSource
+	// ReadSeriesRange returns the readings in [from, to), which are day
+	// starts at most MaxRangeDays apart.
+	ReadSeriesRange(from, to time.Time) ([]model.Reading, error)
+}
+
+// MaxRangeDays is the longest range read from a SeriesRangeSource, which is
+// the longest one of the log endpoints of the API.
+const MaxRangeDays = 31
+
+// DeviceSource reads the devices paired with the account of the user.
+type DeviceSource interface {
+	Close() error
+	ReadDevices() ([]model.Device, error)
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package offline
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+// CSVColumns are the columns of the time, the heart rate and its confidence
+// in the csv files. The empty ones are found among the default names, see
+// defaultColumns; the confidence is optional.
+type CSVColumns struct {
+	Time       string
+	Value      string
+	Confidence string
+}
+
+// defaultColumns are the names, compared case insensitively, of the columns
+// found when they are not set.
+var defaultColumns = CSVColumns{
+	Time:       "datetime,date_time,timestamp,time",
+	Value:      "bpm,value,heart_rate,heartrate",
+	Confidence: "confidence",
+}
+
+// ParseCSVColumns parses comma separated column mappings, ex.
+// time=Timestamp,value=BPM,confidence=Conf.
+func ParseCSVColumns(s string) (CSVColumns, error) {
+	var res CSVColumns
+	for _, mapping := range strings.Split(s, ",") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return res, fmt.Errorf("invalid column mapping %q, expected ex. value=BPM", mapping)
+		}
+		column := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "time":
+			res.Time = column
+		case "value":
+			res.Value = column
+		case "confidence":
+			res.Confidence = column
+		default:
+			return res, fmt.Errorf("unknown field %q in %q, expected time, value or confidence", parts[0], mapping)
+		}
+	}
+
+	return res, nil
+}
+
+// bom is the byte order mark some tools write at the start of the files.
+const bom = "\xef\xbb\xbf"
+
+// isJSON reports whether the content of a file is json rather than csv.
+func isJSON(b []byte) bool {
+	b = bytes.TrimLeft(bytes.TrimPrefix(b, []byte(bom)), " \t\r\n")
+
+	return len(b) > 0 && (b[0] == '[' || b[0] == '{')
+}
+
+// findColumn returns the index of the column, or of the first of the
+// candidate names if it is empty, -1 if there is none.
+func findColumn(header []string, column, candidates string) int {
+	names := strings.Split(candidates, ",")
+	if column != "" {
+		names = []string{column}
+	}
+	for _, name := range names {
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// readHeartCSV reads the heart rate readings of a csv file of the day
+// starting at day. The readings are returned in UTC.
+func readHeartCSV(r io.Reader, columns CSVColumns, day time.Time) ([]model.HeartData, error) {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	header, err := c.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], bom)
+	}
+	timeIdx := findColumn(header, columns.Time, defaultColumns.Time)
+	valueIdx := findColumn(header, columns.Value, defaultColumns.Value)
+	confidenceIdx := findColumn(header, columns.Confidence, defaultColumns.Confidence)
+	if timeIdx < 0 || valueIdx < 0 {
+		return nil, fmt.Errorf("no time or value column in the header %v, set the column mapping", header)
+	}
+	if columns.Confidence != "" && confidenceIdx < 0 {
+		return nil, fmt.Errorf("no column %q in the header %v", columns.Confidence, header)
+	}
+	var res []model.HeartData
+	for line := 2; ; line++ {
+		record, err := c.Read()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if timeIdx >= len(record) || valueIdx >= len(record) || record[valueIdx] == "" {
+			continue
+		}
+		ts, err := parseTime(record[timeIdx], day)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		d := model.HeartData{DateTime: ts.UTC()}
+		if d.Value.BMP, err = parseInt(record[valueIdx]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid heart rate: %v", line, err)
+		}
+		if confidenceIdx >= 0 && confidenceIdx < len(record) && record[confidenceIdx] != "" {
+			if d.Value.Confidence, err = parseInt(record[confidenceIdx]); err != nil {
+				return nil, fmt.Errorf("line %d: invalid confidence: %v", line, err)
+			}
+		}
+		res = append(res, d)
+	}
+}
+
+// parseTime parses a time or, if it has no date, a time of day.
+func parseTime(s string, day time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := model.ParseLocalTime(s, day.Location()); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), t.Second(), 0, day.Location()), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// parseInt parses an integer, rounding decimal values.
+func parseInt(s string) (int, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+
+	return int(math.Round(v)), err
+}
@@ -18,6 +18,7 @@
 package offline
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -28,37 +29,66 @@ import (
 	"github.com/ivajloip/fitbit-data-exporter/internal/source"
 )
 
-// New creates a new source.Source that is backed by a folder with json files
+// New creates a new source.Source that is backed by a folder with files
 // representing readings for different days.
 //
-// The files in the folder should be named heart_rate-yyyy-mm-dd.json.
-func New(dirPath string) (source.Source, error) {
-	if dirPath == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return nil, err
-		}
-		dirPath = homeDir + "/.local/fitbit-data-exporter/"
+// The files in the folder should be named prefix-yyyy-mm-dd.json or
+// prefix-yyyy-mm-dd.csv, the prefix being heart_rate if empty. The format of
+// every file is detected from its content: json files hold a list of
+// model.HeartData and csv files have a header and a row per reading, whose
+// columns are given by columns. The times without a zone in the csv files are
+// wall clock times in loc, on the day of the file if they have no date.
+func New(dirPath, prefix string, columns CSVColumns, loc *time.Location) (source.Source, error) {
+	dirPath, err := defaultDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = "heart_rate"
 	}
 
-	return &reader{dirPath}, nil
+	return &reader{dirPath: dirPath, prefix: prefix, columns: columns, loc: loc}, nil
+}
+
+// defaultDir returns dirPath or, if it is empty, the default folder.
+func defaultDir(dirPath string) (string, error) {
+	if dirPath != "" {
+		return dirPath, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return homeDir + "/.local/fitbit-data-exporter/", nil
 }
 
 type reader struct {
 	dirPath string
+	prefix  string
+	columns CSVColumns
+	loc     *time.Location
 }
 
-// ReadData TODO.
+// ReadData reads the json file of the day or, if there is none, the csv one.
 func (r *reader) ReadData(t time.Time) ([]model.HeartData, error) {
-	fileName := r.dirPath + fmt.Sprintf("/heart_rate-%d-%0.2d-%0.2d.json", t.Year(), t.Month(), t.Day())
-	b, err := ioutil.ReadFile(fileName)
+	fileName := r.dirPath + fmt.Sprintf("/%v-%d-%0.2d-%0.2d", r.prefix, t.Year(), t.Month(), t.Day())
+	b, err := ioutil.ReadFile(fileName + ".json")
+	if os.IsNotExist(err) {
+		if csv, csvErr := ioutil.ReadFile(fileName + ".csv"); csvErr == nil || !os.IsNotExist(csvErr) {
+			b, err = csv, csvErr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	if isJSON(b) {
+		var res []model.HeartData
 
-	var res []model.HeartData
+		return res, json.Unmarshal(b, &res)
+	}
 
-	return res, json.Unmarshal(b, &res)
+	return readHeartCSV(bytes.NewReader(b), r.columns, t.In(r.loc))
 }
 
 func (r *reader) Close() error {
@@ -0,0 +1,118 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package offline
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+)
+
+func TestReader(t *testing.T) {
+	dir, cleanup := writeExport(t, map[string]string{
+		"heart_rate-2021-10-25.json": `[{"dateTime":"2021-10-25T07:00:05Z","value":{"bpm":60,"confidence":2}}]`,
+		// the format is detected from the content
+		"heart_rate-2021-10-26.csv": `[{"dateTime":"2021-10-26T07:00:05Z","value":{"bpm":61,"confidence":3}}]`,
+		"heart_rate-2021-10-27.csv": "\xef\xbb\xbfTimestamp,Value,Confidence\n" +
+			"2021-10-27 07:00:05,62,1\n" +
+			"2021-10-27 07:00:10,63.4,\n",
+		"pulse-2021-10-25.csv": "Time,BPM\n" +
+			"07:00:05,70\n" +
+			"23:59:59,71\n",
+	})
+	defer cleanup()
+	sofia := time.FixedZone("EEST", 3*60*60)
+	reading := func(ts time.Time, bpm, confidence int) model.HeartData {
+		return model.HeartData{DateTime: ts, Value: model.Value{BMP: bpm, Confidence: confidence}}
+	}
+
+	tests := []struct {
+		name    string
+		prefix  string
+		columns string
+		day     time.Time
+		want    []model.HeartData
+	}{
+		{"json", "", "", time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC), []model.HeartData{
+			reading(time.Date(2021, 10, 25, 7, 0, 5, 0, time.UTC), 60, 2),
+		}},
+		{"json in a csv file", "", "", time.Date(2021, 10, 26, 0, 0, 0, 0, time.UTC), []model.HeartData{
+			reading(time.Date(2021, 10, 26, 7, 0, 5, 0, time.UTC), 61, 3),
+		}},
+		{"csv with the default columns", "", "", time.Date(2021, 10, 27, 0, 0, 0, 0, time.UTC), []model.HeartData{
+			reading(time.Date(2021, 10, 27, 4, 0, 5, 0, time.UTC), 62, 1),
+			reading(time.Date(2021, 10, 27, 4, 0, 10, 0, time.UTC), 63, 0),
+		}},
+		{"csv with times of day", "pulse", "time=Time,value=BPM", time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC), []model.HeartData{
+			reading(time.Date(2021, 10, 25, 4, 0, 5, 0, time.UTC), 70, 0),
+			reading(time.Date(2021, 10, 25, 20, 59, 59, 0, time.UTC), 71, 0),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			columns, err := ParseCSVColumns(tt.columns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := New(dir, tt.prefix, columns, sofia)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.ReadData(tt.day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].DateTime.Equal(tt.want[i].DateTime) || got[i].Value != tt.want[i].Value {
+					t.Errorf("got %v, want %v", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+
+	r, err := New(dir, "", CSVColumns{Value: "bpm"}, sofia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadData(time.Date(2021, 10, 27, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("missing mapped column accepted")
+	}
+	if _, err := r.ReadData(time.Date(2021, 10, 28, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("missing day accepted")
+	}
+}
+
+func TestParseCSVColumns(t *testing.T) {
+	got, err := ParseCSVColumns(" time=Timestamp , value=BPM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (CSVColumns{Time: "Timestamp", Value: "BPM"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, s := range []string{"bpm", "pulse=BPM", "value="} {
+		if _, err := ParseCSVColumns(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
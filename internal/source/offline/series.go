@@ -0,0 +1,376 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package offline
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+// exportSeries describes the files of a series in the export, which are csv
+// files unless readFile is set.
+type exportSeries struct {
+	// pattern matches the files, relative to the export folder.
+	pattern    string
+	timeColumn string
+	values     func(row map[string]string) (map[string]float64, error)
+	readFile   func(fileName string, loc *time.Location) ([]model.Reading, error)
+}
+
+var exportSeriesByName = map[string]exportSeries{
+	model.SpO2.Name: {
+		pattern:    "Oxygen Saturation (SpO2)/Daily SpO2 - *.csv",
+		timeColumn: "timestamp",
+		values:     columns(map[string]string{"avg": "average_value", "min": "lower_bound", "max": "upper_bound"}),
+	},
+	model.SpO2Intraday.Name: {
+		pattern:    "Oxygen Saturation (SpO2)/Minute SpO2 - *.csv",
+		timeColumn: "timestamp",
+		values:     columns(map[string]string{"value": "value"}),
+	},
+	model.HRV.Name: {
+		pattern:    "Heart Rate Variability/Daily Heart Rate Variability Summary - *.csv",
+		timeColumn: "timestamp",
+		values:     columns(map[string]string{"daily_rmssd": "rmssd"}),
+	},
+	model.HRVIntraday.Name: {
+		pattern:    "Heart Rate Variability/Heart Rate Variability Details - *.csv",
+		timeColumn: "timestamp",
+		values: columns(map[string]string{
+			"rmssd":    "rmssd",
+			"coverage": "coverage",
+			"lf":       "low_frequency",
+			"hf":       "high_frequency",
+		}),
+	},
+	model.BreathingRate.Name: {
+		pattern:    "Heart Rate Variability/Respiratory Rate Summary - *.csv",
+		timeColumn: "timestamp",
+		values: columns(map[string]string{
+			"full_sleep":  "full_sleep_breathing_rate",
+			"deep_sleep":  "deep_sleep_breathing_rate",
+			"light_sleep": "light_sleep_breathing_rate",
+			"rem_sleep":   "rem_sleep_breathing_rate",
+		}),
+	},
+	model.SkinTemperature.Name: {
+		// the night belongs to the day the user woke up, as in the api
+		pattern:    "Temperature/Computed Temperature - *.csv",
+		timeColumn: "sleep_end",
+		values:     nightlyRelative,
+	},
+	model.ActiveZoneMinutes.Name: {
+		pattern:  "Physical Activity/Active Zone Minutes - *.csv",
+		readFile: readActiveZoneMinutes,
+	},
+	model.VO2Max.Name: {
+		pattern:  "Physical Activity/demographic_vo2_max-*.json",
+		readFile: readVO2Max,
+	},
+	model.Weight.Name: {
+		pattern:  "Personal & Account/weight-*.json",
+		readFile: readWeightLogs,
+	},
+}
+
+// columns returns the values of the fields read from the columns, skipping
+// the empty ones.
+func columns(fields map[string]string) func(row map[string]string) (map[string]float64, error) {
+	return func(row map[string]string) (map[string]float64, error) {
+		res := make(map[string]float64)
+		for field, column := range fields {
+			s := row[column]
+			if s == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v %q: %v", column, s, err)
+			}
+			res[field] = v
+		}
+
+		return res, nil
+	}
+}
+
+// nightlyRelative is the mean of the nightly samples relative to the
+// baseline, which the api reports as nightlyRelative.
+func nightlyRelative(row map[string]string) (map[string]float64, error) {
+	v, err := columns(map[string]string{
+		"sum":     "baseline_relative_sample_sum",
+		"samples": "temperature_samples",
+	})(row)
+	if err != nil || v["samples"] == 0 {
+		return nil, err
+	}
+
+	return map[string]float64{"nightly_relative": v["sum"] / v["samples"]}, nil
+}
+
+// azmZones are the fields of the heart rate zones of the Active Zone Minutes.
+var azmZones = map[string]string{"FAT_BURN": "fat_burn", "CARDIO": "cardio", "PEAK": "peak"}
+
+// readActiveZoneMinutes reads a csv file of Active Zone Minutes, which has a
+// row for every minute and zone with minutes.
+func readActiveZoneMinutes(fileName string, loc *time.Location) ([]model.Reading, error) {
+	byTime := make(map[time.Time]map[string]float64)
+	err := readCSVRows(fileName, func(row map[string]string) error {
+		ts, err := model.ParseLocalTime(row["date_time"], loc)
+		if err != nil {
+			return err
+		}
+		field, ok := azmZones[row["heart_zone_id"]]
+		if !ok {
+			return fmt.Errorf("unknown heart rate zone %q", row["heart_zone_id"])
+		}
+		v, err := strconv.ParseFloat(row["total_minutes"], 64)
+		if err != nil {
+			return fmt.Errorf("invalid total_minutes %q: %v", row["total_minutes"], err)
+		}
+		ts = ts.UTC()
+		if byTime[ts] == nil {
+			byTime[ts] = make(map[string]float64)
+		}
+		byTime[ts][field] += v
+		byTime[ts]["total"] += v
+
+		return nil
+	})
+	var res []model.Reading
+	for ts, values := range byTime {
+		res = append(res, model.Reading{Time: ts, Values: values})
+	}
+
+	return res, err
+}
+
+type vo2MaxLog struct {
+	DateTime string `json:"dateTime"`
+	Value    struct {
+		DemographicVO2Max              float64 `json:"demographicVO2Max"`
+		DemographicVO2MaxError         float64 `json:"demographicVO2MaxError"`
+		FilteredDemographicVO2Max      float64 `json:"filteredDemographicVO2Max"`
+		FilteredDemographicVO2MaxError float64 `json:"filteredDemographicVO2MaxError"`
+	} `json:"value"`
+}
+
+// readVO2Max reads a json file of daily VO2 max estimates with their error,
+// preferring the filtered ones, which the range of the api is based on.
+func readVO2Max(fileName string, loc *time.Location) ([]model.Reading, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var logs []vo2MaxLog
+	if err := json.Unmarshal(b, &logs); err != nil {
+		return nil, err
+	}
+	var res []model.Reading
+	for _, l := range logs {
+		ts, err := time.ParseInLocation("01/02/06 15:04:05", l.DateTime, loc)
+		if err != nil {
+			return nil, err
+		}
+		v, e := l.Value.FilteredDemographicVO2Max, l.Value.FilteredDemographicVO2MaxError
+		if v == 0 {
+			v, e = l.Value.DemographicVO2Max, l.Value.DemographicVO2MaxError
+		}
+		if v == 0 {
+			continue
+		}
+		day := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, loc)
+		res = append(res, model.Reading{Time: day.UTC(), Values: map[string]float64{"low": v - e, "high": v + e}})
+	}
+
+	return res, nil
+}
+
+// readWeightLogs reads a json file of weight logs, whose weights are in
+// pounds.
+func readWeightLogs(fileName string, loc *time.Location) ([]model.Reading, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var logs []model.WeightLog
+	if err := json.Unmarshal(b, &logs); err != nil {
+		return nil, err
+	}
+
+	return model.WeightReadings(logs, "01/02/06", model.PoundsToKilograms, loc)
+}
+
+// NewSeriesReader creates a new source.SeriesSource that reads the series
+// from the files of the Fitbit data export in dirPath. The times without
+// a zone in the files are wall clock times in loc.
+func NewSeriesReader(dirPath string, series model.Series, loc *time.Location) (source.SeriesSource, error) {
+	spec, ok := exportSeriesByName[series.Name]
+	if !ok {
+		return nil, fmt.Errorf("the series %v is not in the export", series.Name)
+	}
+	dirPath, err := defaultDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seriesReader{dirPath: dirPath, series: series, spec: spec, loc: loc}, nil
+}
+
+type seriesReader struct {
+	dirPath string
+	series  model.Series
+	spec    exportSeries
+	loc     *time.Location
+
+	once     sync.Once
+	readings []model.Reading
+	err      error
+}
+
+// Series TODO.
+func (r *seriesReader) Series() model.Series {
+	return r.series
+}
+
+// ReadSeries reads all the files on the first call.
+func (r *seriesReader) ReadSeries(t time.Time) ([]model.Reading, error) {
+	return r.ReadSeriesRange(t, t.AddDate(0, 0, 1))
+}
+
+// ReadSeriesRange reads all the files on the first call.
+func (r *seriesReader) ReadSeriesRange(from, to time.Time) ([]model.Reading, error) {
+	r.once.Do(func() {
+		r.readings, r.err = r.readAll()
+	})
+	if r.err != nil {
+		return nil, r.err
+	}
+	i := sort.Search(len(r.readings), func(i int) bool {
+		return !r.readings[i].Time.Before(from)
+	})
+	var res []model.Reading
+	for _, d := range r.readings[i:] {
+		if !d.Time.Before(to) {
+			break
+		}
+		res = append(res, d)
+	}
+
+	return res, nil
+}
+
+func (r *seriesReader) readAll() ([]model.Reading, error) {
+	files, err := filepath.Glob(filepath.Join(r.dirPath, r.spec.pattern))
+	if err != nil {
+		return nil, err
+	}
+	var res []model.Reading
+	readFile := r.readCSV
+	if r.spec.readFile != nil {
+		readFile = func(fileName string) ([]model.Reading, error) {
+			return r.spec.readFile(fileName, r.loc)
+		}
+	}
+	for _, f := range files {
+		readings, err := readFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", f, err)
+		}
+		res = append(res, readings...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+
+	return res, nil
+}
+
+func (r *seriesReader) readCSV(fileName string) ([]model.Reading, error) {
+	var res []model.Reading
+	err := readCSVRows(fileName, func(row map[string]string) error {
+		ts, err := model.ParseLocalTime(row[r.spec.timeColumn], r.loc)
+		if err != nil {
+			return err
+		}
+		values, err := r.spec.values(row)
+		if err != nil || len(values) == 0 {
+			return err
+		}
+		if r.series.Daily {
+			ts = ts.In(r.loc)
+			ts = time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, r.loc)
+		}
+		res = append(res, model.Reading{Time: ts.UTC(), Values: values})
+
+		return nil
+	})
+
+	return res, err
+}
+
+// readCSVRows calls fn with every row of a csv file, by column name.
+func readCSVRows(fileName string, fn func(row map[string]string) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	c := csv.NewReader(f)
+	header, err := c.Read()
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := c.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// Close TODO.
+func (r *seriesReader) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package offline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/source"
+)
+
+func writeExport(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fde-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestSeriesReader(t *testing.T) {
+	dir, cleanup := writeExport(t, map[string]string{
+		"Oxygen Saturation (SpO2)/Daily SpO2 - 2021-10-01-2021-10-31.csv": "timestamp,average_value,lower_bound,upper_bound\n" +
+			"2021-10-25T00:00:00,97.5,94.0,100.0\n" +
+			"2021-10-26T00:00:00,96.1,,99.2\n",
+		"Oxygen Saturation (SpO2)/Minute SpO2 - 2021-10-25.csv": "timestamp,value\n" +
+			"2021-10-25T23:59:30,95.7\n" +
+			"2021-10-25T03:12:00,96.2\n",
+		"Physical Activity/Active Zone Minutes - 2021-10-01.csv": "date_time,heart_zone_id,total_minutes\n" +
+			"2021-10-25T07:01,FAT_BURN,1\n" +
+			"2021-10-25T07:02,CARDIO,2\n" +
+			"2021-10-25T07:02,PEAK,2\n",
+		"Physical Activity/demographic_vo2_max-2021-10-25.json": `[{"dateTime":"10/25/21 00:00:00","value":` +
+			`{"demographicVO2Max":45.1,"demographicVO2MaxError":3.0,"filteredDemographicVO2Max":46.0,"filteredDemographicVO2MaxError":2.0}}]`,
+		"Temperature/Computed Temperature - 2021-10-01.csv": "type,sleep_start,sleep_end,temperature_samples,nightly_temperature,baseline_relative_sample_sum\n" +
+			"SKIN,2021-10-24T23:10:00,2021-10-25T07:05:00,4,33.9,-0.4\n",
+	})
+	defer cleanup()
+	day := time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		series model.Series
+		want   []model.Reading
+	}{
+		{model.SpO2, []model.Reading{{Time: day, Values: map[string]float64{"avg": 97.5, "min": 94, "max": 100}}}},
+		{model.SpO2Intraday, []model.Reading{
+			{Time: day.Add(3*time.Hour + 12*time.Minute), Values: map[string]float64{"value": 96.2}},
+			{Time: day.Add(24*time.Hour - 30*time.Second), Values: map[string]float64{"value": 95.7}},
+		}},
+		{model.SkinTemperature, []model.Reading{{Time: day, Values: map[string]float64{"nightly_relative": -0.1}}}},
+		{model.HRV, nil},
+		{model.ActiveZoneMinutes, []model.Reading{
+			{Time: day.Add(7*time.Hour + time.Minute), Values: map[string]float64{"fat_burn": 1, "total": 1}},
+			{Time: day.Add(7*time.Hour + 2*time.Minute), Values: map[string]float64{"cardio": 2, "peak": 2, "total": 4}},
+		}},
+		{model.VO2Max, []model.Reading{{Time: day, Values: map[string]float64{"low": 44, "high": 48}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.series.Name, func(t *testing.T) {
+			r, err := NewSeriesReader(dir, tt.series, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.ReadSeries(day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	r, err := NewSeriesReader(dir, model.SpO2, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ReadSeries(day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.Reading{{Time: day.AddDate(0, 0, 1), Values: map[string]float64{"avg": 96.1, "max": 99.2}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("next day: got %v, want %v", got, want)
+	}
+}
+
+func TestSeriesReaderWeight(t *testing.T) {
+	dir, cleanup := writeExport(t, map[string]string{
+		"Personal & Account/weight-2021-10-01.json": `[{"logId":1,"weight":160.0,"bmi":22.41,"fat":18.5,"date":"10/25/21","time":"07:12:34","source":"Aria"},` +
+			`{"logId":2,"weight":158.5,"bmi":22.2,"date":"10/02/21","time":"08:00:00","source":"Web"}]`,
+	})
+	defer cleanup()
+
+	r, err := NewSeriesReader(dir, model.Weight, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, ok := r.(source.SeriesRangeSource)
+	if !ok {
+		t.Fatalf("%T does not implement source.SeriesRangeSource", r)
+	}
+	got, err := rs.ReadSeriesRange(time.Date(2021, 10, 3, 0, 0, 0, 0, time.UTC), time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the export has the weight in pounds
+	pounds := 160.0
+	want := []model.Reading{{
+		Time:   time.Date(2021, 10, 25, 7, 12, 34, 0, time.UTC),
+		Values: map[string]float64{"weight": pounds * model.PoundsToKilograms, "bmi": 22.41, "fat": 18.5},
+		Tags:   map[string]string{"source": "Aria"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -18,13 +18,16 @@
 package influxdb
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	influx "github.com/influxdata/influxdb/client/v2"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
 	"github.com/ivajloip/fitbit-data-exporter/internal/model"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
 )
@@ -35,6 +38,9 @@ const (
 	RetryTimeout = 2 * time.Minute
 	// RetryPeriod gives a default retry period for retryable operations
 	RetryPeriod = 2 * time.Second
+
+	pingTimeout  = 5 * time.Second
+	writeTimeout = 30 * time.Second
 )
 
 type influxStorage struct {
@@ -51,6 +57,9 @@ type influxStorage struct {
 	flushed       chan struct{}
 	err           error
 	errLock       sync.RWMutex
+
+	closeLock sync.RWMutex
+	closed    bool
 }
 
 // NewStorage TODO.
@@ -59,6 +68,8 @@ func NewStorage(dataOwner, database, addr, username, password string) (storage.S
 		Addr:     addr,
 		Username: username,
 		Password: password,
+		// a write must not block closing the storage forever
+		Timeout: writeTimeout,
 	})
 	if err != nil {
 		return nil, err
@@ -117,12 +128,31 @@ func (i *influxStorage) setError(e error) {
 	i.errLock.Unlock()
 }
 
+// Ping TODO.
+func (i *influxStorage) Ping() error {
+	i.closeLock.RLock()
+	defer i.closeLock.RUnlock()
+	if i.closed {
+		return storage.ErrClosed
+	}
+	_, _, err := i.client.Ping(pingTimeout)
+
+	return err
+}
+
 // Close closes the handler, taking care that all the points sent before the close are written.
-// Note
 func (i *influxStorage) Close() error {
+	i.closeLock.Lock()
+	defer i.closeLock.Unlock()
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+
 	i.flushChan <- struct{}{}
 	close(i.batchChan)
 	<-i.flushed
+	_ = i.client.Close()
 
 	i.errLock.RLock()
 	err := i.err
@@ -136,6 +166,7 @@ func (i *influxStorage) processInfluxPoints() {
 	var batch influx.BatchPoints
 
 	ticker := time.NewTicker(i.batchInterval)
+	defer ticker.Stop()
 	batch, err = influx.NewBatchPoints(influx.BatchPointsConfig{
 		Database:  i.database,
 		Precision: i.precision,
@@ -145,8 +176,16 @@ func (i *influxStorage) processInfluxPoints() {
 	}
 
 	flushAndClear := func() {
+		start := time.Now()
 		err := i.client.Write(batch)
+		metrics.InfluxFlushDuration.Observe(time.Since(start).Seconds())
 		i.setError(err)
+		if err != nil {
+			metrics.InfluxFlushErrors.Inc()
+			log.WithError(err).Warn("failed to write the InfluxDB batch, it will be retried")
+		} else {
+			metrics.ReadingsSaved.WithLabelValues("influxdb").Add(float64(len(batch.Points())))
+		}
 
 		// only clear the buffer if all data is written to the server
 		if err == nil {
@@ -170,8 +209,10 @@ func (i *influxStorage) processInfluxPoints() {
 			for p := range i.batchChan {
 				batch.AddPoint(p)
 			}
+			log.WithField("points", len(batch.Points())).Info("flushing the InfluxDB batch before closing")
 			flushAndClear()
 			i.flushed <- struct{}{}
+			return
 		}
 	}
 }
@@ -190,14 +231,22 @@ func ensureDBExists(client influx.Client, db string) error {
 
 // SaveToDB TODO.
 func (i *influxStorage) Save(data []model.HeartData) error {
+	i.closeLock.RLock()
+	defer i.closeLock.RUnlock()
+	if i.closed {
+		return storage.ErrClosed
+	}
+
 	for _, d := range data {
+		// the username is a tag, so that the readings of different users
+		// at the same time are different points
+		tags := map[string]string{"username": i.username}
 		fields := map[string]interface{}{
-			"username":   i.username,
 			"bpm":        d.Value.BMP,
 			"confidence": d.Value.Confidence,
 		}
 
-		pt, err := influx.NewPoint(tableName, nil, fields, d.DateTime)
+		pt, err := influx.NewPoint(tableName, tags, fields, d.DateTime)
 		if err != nil {
 			return fmt.Errorf("failed to create influx point: %v", err)
 		}
@@ -208,15 +257,79 @@ func (i *influxStorage) Save(data []model.HeartData) error {
 }
 
 func (i *influxStorage) IsPresent(t time.Time) (bool, error) {
+	res, err := i.query("SELECT bpm FROM %s WHERE %s LIMIT 1", tableName, i.where(t, storage.DayEnd(t)))
+	if err != nil {
+		return false, err
+	}
+
+	return len(res) > 0 && len(res[0].Series) > 0, nil
+}
+
+func (i *influxStorage) Readings(from, to time.Time) ([]model.HeartData, error) {
+	res, err := i.query("SELECT bpm, confidence FROM %s WHERE %s", tableName, i.where(from, to))
+	if err != nil {
+		return nil, err
+	}
+	var data []model.HeartData
+	if len(res) == 0 || len(res[0].Series) == 0 {
+		return data, nil
+	}
+	for _, row := range res[0].Series[0].Values {
+		d, err := toHeartData(row)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, d)
+	}
+
+	return data, nil
+}
+
+// where selects the readings of the user in [from, to). The username is a
+// tag, but the heart rate readings saved by the older versions have it as a
+// field, so both are matched.
+func (i *influxStorage) where(from, to time.Time) string {
+	username := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(i.username)
+
+	return fmt.Sprintf("(\"username\"::tag = '%s' OR \"username\"::field = '%s') AND time >= %d AND time < %d",
+		username, username, from.UnixNano(), to.UnixNano())
+}
+
+func (i *influxStorage) query(format string, args ...interface{}) ([]influx.Result, error) {
 	res, err := i.client.Query(influx.Query{
-		Database: i.database,
-		Command:  fmt.Sprintf("SELECT bpm FROM %s WHERE time > %d AND time < %d + 1d", tableName, t.UnixNano(), t.UnixNano()),
+		Database:  i.database,
+		Command:   fmt.Sprintf(format, args...),
+		Precision: "ns",
 	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if res.Error() != nil {
-		return false, res.Error()
+		return nil, res.Error()
+	}
+
+	return res.Results, nil
+}
+
+// toHeartData converts a [time, bpm, confidence] row.
+func toHeartData(row []interface{}) (model.HeartData, error) {
+	var d model.HeartData
+	var values [3]int64
+	if len(row) != len(values) {
+		return d, fmt.Errorf("unexpected row %v", row)
 	}
-	return len(res.Results) > 0 && len(res.Results[0].Series) > 0, nil
+	for j, v := range row {
+		n, ok := v.(json.Number)
+		if !ok {
+			return d, fmt.Errorf("unexpected value %v in row %v", v, row)
+		}
+		var err error
+		if values[j], err = n.Int64(); err != nil {
+			return d, fmt.Errorf("unexpected value %v in row %v: %v", v, row, err)
+		}
+	}
+	d.DateTime = time.Unix(0, values[0])
+	d.Value = model.Value{BMP: int(values[1]), Confidence: int(values[2])}
+
+	return d, nil
 }
@@ -0,0 +1,102 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package influxdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage/storagetest"
+)
+
+// TestConformance needs a server, given by FDE_TEST_INFLUXDB_URL.
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("FDE_TEST_INFLUXDB_URL")
+	if addr == "" {
+		t.Skip("FDE_TEST_INFLUXDB_URL is not set")
+	}
+
+	storagetest.Run(t, func(username string) (storage.Storage, error) {
+		return NewStorage(username, "fde-test", addr, os.Getenv("FDE_TEST_INFLUXDB_USERNAME"), os.Getenv("FDE_TEST_INFLUXDB_PASSWORD"))
+	})
+}
+
+func TestWhere(t *testing.T) {
+	i := &influxStorage{username: `o'neil`}
+	from := time.Unix(0, 1000)
+	want := `("username"::tag = 'o\'neil' OR "username"::field = 'o\'neil') AND time >= 1000 AND time < 2000`
+	if got := i.where(from, from.Add(1000)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestLegacyUsernameField checks that the heart rate readings saved by the
+// older versions, with the username as a field, are found. It needs a
+// server, given by FDE_TEST_INFLUXDB_URL.
+func TestLegacyUsernameField(t *testing.T) {
+	addr := os.Getenv("FDE_TEST_INFLUXDB_URL")
+	if addr == "" {
+		t.Skip("FDE_TEST_INFLUXDB_URL is not set")
+	}
+	username, password := os.Getenv("FDE_TEST_INFLUXDB_USERNAME"), os.Getenv("FDE_TEST_INFLUXDB_PASSWORD")
+	user := fmt.Sprintf("legacy-%d", time.Now().UnixNano())
+	st, err := NewStorage(user, "fde-test", addr, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	c, err := influx.NewHTTPClient(influx.HTTPConfig{Addr: addr, Username: username, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	pt, err := influx.NewPoint(tableName, nil, map[string]interface{}{"username": user, "bpm": 60, "confidence": 1}, day.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := influx.NewBatchPoints(influx.BatchPointsConfig{Database: "fde-test", Precision: "ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.AddPoint(pt)
+	if err := c.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	present, err := st.IsPresent(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !present {
+		t.Error("IsPresent() = false for a day saved with the username as a field")
+	}
+	got, err := st.(storage.Reader).Readings(day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Value.BMP != 60 || !got[0].DateTime.Equal(day.Add(time.Hour)) {
+		t.Errorf("Readings() = %v, want the reading saved with the username as a field", got)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package influxdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// SaveSeries writes the readings as points of the measurement named after
+// the series, with a field for each recorded value and a tag for each known
+// tag.
+func (i *influxStorage) SaveSeries(s model.Series, data []model.Reading) error {
+	i.closeLock.RLock()
+	defer i.closeLock.RUnlock()
+	if i.closed {
+		return storage.ErrClosed
+	}
+
+	for _, d := range data {
+		if len(d.Values) == 0 {
+			continue
+		}
+		tags := map[string]string{"username": i.username}
+		for _, tag := range s.Tags {
+			// empty tags can not be written
+			if v := d.Tags[tag]; v != "" {
+				tags[tag] = v
+			}
+		}
+		fields := make(map[string]interface{}, len(d.Values))
+		for k, v := range d.Values {
+			fields[k] = v
+		}
+		pt, err := influx.NewPoint(s.Name, tags, fields, d.Time)
+		if err != nil {
+			return fmt.Errorf("failed to create influx point: %v", err)
+		}
+		i.batchChan <- pt
+	}
+
+	return nil
+}
+
+// IsSeriesPresent TODO.
+func (i *influxStorage) IsSeriesPresent(s model.Series, t time.Time) (bool, error) {
+	res, err := i.query("SELECT * FROM %s WHERE %s LIMIT 1", strconv.Quote(s.Name), i.where(t, storage.DayEnd(t)))
+	if err != nil {
+		return false, err
+	}
+
+	return len(res) > 0 && len(res[0].Series) > 0, nil
+}
+
+// SeriesReadings TODO.
+func (i *influxStorage) SeriesReadings(s model.Series, from, to time.Time) ([]model.Reading, error) {
+	res, err := i.query("SELECT * FROM %s WHERE %s", strconv.Quote(s.Name), i.where(from, to))
+	if err != nil {
+		return nil, err
+	}
+	var data []model.Reading
+	if len(res) == 0 || len(res[0].Series) == 0 {
+		return data, nil
+	}
+	columns := res[0].Series[0].Columns
+	for _, row := range res[0].Series[0].Values {
+		d, err := toReading(s, columns, row)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, d)
+	}
+
+	return data, nil
+}
+
+// toReading converts a row with the time, the fields and the tags of the
+// series among the columns. The fields and the tags that are not known are
+// null.
+func toReading(s model.Series, columns []string, row []interface{}) (model.Reading, error) {
+	d := model.Reading{Values: make(map[string]float64)}
+	if len(row) != len(columns) {
+		return d, fmt.Errorf("unexpected row %v", row)
+	}
+	fields := make(map[string]bool, len(s.Fields))
+	for _, f := range s.Fields {
+		fields[f] = true
+	}
+	tags := make(map[string]bool, len(s.Tags))
+	for _, tag := range s.Tags {
+		tags[tag] = true
+	}
+	for j, c := range columns {
+		if row[j] == nil || (c != "time" && !fields[c] && !tags[c]) {
+			continue
+		}
+		if tags[c] {
+			v, ok := row[j].(string)
+			if !ok {
+				return d, fmt.Errorf("unexpected tag %v in row %v", row[j], row)
+			}
+			// the points without the tag have it empty
+			if v == "" {
+				continue
+			}
+			if d.Tags == nil {
+				d.Tags = make(map[string]string)
+			}
+			d.Tags[c] = v
+			continue
+		}
+		n, ok := row[j].(json.Number)
+		if !ok {
+			return d, fmt.Errorf("unexpected value %v in row %v", row[j], row)
+		}
+		if c == "time" {
+			ns, err := n.Int64()
+			if err != nil {
+				return d, fmt.Errorf("unexpected time %v in row %v: %v", n, row, err)
+			}
+			d.Time = time.Unix(0, ns)
+			continue
+		}
+		v, err := n.Float64()
+		if err != nil {
+			return d, fmt.Errorf("unexpected value %v in row %v: %v", n, row, err)
+		}
+		d.Values[c] = v
+	}
+
+	return d, nil
+}
@@ -18,14 +18,73 @@
 package storage
 
 import (
+	"errors"
 	"time"
 
 	"github.com/ivajloip/fitbit-data-exporter/internal/model"
 )
 
-// Storage TODO.
+// ErrClosed is returned when saving to a closed Storage.
+var ErrClosed = errors.New("storage is closed")
+
+// Storage keeps the readings of a single user.
+//
+// IsPresent reports whether a reading of the user is stored in the day
+// starting at t, see DayEnd. Saving a reading with the same time as a stored
+// one replaces it. Close flushes the buffered readings; closing again is a
+// no-op and saving afterwards returns ErrClosed.
+//
+// See storagetest for the tests of this contract.
 type Storage interface {
 	IsPresent(t time.Time) (bool, error)
 	Save(data []model.HeartData) error
 	Close() error
 }
+
+// Reader is implemented by the storages that can return the stored readings.
+type Reader interface {
+	// Readings returns the readings of the user in [from, to) sorted by
+	// time.
+	Readings(from, to time.Time) ([]model.HeartData, error)
+}
+
+// SeriesStorage is implemented by the storages that keep the series other
+// than the heart rate of the user. It follows the contract of Storage for
+// every series.
+type SeriesStorage interface {
+	// IsSeriesPresent reports whether a reading of the series is stored in
+	// the day starting at t.
+	IsSeriesPresent(s model.Series, t time.Time) (bool, error)
+	SaveSeries(s model.Series, data []model.Reading) error
+	// SeriesReadings returns the readings of the series in [from, to)
+	// sorted by time.
+	SeriesReadings(s model.Series, from, to time.Time) ([]model.Reading, error)
+}
+
+// SeriesCreator is implemented by the storages that need to create the
+// schema of the series configured at run time, rather than migrating it.
+type SeriesCreator interface {
+	// CreateSeries creates the schema of the series if missing, adding
+	// the fields and the tags that are missing.
+	CreateSeries(s model.Series) error
+}
+
+// Pinger is implemented by the storages that can check the connectivity to
+// their backend.
+type Pinger interface {
+	// Ping returns an error if the backend is not reachable and ErrClosed
+	// after Close.
+	Ping() error
+}
+
+// DayEnd returns the end of the day starting at t, exclusive. The day is a
+// calendar day in t.Location(), so it lasts 23 or 25 hours when the clock
+// changes.
+func DayEnd(t time.Time) time.Time {
+	return t.AddDate(0, 0, 1)
+}
+
+// DayStart returns the start of the day of t in t.Location().
+func DayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// DB keeps the readings of all the users in memory, as a database server
+// would. It is meant for tests and is the reference implementation of the
+// storage.Storage contract.
+type DB struct {
+	mu   sync.RWMutex
+	data map[string]map[int64]model.HeartData // by user and unix nano time
+	// by user, series and time and key
+	series map[string]map[string]map[readingKey]model.Reading
+}
+
+// NewDB returns an empty DB.
+func NewDB() *DB {
+	return &DB{
+		data:   make(map[string]map[int64]model.HeartData),
+		series: make(map[string]map[string]map[readingKey]model.Reading),
+	}
+}
+
+// Storage returns a storage for the readings of the user in the DB.
+func (db *DB) Storage(username string) *Storage {
+	return &Storage{db: db, username: username}
+}
+
+// Storage is a storage.Storage that keeps the readings in a DB.
+type Storage struct {
+	db       *DB
+	username string
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewStorage returns a storage in a new, empty, DB.
+func NewStorage(username string) *Storage {
+	return NewDB().Storage(username)
+}
+
+// Save TODO.
+func (s *Storage) Save(data []model.HeartData) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return storage.ErrClosed
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	readings := s.db.data[s.username]
+	if readings == nil {
+		readings = make(map[int64]model.HeartData)
+		s.db.data[s.username] = readings
+	}
+	for _, d := range data {
+		readings[d.DateTime.UnixNano()] = d
+	}
+
+	return nil
+}
+
+// IsPresent TODO.
+func (s *Storage) IsPresent(t time.Time) (bool, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	end := storage.DayEnd(t)
+	for _, d := range s.db.data[s.username] {
+		if !d.DateTime.Before(t) && d.DateTime.Before(end) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Readings TODO.
+func (s *Storage) Readings(from, to time.Time) ([]model.HeartData, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	var res []model.HeartData
+	for _, d := range s.db.data[s.username] {
+		if !d.DateTime.Before(from) && d.DateTime.Before(to) {
+			res = append(res, d)
+		}
+	}
+	sortByTime(res)
+
+	return res, nil
+}
+
+// Close TODO.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+
+	return nil
+}
+
+// Ping TODO.
+func (s *Storage) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return storage.ErrClosed
+	}
+
+	return nil
+}
+
+// Data returns all the saved readings of the user sorted by time.
+func (s *Storage) Data() []model.HeartData {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	res := make([]model.HeartData, 0, len(s.db.data[s.username]))
+	for _, d := range s.db.data[s.username] {
+		res = append(res, d)
+	}
+	sortByTime(res)
+
+	return res
+}
+
+func sortByTime(data []model.HeartData) {
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].DateTime.Before(data[j].DateTime)
+	})
+}
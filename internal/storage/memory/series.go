@@ -0,0 +1,100 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// readingKey tells apart the readings of a series, by unix nano time and the
+// value of the key tag of the series, if any.
+type readingKey struct {
+	time int64
+	key  string
+}
+
+// SaveSeries TODO.
+func (s *Storage) SaveSeries(series model.Series, data []model.Reading) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return storage.ErrClosed
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	byName := s.db.series[s.username]
+	if byName == nil {
+		byName = make(map[string]map[readingKey]model.Reading)
+		s.db.series[s.username] = byName
+	}
+	readings := byName[series.Name]
+	if readings == nil {
+		readings = make(map[readingKey]model.Reading)
+		byName[series.Name] = readings
+	}
+	for _, d := range data {
+		values := make(map[string]float64, len(d.Values))
+		for k, v := range d.Values {
+			values[k] = v
+		}
+		var tags map[string]string
+		if len(d.Tags) > 0 {
+			tags = make(map[string]string, len(d.Tags))
+			for k, v := range d.Tags {
+				tags[k] = v
+			}
+		}
+		readings[readingKey{d.Time.UnixNano(), d.Tags[series.Key]}] = model.Reading{Time: d.Time, Values: values, Tags: tags}
+	}
+
+	return nil
+}
+
+// IsSeriesPresent TODO.
+func (s *Storage) IsSeriesPresent(series model.Series, t time.Time) (bool, error) {
+	data, err := s.SeriesReadings(series, t, storage.DayEnd(t))
+
+	return len(data) > 0, err
+}
+
+// SeriesReadings TODO.
+func (s *Storage) SeriesReadings(series model.Series, from, to time.Time) ([]model.Reading, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	var res []model.Reading
+	for _, d := range s.db.series[s.username][series.Name] {
+		if !d.Time.Before(from) && d.Time.Before(to) {
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Time.Equal(res[j].Time) {
+			return res[i].Time.Before(res[j].Time)
+		}
+
+		return res[i].Tags[series.Key] < res[j].Tags[series.Key]
+	})
+
+	return res, nil
+}
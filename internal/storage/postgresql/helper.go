@@ -21,8 +21,7 @@ import (
 	"database/sql"
 	"fmt"
 
-	// register postgresql driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	migrate "github.com/rubenv/sql-migrate"
 
 	"github.com/gocraft/dbr/v2"
@@ -64,6 +63,169 @@ func migrationsUp(db *sql.DB) error {
 				)`},
 				Down: []string{"DROP TABLE heart_reading"},
 			},
+			&migrate.Migration{
+				Id: "124",
+				Up: []string{
+					`DELETE FROM heart_reading a USING heart_reading b
+	WHERE a.id < b.id AND a.username = b.username AND a.time = b.time`,
+					`CREATE UNIQUE INDEX heart_reading_username_time_idx ON heart_reading (username, time)`,
+				},
+				Down: []string{"DROP INDEX heart_reading_username_time_idx"},
+			},
+			&migrate.Migration{
+				Id: "125",
+				Up: concat(
+					seriesTable("spo2", "avg", "min", "max"),
+					seriesTable("spo2_intraday", "value"),
+					seriesTable("hrv", "daily_rmssd", "deep_rmssd"),
+					seriesTable("hrv_intraday", "rmssd", "coverage", "lf", "hf"),
+					seriesTable("breathing_rate", "full_sleep", "deep_sleep", "light_sleep", "rem_sleep"),
+					seriesTable("skin_temperature", "nightly_relative"),
+				),
+				Down: []string{
+					"DROP TABLE spo2",
+					"DROP TABLE spo2_intraday",
+					"DROP TABLE hrv",
+					"DROP TABLE hrv_intraday",
+					"DROP TABLE breathing_rate",
+					"DROP TABLE skin_temperature",
+				},
+			},
+			&migrate.Migration{
+				Id: "126",
+				Up: concat(
+					seriesTable("weight", "weight", "bmi", "fat"),
+					[]string{"ALTER TABLE weight ADD COLUMN source text"},
+				),
+				Down: []string{"DROP TABLE weight"},
+			},
+			&migrate.Migration{
+				Id: "127",
+				Up: concat(
+					seriesTable("activity", "duration", "active_duration", "calories", "average_heart_rate", "active_zone_minutes", "steps"),
+					[]string{"ALTER TABLE activity ADD COLUMN name text, ADD COLUMN log_type text, ADD COLUMN log_id text"},
+					seriesTable("activity_trackpoint", "latitude", "longitude", "altitude", "distance", "heart_rate"),
+					[]string{
+						"ALTER TABLE activity_trackpoint ADD COLUMN log_id text",
+						"CREATE INDEX activity_trackpoint_log_id_idx ON activity_trackpoint (username, log_id)",
+					},
+				),
+				Down: []string{
+					"DROP TABLE activity",
+					"DROP TABLE activity_trackpoint",
+				},
+			},
+			&migrate.Migration{
+				Id: "128",
+				Up: concat(
+					seriesTable("active_zone_minutes", "fat_burn", "cardio", "peak", "total"),
+					seriesTable("vo2_max", "low", "high"),
+				),
+				Down: []string{
+					"DROP TABLE active_zone_minutes",
+					"DROP TABLE vo2_max",
+				},
+			},
+			&migrate.Migration{
+				Id: "129",
+				Up: concat(
+					seriesTable("food_log", "calories", "carbs", "fat", "fiber", "protein", "sodium", "amount"),
+					[]string{
+						"ALTER TABLE food_log ADD COLUMN log_id text not null, ADD COLUMN meal_type text, ADD COLUMN name text, " +
+							"ADD COLUMN brand text, ADD COLUMN unit text",
+						// the foods logged on a day have the same time
+						"DROP INDEX food_log_username_time_idx",
+						"CREATE UNIQUE INDEX food_log_username_time_log_id_idx ON food_log (username, time, log_id)",
+						// a row per nutrient of every food, to aggregate
+						// them without listing the columns
+						`CREATE VIEW food_nutrient AS
+  SELECT f.id AS food_log_id, f.username, f.time, f.log_id, f.meal_type, n.nutrient, n.value
+  FROM food_log f CROSS JOIN LATERAL (VALUES
+    ('calories', f.calories), ('carbs', f.carbs), ('fat', f.fat),
+    ('fiber', f.fiber), ('protein', f.protein), ('sodium', f.sodium)
+  ) AS n(nutrient, value)
+  WHERE n.value IS NOT NULL`,
+					},
+					seriesTable("water", "amount"),
+				),
+				Down: []string{
+					"DROP VIEW food_nutrient",
+					"DROP TABLE food_log",
+					"DROP TABLE water",
+				},
+			},
+			&migrate.Migration{
+				Id: "130",
+				Up: concat(
+					seriesTable("device", "battery_level", "last_sync"),
+					[]string{
+						"ALTER TABLE device ADD COLUMN device_id text not null, ADD COLUMN model text, ADD COLUMN type text, ADD COLUMN battery text",
+						// the devices polled at the same time
+						"DROP INDEX device_username_time_idx",
+						"CREATE UNIQUE INDEX device_username_time_device_id_idx ON device (username, time, device_id)",
+					},
+				),
+				Down: []string{"DROP TABLE device"},
+			},
+			&migrate.Migration{
+				Id: "131",
+				Up: concat(
+					seriesTable("record", "heart_rate", "cadence", "latitude", "longitude", "altitude", "distance", "speed"),
+					[]string{"ALTER TABLE record ADD COLUMN source text"},
+				),
+				Down: []string{"DROP TABLE record"},
+			},
+			&migrate.Migration{
+				Id: "132",
+				Up: concat(
+					seriesTable("steps", "steps"),
+					[]string{
+						"ALTER TABLE steps ADD COLUMN source text not null",
+						// the sources counting the same steps
+						"DROP INDEX steps_username_time_idx",
+						"CREATE UNIQUE INDEX steps_username_time_source_idx ON steps (username, time, source)",
+					},
+					seriesTable("resting_heart_rate", "value"),
+					[]string{
+						"ALTER TABLE resting_heart_rate ADD COLUMN source text not null",
+						"DROP INDEX resting_heart_rate_username_time_idx",
+						"CREATE UNIQUE INDEX resting_heart_rate_username_time_source_idx ON resting_heart_rate (username, time, source)",
+					},
+				),
+				Down: []string{
+					"DROP TABLE steps",
+					"DROP TABLE resting_heart_rate",
+				},
+			},
+			&migrate.Migration{
+				Id: "133",
+				Up: concat(
+					seriesTable("sleep_stage", "duration"),
+					[]string{
+						"ALTER TABLE sleep_stage ADD COLUMN source text not null, ADD COLUMN stage text",
+						"DROP INDEX sleep_stage_username_time_idx",
+						"CREATE UNIQUE INDEX sleep_stage_username_time_source_idx ON sleep_stage (username, time, source)",
+					},
+				),
+				Down: []string{"DROP TABLE sleep_stage"},
+			},
+			&migrate.Migration{
+				Id: "134",
+				Up: []string{
+					// the records were only written by the fit command,
+					// whose source is garmin by default
+					"UPDATE record SET source = 'garmin' WHERE source IS NULL",
+					"ALTER TABLE record ALTER COLUMN source SET NOT NULL",
+					// the devices recording at the same time
+					"DROP INDEX record_username_time_idx",
+					"CREATE UNIQUE INDEX record_username_time_source_idx ON record (username, time, source)",
+				},
+				Down: []string{
+					"DROP INDEX record_username_time_source_idx",
+					"CREATE UNIQUE INDEX record_username_time_idx ON record (username, time)",
+					"ALTER TABLE record ALTER COLUMN source DROP NOT NULL",
+				},
+			},
 		},
 	}
 
@@ -72,3 +234,31 @@ func migrationsUp(db *sql.DB) error {
 
 	return err
 }
+
+// seriesTable returns the statements creating the table of a series of
+// readings, with a nullable column for each field. It must not be changed, as
+// the migrations using it have already run.
+func seriesTable(name string, fields ...string) []string {
+	columns := ""
+	for _, f := range fields {
+		columns += fmt.Sprintf(",\n  %s double precision", pq.QuoteIdentifier(f))
+	}
+
+	return []string{
+		fmt.Sprintf(`CREATE TABLE %s (
+  id bigserial primary key,
+  username varchar(256) not null,
+  time timestamp with time zone not null%s
+)`, name, columns),
+		fmt.Sprintf("CREATE UNIQUE INDEX %s_username_time_idx ON %s (username, time)", name, name),
+	}
+}
+
+func concat(statements ...[]string) []string {
+	var res []string
+	for _, s := range statements {
+		res = append(res, s...)
+	}
+
+	return res
+}
@@ -18,11 +18,13 @@
 package postgresql
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	dbr "github.com/gocraft/dbr/v2"
-	log "github.com/sirupsen/logrus"
 
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
 	"github.com/ivajloip/fitbit-data-exporter/internal/model"
 	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
 )
@@ -32,6 +34,9 @@ const tableName = "heart_reading"
 type pgStorage struct {
 	s        *dbr.Session
 	username string
+
+	mu     sync.RWMutex
+	closed bool
 }
 
 // NewStorage TODO.
@@ -44,15 +49,20 @@ func NewStorage(username string, s *dbr.Session) storage.Storage {
 
 // SaveToDB TODO.
 func (p *pgStorage) Save(data []model.HeartData) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return storage.ErrClosed
+	}
+
 	for _, d := range data {
-		ts := d.DateTime
-		_, err := p.s.InsertInto(tableName).
-			Columns("username", "time", "value", "confidence").
-			Values(p.username, ts, d.Value.BMP, d.Value.Confidence).
-			Exec()
+		_, err := p.s.InsertBySql(`INSERT INTO `+tableName+` (username, time, value, confidence) VALUES (?, ?, ?, ?)
+ON CONFLICT (username, time) DO UPDATE SET value = EXCLUDED.value, confidence = EXCLUDED.confidence`,
+			p.username, d.DateTime, d.Value.BMP, d.Value.Confidence).Exec()
 		if err != nil {
-			log.WithError(err).Infof("failed to add: %v %v %v", p.username, ts.Add(3*time.Hour), d.Value)
+			return fmt.Errorf("failed to add %v %v: %v", d.DateTime, d.Value, err)
 		}
+		metrics.ReadingsSaved.WithLabelValues("postgresql").Inc()
 	}
 
 	return nil
@@ -60,11 +70,55 @@ func (p *pgStorage) Save(data []model.HeartData) error {
 
 func (p *pgStorage) IsPresent(t time.Time) (bool, error) {
 	var res int
-	err := p.s.Select("count(*)").From(tableName).Where("time - ? > interval '0 minutes' AND time - ? < interval '23 hours'", t, t).LoadOne(&res)
+	err := p.s.Select("count(*)").From(tableName).
+		Where("username = ? AND time >= ? AND time < ?", p.username, t, storage.DayEnd(t)).
+		LoadOne(&res)
 
 	return res > 0, err
 }
 
+type reading struct {
+	Time       time.Time `db:"time"`
+	Value      int       `db:"value"`
+	Confidence int       `db:"confidence"`
+}
+
+func (p *pgStorage) Readings(from, to time.Time) ([]model.HeartData, error) {
+	var rows []reading
+	_, err := p.s.Select("time", "value", "confidence").From(tableName).
+		Where("username = ? AND time >= ? AND time < ?", p.username, from, to).
+		OrderBy("time").
+		Load(&rows)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]model.HeartData, 0, len(rows))
+	for _, r := range rows {
+		res = append(res, model.HeartData{
+			DateTime: r.Time,
+			Value:    model.Value{BMP: r.Value, Confidence: r.Confidence},
+		})
+	}
+
+	return res, nil
+}
+
+// Ping TODO.
+func (p *pgStorage) Ping() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return storage.ErrClosed
+	}
+
+	return p.s.Ping()
+}
+
+// Close does not close the session, which can be shared between storages.
 func (p *pgStorage) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+
 	return nil
 }
@@ -0,0 +1,45 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package postgresql
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage/storagetest"
+)
+
+// TestConformance needs a database, given by FDE_TEST_POSTGRESQL_DSN.
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("FDE_TEST_POSTGRESQL_DSN")
+	if dsn == "" {
+		t.Skip("FDE_TEST_POSTGRESQL_DSN is not set")
+	}
+	db, err := OpenSQLDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	storagetest.Run(t, func(username string) (storage.Storage, error) {
+		return NewStorage(username, db), nil
+	})
+}
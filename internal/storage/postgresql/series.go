@@ -0,0 +1,195 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package postgresql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// SaveSeries upserts the readings in the table of the series, see
+// seriesTable, with a text column for each tag. The fields and the tags that
+// are not known are NULL.
+func (p *pgStorage) SaveSeries(s model.Series, data []model.Reading) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return storage.ErrClosed
+	}
+
+	columns := quoteColumns(s)
+	updates := make([]string, len(columns))
+	for i, c := range columns {
+		updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", c, c)
+	}
+	conflict := "username, time"
+	if s.Key != "" {
+		conflict += ", " + pq.QuoteIdentifier(s.Key)
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (username, time, %s) VALUES (?, ?%s)
+ON CONFLICT (%s) DO UPDATE SET %s`,
+		pq.QuoteIdentifier(s.Name), strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)), conflict, strings.Join(updates, ", "))
+	for _, d := range data {
+		args := []interface{}{p.username, d.Time}
+		for _, f := range s.Fields {
+			if v, ok := d.Values[f]; ok {
+				args = append(args, v)
+			} else {
+				args = append(args, nil)
+			}
+		}
+		for _, tag := range s.Tags {
+			if v, ok := d.Tags[tag]; ok {
+				args = append(args, v)
+			} else {
+				args = append(args, nil)
+			}
+		}
+		if _, err := p.s.InsertBySql(query, args...).Exec(); err != nil {
+			return fmt.Errorf("failed to add %v %v %v: %v", s.Name, d.Time, d.Values, err)
+		}
+		metrics.ReadingsSaved.WithLabelValues("postgresql").Inc()
+	}
+
+	return nil
+}
+
+// IsSeriesPresent TODO.
+func (p *pgStorage) IsSeriesPresent(s model.Series, t time.Time) (bool, error) {
+	var res int
+	err := p.s.Select("count(*)").From(pq.QuoteIdentifier(s.Name)).
+		Where("username = ? AND time >= ? AND time < ?", p.username, t, storage.DayEnd(t)).
+		LoadOne(&res)
+
+	return res > 0, err
+}
+
+// SeriesReadings TODO.
+func (p *pgStorage) SeriesReadings(s model.Series, from, to time.Time) ([]model.Reading, error) {
+	rows, err := p.s.Select(append([]string{"time"}, quoteColumns(s)...)...).From(pq.QuoteIdentifier(s.Name)).
+		Where("username = ? AND time >= ? AND time < ?", p.username, from, to).
+		OrderBy(orderBy(s)).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var res []model.Reading
+	values := make([]sql.NullFloat64, len(s.Fields))
+	tags := make([]sql.NullString, len(s.Tags))
+	dest := []interface{}{new(time.Time)}
+	for i := range values {
+		dest = append(dest, &values[i])
+	}
+	for i := range tags {
+		dest = append(dest, &tags[i])
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := model.Reading{Time: *dest[0].(*time.Time), Values: make(map[string]float64)}
+		for i, f := range s.Fields {
+			if values[i].Valid {
+				r.Values[f] = values[i].Float64
+			}
+		}
+		for i, tag := range s.Tags {
+			if !tags[i].Valid {
+				continue
+			}
+			if r.Tags == nil {
+				r.Tags = make(map[string]string)
+			}
+			r.Tags[tag] = tags[i].String
+		}
+		res = append(res, r)
+	}
+
+	return res, rows.Err()
+}
+
+// CreateSeries creates the table of a series configured at run time, see
+// seriesTable, with a text column for each tag.
+func (p *pgStorage) CreateSeries(s model.Series) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return storage.ErrClosed
+	}
+	for _, stmt := range createSeriesStatements(s) {
+		if _, err := p.s.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create %v: %v", s.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// createSeriesStatements returns the statements creating the table of the
+// series and the columns that are missing, which are idempotent.
+func createSeriesStatements(s model.Series) []string {
+	table := pq.QuoteIdentifier(s.Name)
+	res := []string{fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+  id bigserial primary key,
+  username varchar(256) not null,
+  time timestamp with time zone not null
+)`, table)}
+	for _, f := range s.Fields {
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s double precision", table, pq.QuoteIdentifier(f)))
+	}
+	for _, tag := range s.Tags {
+		res = append(res, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s text", table, pq.QuoteIdentifier(tag)))
+	}
+	index, columns := s.Name+"_username_time_idx", "username, time"
+	if s.Key != "" {
+		index = s.Name + "_username_time_" + s.Key + "_idx"
+		columns += ", " + pq.QuoteIdentifier(s.Key)
+	}
+
+	return append(res, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)", pq.QuoteIdentifier(index), table, columns))
+}
+
+// orderBy sorts the readings by time and key.
+func orderBy(s model.Series) string {
+	if s.Key == "" {
+		return "time"
+	}
+
+	return "time, " + pq.QuoteIdentifier(s.Key)
+}
+
+// quoteColumns returns the columns of the fields and then the tags.
+func quoteColumns(s model.Series) []string {
+	var res []string
+	for _, c := range append(append([]string{}, s.Fields...), s.Tags...) {
+		res = append(res, pq.QuoteIdentifier(c))
+	}
+
+	return res
+}
@@ -0,0 +1,335 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package remotewrite implements a storage.Storage pushing the readings to a
+// Prometheus compatible store with the remote-write protocol.
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/metrics"
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+const (
+	// HeartRateMetric is the name of the series of the heart rate readings.
+	HeartRateMetric = "fitbit_heart_rate_bpm"
+	// ConfidenceMetric is the name of the series of their confidence.
+	ConfidenceMetric = "fitbit_heart_rate_confidence"
+
+	// batchSize is the number of readings pushed per request.
+	batchSize = 5000
+	retries   = 3
+	timeout   = 30 * time.Second
+)
+
+type remoteStorage struct {
+	client   *http.Client
+	username string
+	writeURL string
+	queryURL string
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewStorage returns a storage.Storage that pushes the readings of the user,
+// with their original timestamps, to writeURL (ex.
+// http://localhost:8428/api/v1/write for VictoriaMetrics) and checks their
+// presence with PromQL queries to the Prometheus HTTP API at queryURL (ex.
+// http://localhost:8428).
+//
+// The readings are saved in the HeartRateMetric and ConfidenceMetric series,
+// labeled with the user. Whether saving a reading twice replaces it or
+// fails depends on the store.
+func NewStorage(username, writeURL, queryURL string) storage.Storage {
+	return &remoteStorage{
+		client:   &http.Client{Timeout: timeout},
+		username: username,
+		writeURL: writeURL,
+		queryURL: queryURL,
+	}
+}
+
+// SaveToDB TODO.
+func (r *remoteStorage) Save(data []model.HeartData) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return storage.ErrClosed
+	}
+
+	data = sortedUnique(data)
+	for len(data) > 0 {
+		n := batchSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := r.push(data[:n]); err != nil {
+			return err
+		}
+		metrics.ReadingsSaved.WithLabelValues("remotewrite").Add(float64(n))
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// sortedUnique returns the readings sorted by time, keeping the last one of
+// those with the same time, as the stores expect the samples of a series to
+// be in order.
+func sortedUnique(data []model.HeartData) []model.HeartData {
+	res := make([]model.HeartData, len(data))
+	copy(res, data)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].DateTime.Before(res[j].DateTime)
+	})
+	j := 0
+	for i := range res {
+		if j > 0 && timestamp(res[j-1].DateTime) == timestamp(res[i].DateTime) {
+			res[j-1] = res[i]
+			continue
+		}
+		res[j] = res[i]
+		j++
+	}
+
+	return res[:j]
+}
+
+func (r *remoteStorage) push(data []model.HeartData) error {
+	bpm := &timeSeries{Labels: r.labels(HeartRateMetric)}
+	confidence := &timeSeries{Labels: r.labels(ConfidenceMetric)}
+	for _, d := range data {
+		ts := timestamp(d.DateTime)
+		bpm.Samples = append(bpm.Samples, &sample{Value: float64(d.Value.BMP), Timestamp: ts})
+		confidence.Samples = append(confidence.Samples, &sample{Value: float64(d.Value.Confidence), Timestamp: ts})
+	}
+	b, err := proto.Marshal(&writeRequest{Timeseries: []*timeSeries{bpm, confidence}})
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, b)
+
+	for attempt := 1; ; attempt++ {
+		retry, err := r.send(body)
+		if err == nil || !retry || attempt == retries {
+			return err
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("remote write failed, retrying")
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// send reports whether the request can be retried when it fails.
+func (r *remoteStorage) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, r.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("remote write failed: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode/100 == 5, fmt.Errorf("remote write failed: %v %s", resp.Status, msg)
+}
+
+// labels returns the labels of the series sorted by name, as required by
+// the protocol.
+func (r *remoteStorage) labels(name string) []*label {
+	return []*label{
+		{Name: "__name__", Value: name},
+		{Name: "user", Value: r.username},
+	}
+}
+
+func (r *remoteStorage) IsPresent(t time.Time) (bool, error) {
+	res, err := r.query("count_over_time", HeartRateMetric, t, storage.DayEnd(t))
+	if err != nil {
+		return false, err
+	}
+
+	return len(res) > 0 && len(res[0].Value) == 2, nil
+}
+
+func (r *remoteStorage) Readings(from, to time.Time) ([]model.HeartData, error) {
+	bpm, err := r.query("", HeartRateMetric, from, to)
+	if err != nil {
+		return nil, err
+	}
+	confidence, err := r.query("", ConfidenceMetric, from, to)
+	if err != nil {
+		return nil, err
+	}
+	confidences := make(map[int64]int)
+	for _, s := range confidence {
+		for _, v := range s.Values {
+			ts, value, err := parseSample(v)
+			if err != nil {
+				return nil, err
+			}
+			confidences[ts] = int(value)
+		}
+	}
+	var res []model.HeartData
+	for _, s := range bpm {
+		for _, v := range s.Values {
+			ts, value, err := parseSample(v)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, model.HeartData{
+				DateTime: time.Unix(0, ts*int64(time.Millisecond)),
+				Value:    model.Value{BMP: int(value), Confidence: confidences[ts]},
+			})
+		}
+	}
+
+	return res, nil
+}
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []series `json:"result"`
+	} `json:"data"`
+}
+
+type series struct {
+	// Value is set for instant vectors and Values for range vectors.
+	Value  []json.Number   `json:"value"`
+	Values [][]json.Number `json:"values"`
+}
+
+// query evaluates fn over the samples of the user's series of the metric in
+// [from, to), with millisecond precision. Without fn, the samples are
+// returned.
+func (r *remoteStorage) query(fn, metric string, from, to time.Time) ([]series, error) {
+	// a range selector evaluated at t selects the samples in (t - range, t]
+	end := timestamp(to) - 1
+	q := fmt.Sprintf("%s{user=%s}[%dms]", metric, strconv.Quote(r.username), end-timestamp(from)+1)
+	if fn != "" {
+		q = fmt.Sprintf("%s(%s)", fn, q)
+	}
+	params := url.Values{
+		"query": {q},
+		"time":  {strconv.FormatFloat(float64(end)/1000, 'f', 3, 64)},
+	}
+	resp, err := r.client.Get(r.queryURL + "/api/v1/query?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	var res queryResponse
+	if err := dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("query failed: %v %v", resp.Status, err)
+	}
+	if res.Status != "success" {
+		return nil, fmt.Errorf("query failed: %v %v", resp.Status, res.Error)
+	}
+
+	return res.Data.Result, nil
+}
+
+// Ping evaluates a constant query, as neither Prometheus nor VictoriaMetrics
+// can check the write endpoint without writing.
+func (r *remoteStorage) Ping() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return storage.ErrClosed
+	}
+	resp, err := r.client.Get(r.queryURL + "/api/v1/query?" + url.Values{"query": {"vector(1)"}}.Encode())
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var res queryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("query failed: %v %v", resp.Status, err)
+	}
+	if res.Status != "success" {
+		return fmt.Errorf("query failed: %v %v", resp.Status, res.Error)
+	}
+
+	return nil
+}
+
+// parseSample parses a [seconds, "value"] pair, returning the time in
+// milliseconds.
+func parseSample(v []json.Number) (int64, float64, error) {
+	if len(v) != 2 {
+		return 0, 0, fmt.Errorf("unexpected sample %v", v)
+	}
+	seconds, err := v[0].Float64()
+	if err != nil {
+		return 0, 0, err
+	}
+	value, err := strconv.ParseFloat(v[1].String(), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int64(math.Round(seconds * 1000)), value, nil
+}
+
+func (r *remoteStorage) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+
+	return nil
+}
+
+// timestamp returns the time in milliseconds, the precision of the samples.
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
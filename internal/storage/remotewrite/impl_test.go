@@ -0,0 +1,158 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage/storagetest"
+)
+
+// fakeStore is a remote-write receiver answering the PromQL queries of the
+// storage. Like VictoriaMetrics, it keeps the last sample pushed for a
+// series and a time.
+type fakeStore struct {
+	mu     sync.Mutex
+	series map[string]map[int64]float64 // by metric and user
+}
+
+var queryRe = regexp.MustCompile(`^(count_over_time\()?(\w+)\{user=("(?:[^"\\]|\\.)*")\}\[(\d+)ms\]\)?$`)
+
+func newFakeStore() *httptest.Server {
+	f := &fakeStore{series: make(map[string]map[int64]float64)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/write", f.handleWrite)
+	mux.HandleFunc("/api/v1/query", f.handleQuery)
+
+	return httptest.NewServer(mux)
+}
+
+func (f *fakeStore) handleWrite(w http.ResponseWriter, r *http.Request) {
+	compressed, _ := ioutil.ReadAll(r.Body)
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil || r.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, fmt.Sprintf("invalid snappy body: %v", err), http.StatusBadRequest)
+		return
+	}
+	var req writeRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ts := range req.Timeseries {
+		if len(ts.Labels) != 2 || ts.Labels[0].Name != "__name__" || ts.Labels[1].Name != "user" {
+			http.Error(w, fmt.Sprintf("unexpected labels %v", ts.Labels), http.StatusBadRequest)
+			return
+		}
+		key := ts.Labels[0].Value + "/" + ts.Labels[1].Value
+		if f.series[key] == nil {
+			f.series[key] = make(map[int64]float64)
+		}
+		for i, s := range ts.Samples {
+			if i > 0 && s.Timestamp <= ts.Samples[i-1].Timestamp {
+				http.Error(w, "out of order samples", http.StatusBadRequest)
+				return
+			}
+			f.series[key][s.Timestamp] = s.Value
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeStore) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("query") == "vector(1)" {
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[0,"1"]}]}}`)
+		return
+	}
+	m := queryRe.FindStringSubmatch(r.FormValue("query"))
+	end, err := strconv.ParseFloat(r.FormValue("time"), 64)
+	if m == nil || err != nil {
+		http.Error(w, `{"status":"error","error":"unsupported query"}`, http.StatusBadRequest)
+		return
+	}
+	user, _ := strconv.Unquote(m[3])
+	rng, _ := strconv.ParseInt(m[4], 10, 64)
+	endMs := int64(math.Round(end * 1000))
+
+	f.mu.Lock()
+	var samples []int64
+	values := f.series[m[2]+"/"+user]
+	for ts := range values {
+		if ts > endMs-rng && ts <= endMs {
+			samples = append(samples, ts)
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	result := "[]"
+	switch {
+	case len(samples) == 0:
+	case m[1] != "":
+		result = fmt.Sprintf(`[{"metric":{},"value":[%.3f,"%d"]}]`, end, len(samples))
+	default:
+		result = `[{"metric":{},"values":[`
+		for i, ts := range samples {
+			if i > 0 {
+				result += ","
+			}
+			result += fmt.Sprintf(`[%.3f,"%v"]`, float64(ts)/1000, values[ts])
+		}
+		result += "]}]"
+	}
+	fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":%s}}`, result)
+}
+
+func TestConformance(t *testing.T) {
+	srv := newFakeStore()
+	defer srv.Close()
+
+	storagetest.Run(t, func(username string) (storage.Storage, error) {
+		return NewStorage(username, srv.URL+"/api/v1/write", srv.URL), nil
+	})
+}
+
+// TestConformanceRemote needs a store, given by FDE_TEST_REMOTE_WRITE_URL
+// and FDE_TEST_PROMETHEUS_QUERY_URL.
+func TestConformanceRemote(t *testing.T) {
+	writeURL := os.Getenv("FDE_TEST_REMOTE_WRITE_URL")
+	queryURL := os.Getenv("FDE_TEST_PROMETHEUS_QUERY_URL")
+	if writeURL == "" || queryURL == "" {
+		t.Skip("FDE_TEST_REMOTE_WRITE_URL or FDE_TEST_PROMETHEUS_QUERY_URL is not set")
+	}
+
+	storagetest.Run(t, func(username string) (storage.Storage, error) {
+		return NewStorage(username, writeURL, queryURL), nil
+	})
+}
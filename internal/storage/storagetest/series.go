@@ -0,0 +1,212 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+package storagetest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// seriesStorage returns the storage as a storage.SeriesStorage, skipping the
+// test if it does not implement it.
+func seriesStorage(t *testing.T, st storage.Storage) storage.SeriesStorage {
+	t.Helper()
+	ss, ok := st.(storage.SeriesStorage)
+	if !ok {
+		t.Skipf("%T does not implement storage.SeriesStorage", st)
+	}
+
+	return ss
+}
+
+// savedSeries saves the readings of the series and closes the storage,
+// flushing them, before returning a new storage for the same user.
+func (s suite) savedSeries(t *testing.T, username string, series model.Series, data ...model.Reading) (storage.SeriesStorage, func()) {
+	st, closeFn := s.mustOpen(t, username)
+	ss := seriesStorage(t, st)
+	if err := ss.SaveSeries(series, data); err != nil {
+		closeFn()
+		t.Fatalf("SaveSeries() error = %v", err)
+	}
+	closeFn()
+	st, closeFn = s.mustOpen(t, username)
+
+	return seriesStorage(t, st), closeFn
+}
+
+func checkSeriesPresence(t *testing.T, st storage.SeriesStorage, series model.Series, tests []presence) {
+	t.Helper()
+	for _, tt := range tests {
+		got, err := st.IsSeriesPresent(series, tt.t)
+		if err != nil {
+			t.Fatalf("%s: IsSeriesPresent(%v, %v) error = %v", tt.name, series.Name, tt.t, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: IsSeriesPresent(%v, %v) = %v, want %v", tt.name, series.Name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func checkSeriesReadings(t *testing.T, st storage.SeriesStorage, series model.Series, from, to time.Time, want ...model.Reading) {
+	t.Helper()
+	got, err := st.SeriesReadings(series, from, to)
+	if err != nil {
+		t.Fatalf("SeriesReadings(%v) error = %v", series.Name, err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("SeriesReadings(%v) = %v, want %v", series.Name, got, want)
+	}
+	for i := range got {
+		if !got[i].Time.Equal(want[i].Time) || !reflect.DeepEqual(got[i].Values, want[i].Values) ||
+			len(got[i].Tags) != len(want[i].Tags) || (len(want[i].Tags) > 0 && !reflect.DeepEqual(got[i].Tags, want[i].Tags)) {
+			t.Errorf("SeriesReadings(%v)[%d] = %v, want %v", series.Name, i, got[i], want[i])
+		}
+	}
+}
+
+func (s suite) testSeries(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	spo2 := model.Reading{Time: day, Values: map[string]float64{"avg": 95.5, "min": 92, "max": 99}}
+	ss, closeFn := s.savedSeries(t, s.user(t, "u"), model.SpO2, spo2)
+	defer closeFn()
+
+	checkSeriesPresence(t, ss, model.SpO2, []presence{
+		{"day of the reading", day, true},
+		{"previous day", day.AddDate(0, 0, -1), false},
+		{"next day", day.AddDate(0, 0, 1), false},
+	})
+	checkSeriesPresence(t, ss, model.HRVIntraday, []presence{{"other series", day, false}})
+	checkSeriesReadings(t, ss, model.SpO2, day, day.AddDate(0, 0, 1), spo2)
+	if st, ok := ss.(storage.Storage); ok {
+		checkPresence(t, st, []presence{{"heart rate", day, false}})
+	}
+}
+
+func (s suite) testSeriesIntraday(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	first := model.Reading{Time: day.Add(3 * time.Hour), Values: map[string]float64{"rmssd": 30.5, "coverage": 0.9, "lf": 200, "hf": 120}}
+	second := model.Reading{Time: day.Add(3*time.Hour + 5*time.Minute), Values: map[string]float64{"rmssd": 28}}
+	ss, closeFn := s.savedSeries(t, s.user(t, "u"), model.HRVIntraday, second, first)
+	defer closeFn()
+
+	// sorted, and the fields that were not recorded are missing
+	checkSeriesReadings(t, ss, model.HRVIntraday, day, day.AddDate(0, 0, 1), first, second)
+	checkSeriesReadings(t, ss, model.HRVIntraday, first.Time, second.Time, first)
+}
+
+func (s suite) testSeriesTags(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	scale := model.Reading{
+		Time:   day.Add(7 * time.Hour),
+		Values: map[string]float64{"weight": 72.5, "bmi": 22.4, "fat": 18.5},
+		Tags:   map[string]string{"source": "Aria"},
+	}
+	unknown := model.Reading{Time: day.Add(20 * time.Hour), Values: map[string]float64{"fat": 19}}
+	ss, closeFn := s.savedSeries(t, s.user(t, "u"), model.Weight, unknown, scale)
+	defer closeFn()
+
+	checkSeriesReadings(t, ss, model.Weight, day, day.AddDate(0, 0, 1), scale, unknown)
+}
+
+func (s suite) testSeriesKey(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	username := s.user(t, "u")
+	food := func(logID string, calories float64) model.Reading {
+		return model.Reading{
+			Time:   day,
+			Values: map[string]float64{"calories": calories, "amount": 1},
+			Tags:   map[string]string{"log_id": logID, "meal_type": "Breakfast"},
+		}
+	}
+	_, closeFn := s.savedSeries(t, username, model.Food, food("1", 95), food("2", 120))
+	closeFn()
+	ss, closeFn := s.savedSeries(t, username, model.Food, food("1", 80))
+	defer closeFn()
+
+	// the readings at the same time are told apart by the key
+	checkSeriesReadings(t, ss, model.Food, day, day.AddDate(0, 0, 1), food("1", 80), food("2", 120))
+}
+
+func (s suite) testSeriesCreated(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	username := s.user(t, "u")
+	series := model.Series{Name: "storagetest_configured", Fields: []string{"value"}, Tags: []string{"source"}, Key: "source"}
+	st, closeFn := s.mustOpen(t, username)
+	if c, ok := st.(storage.SeriesCreator); ok {
+		// creating it again, ex. on the next run, adds the new fields
+		for _, fields := range [][]string{{"value"}, {"value", "extra"}} {
+			created := series
+			created.Fields = fields
+			if err := c.CreateSeries(created); err != nil {
+				closeFn()
+				t.Fatalf("CreateSeries() error = %v", err)
+			}
+		}
+		series.Fields = []string{"value", "extra"}
+	}
+	closeFn()
+	reading := func(source string, v float64) model.Reading {
+		return model.Reading{Time: day, Values: map[string]float64{"value": v}, Tags: map[string]string{"source": source}}
+	}
+	ss, closeFn := s.savedSeries(t, username, series, reading("a", 1), reading("b", 2))
+	defer closeFn()
+
+	checkSeriesReadings(t, ss, series, day, day.AddDate(0, 0, 1), reading("a", 1), reading("b", 2))
+}
+
+func (s suite) testSeriesDuplicates(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	username := s.user(t, "u")
+	_, closeFn := s.savedSeries(t, username, model.SkinTemperature,
+		model.Reading{Time: day, Values: map[string]float64{"nightly_relative": -0.5}})
+	closeFn()
+	want := model.Reading{Time: day, Values: map[string]float64{"nightly_relative": 0.25}}
+	ss, closeFn := s.savedSeries(t, username, model.SkinTemperature, want)
+	defer closeFn()
+
+	checkSeriesReadings(t, ss, model.SkinTemperature, day, day.AddDate(0, 0, 1), want)
+}
+
+func (s suite) testSeriesUsers(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	alice := model.Reading{Time: day, Values: map[string]float64{"full_sleep": 15}}
+	_, closeFn := s.savedSeries(t, s.user(t, "alice"), model.BreathingRate, alice)
+	closeFn()
+	bob, closeFn := s.mustOpen(t, s.user(t, "bob"))
+	defer closeFn()
+
+	checkSeriesPresence(t, seriesStorage(t, bob), model.BreathingRate, []presence{{"other user's day", day, false}})
+}
+
+func (s suite) testSeriesClose(t *testing.T) {
+	st, err := s.open(s.user(t, "u"))
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	r := model.Reading{Time: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), Values: map[string]float64{"avg": 95}}
+	if err := seriesStorage(t, st).SaveSeries(model.SpO2, []model.Reading{r}); err != storage.ErrClosed {
+		t.Errorf("SaveSeries() after Close() error = %v, want %v", err, storage.ErrClosed)
+	}
+}
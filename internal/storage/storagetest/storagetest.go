@@ -0,0 +1,263 @@
+// Copyright 2019 Ivaylo Petrov. All rights reserved.
+//
+// This file is part of Fitbit Data Exporter.
+//
+// Fitbit Data Exporter is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Fitbit Data Exporter is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Fitbit Data Exporter.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package storagetest checks that a storage.Storage implements the contract
+// described in the storage package, so that all the backends behave the same.
+package storagetest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ivajloip/fitbit-data-exporter/internal/model"
+	"github.com/ivajloip/fitbit-data-exporter/internal/storage"
+)
+
+// OpenFunc opens a storage for the user. The storages opened by the same
+// OpenFunc must share the backend, as the ones opened on the same database.
+// The returned storages must also implement storage.Reader.
+type OpenFunc func(username string) (storage.Storage, error)
+
+// Run runs the conformance tests. The backend does not need to be empty, as
+// every test uses its own users.
+func Run(t *testing.T, open OpenFunc) {
+	s := suite{open: open, prefix: fmt.Sprintf("storagetest-%d", time.Now().UnixNano())}
+	t.Run("Presence", s.testPresence)
+	t.Run("TimeZones", s.testTimeZones)
+	t.Run("DST", s.testDST)
+	t.Run("Duplicates", s.testDuplicates)
+	t.Run("Users", s.testUsers)
+	t.Run("Close", s.testClose)
+	t.Run("Ping", s.testPing)
+	t.Run("Series", s.testSeries)
+	t.Run("SeriesIntraday", s.testSeriesIntraday)
+	t.Run("SeriesTags", s.testSeriesTags)
+	t.Run("SeriesKey", s.testSeriesKey)
+	t.Run("SeriesCreated", s.testSeriesCreated)
+	t.Run("SeriesDuplicates", s.testSeriesDuplicates)
+	t.Run("SeriesUsers", s.testSeriesUsers)
+	t.Run("SeriesClose", s.testSeriesClose)
+}
+
+type suite struct {
+	open   OpenFunc
+	prefix string
+}
+
+// user returns a username unique to the test.
+func (s suite) user(t *testing.T, name string) string {
+	return s.prefix + "-" + t.Name() + "-" + name
+}
+
+// mustOpen opens a storage for the user, which is closed by the returned
+// function.
+func (s suite) mustOpen(t *testing.T, username string) (storage.Storage, func()) {
+	st, err := s.open(username)
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	if _, ok := st.(storage.Reader); !ok {
+		t.Fatalf("%T does not implement storage.Reader", st)
+	}
+
+	return st, func() {
+		if err := st.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}
+}
+
+// saved saves the readings and closes the storage, flushing them, before
+// returning a new storage for the same user.
+func (s suite) saved(t *testing.T, username string, data ...model.HeartData) (storage.Storage, func()) {
+	st, closeFn := s.mustOpen(t, username)
+	if err := st.Save(data); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	closeFn()
+
+	return s.mustOpen(t, username)
+}
+
+type presence struct {
+	name string
+	t    time.Time
+	want bool
+}
+
+func checkPresence(t *testing.T, st storage.Storage, tests []presence) {
+	t.Helper()
+	for _, tt := range tests {
+		got, err := st.IsPresent(tt.t)
+		if err != nil {
+			t.Fatalf("%s: IsPresent(%v) error = %v", tt.name, tt.t, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: IsPresent(%v) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func checkReadings(t *testing.T, st storage.Storage, from, to time.Time, want ...model.HeartData) {
+	t.Helper()
+	got, err := st.(storage.Reader).Readings(from, to)
+	if err != nil {
+		t.Fatalf("Readings() error = %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Readings() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if !got[i].DateTime.Equal(want[i].DateTime) || got[i].Value != want[i].Value {
+			t.Errorf("Readings()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func reading(t time.Time, bpm int) model.HeartData {
+	return model.HeartData{DateTime: t, Value: model.Value{BMP: bpm, Confidence: 1}}
+}
+
+func (s suite) testPresence(t *testing.T) {
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	st, closeFn := s.saved(t, s.user(t, "u"), reading(day, 60))
+	defer closeFn()
+
+	checkPresence(t, st, []presence{
+		{"start is inclusive", day, true},
+		{"end is exclusive", day.AddDate(0, 0, -1), false},
+		{"reading at the end of the day", day.AddDate(0, 0, -1).Add(time.Second), true},
+		{"reading before the day", day.Add(time.Second), false},
+		{"empty day", day.AddDate(0, 0, 1), false},
+	})
+	checkReadings(t, st, day, day.AddDate(0, 0, 1), reading(day, 60))
+	checkReadings(t, st, day.AddDate(0, 0, -1), day)
+}
+
+func (s suite) testTimeZones(t *testing.T) {
+	eest := time.FixedZone("EEST", 3*60*60)
+	// 2019-05-31 21:30 UTC
+	ts := time.Date(2019, 6, 1, 0, 30, 0, 0, eest)
+	st, closeFn := s.saved(t, s.user(t, "u"), reading(ts, 60))
+	defer closeFn()
+
+	checkPresence(t, st, []presence{
+		{"day in the same zone", time.Date(2019, 6, 1, 0, 0, 0, 0, eest), true},
+		{"day in UTC containing the instant", time.Date(2019, 5, 31, 0, 0, 0, 0, time.UTC), true},
+		{"same date in UTC", time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), false},
+	})
+	checkReadings(t, st, ts.UTC(), ts.UTC().Add(time.Second), reading(ts, 60))
+}
+
+func (s suite) testDST(t *testing.T) {
+	sofia, err := time.LoadLocation("Europe/Sofia")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	// the clock moved forward on 2019-03-31 and back on 2019-10-27
+	afterShortDay := time.Date(2019, 4, 1, 0, 30, 0, 0, sofia)
+	endOfLongDay := time.Date(2019, 10, 27, 23, 30, 0, 0, sofia)
+	st, closeFn := s.saved(t, s.user(t, "u"), reading(afterShortDay, 60), reading(endOfLongDay, 70))
+	defer closeFn()
+
+	checkPresence(t, st, []presence{
+		{"23h day", time.Date(2019, 3, 31, 0, 0, 0, 0, sofia), false},
+		{"day after the 23h day", time.Date(2019, 4, 1, 0, 0, 0, 0, sofia), true},
+		{"25h day", time.Date(2019, 10, 27, 0, 0, 0, 0, sofia), true},
+		{"day after the 25h day", time.Date(2019, 10, 28, 0, 0, 0, 0, sofia), false},
+	})
+}
+
+func (s suite) testDuplicates(t *testing.T) {
+	ts := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	username := s.user(t, "u")
+	st, closeFn := s.mustOpen(t, username)
+	if err := st.Save([]model.HeartData{reading(ts, 60), reading(ts, 61)}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	closeFn()
+	// saved again, as when a day is read twice
+	st, closeFn = s.saved(t, username, reading(ts, 62), reading(ts.Add(time.Second), 63))
+	defer closeFn()
+
+	checkReadings(t, st, ts, ts.Add(time.Minute), reading(ts, 62), reading(ts.Add(time.Second), 63))
+}
+
+func (s suite) testUsers(t *testing.T) {
+	ts := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	alice, closeAlice := s.saved(t, s.user(t, "alice"), reading(ts, 60))
+	defer closeAlice()
+	bob, closeBob := s.mustOpen(t, s.user(t, "bob"))
+	defer closeBob()
+
+	checkPresence(t, bob, []presence{{"other user's day", day, false}})
+	checkReadings(t, bob, day, day.AddDate(0, 0, 1))
+
+	bob, closeBob = s.saved(t, s.user(t, "bob"), reading(ts, 80))
+	defer closeBob()
+	checkPresence(t, bob, []presence{{"own day", day, true}})
+	checkReadings(t, bob, day, day.AddDate(0, 0, 1), reading(ts, 80))
+	checkReadings(t, alice, day, day.AddDate(0, 0, 1), reading(ts, 60))
+}
+
+func (s suite) testClose(t *testing.T) {
+	ts := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	st, err := s.open(s.user(t, "u"))
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	if err := st.Save([]model.HeartData{reading(ts, 60)}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+	if err := st.Save([]model.HeartData{reading(ts, 61)}); err != storage.ErrClosed {
+		t.Errorf("Save() after Close() error = %v, want %v", err, storage.ErrClosed)
+	}
+
+	// the readings saved before closing are flushed
+	st, closeFn := s.mustOpen(t, s.user(t, "u"))
+	defer closeFn()
+	checkReadings(t, st, ts, ts.Add(time.Second), reading(ts, 60))
+}
+
+func (s suite) testPing(t *testing.T) {
+	st, err := s.open(s.user(t, "u"))
+	if err != nil {
+		t.Fatalf("failed to open the storage: %v", err)
+	}
+	p, ok := st.(storage.Pinger)
+	if !ok {
+		_ = st.Close()
+		t.Skipf("%T does not implement storage.Pinger", st)
+	}
+	if err := p.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := p.Ping(); err != storage.ErrClosed {
+		t.Errorf("Ping() after Close() error = %v, want %v", err, storage.ErrClosed)
+	}
+}